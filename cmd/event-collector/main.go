@@ -2,20 +2,29 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/spf13/viper"
 
 	"github.com/couchbase/k8s-event-collector/pkg/config"
 	evcol "github.com/couchbase/k8s-event-collector/pkg/event-collector"
+	"github.com/couchbase/k8s-event-collector/pkg/eventstash"
+	"github.com/couchbase/k8s-event-collector/pkg/filters"
+	"github.com/couchbase/k8s-event-collector/pkg/incidents"
 	"github.com/couchbase/k8s-event-collector/pkg/plugins"
+	"github.com/couchbase/k8s-event-collector/pkg/schedule"
+	"github.com/couchbase/k8s-event-collector/pkg/silences"
 	"github.com/couchbase/k8s-event-collector/pkg/stashserver"
+	"github.com/couchbase/k8s-event-collector/pkg/triggers"
 	"github.com/couchbase/k8s-event-collector/pkg/version"
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -32,8 +41,8 @@ func main() {
 	logf.SetLogger(zap.New(zap.UseDevMode(false)))
 	log.Info(fmt.Sprintf("Starting %s: %s", version.Application, version.WithBuildNumberAndRevision()))
 
-	// Create Client
-	kubeClient, err := getKubeClient()
+	// Create Clients
+	kubeClient, dynamicClient, err := getKubeClients()
 
 	if err != nil {
 		panic(err)
@@ -51,62 +60,366 @@ func main() {
 		KubeClient: kubeClient,
 		Namespace:  ns,
 	}
-	addFilterFunction(&eventcollector, cfg.EventFilters, kubeClient)
-	addActionFunc(&eventcollector, cfg)
+	collectionFilter := filters.NewFilterSet("eventFilters", "", cfg.EventFilters, kubeClient)
+	eventcollector.FilterFunc = collectionFilter.Match
 
 	// Create and setup stashServer
-	stashServer := stashserver.NewStashServer(&eventcollector, cfg.MaxStashes)
-	eventcollector.ActionCallback = func(in *corev1.Event) {
-		stashServer.CreateBufferStash()
+	stashServer := stashserver.NewStashServer(&eventcollector, cfg.StashDir, cfg.MaxStashes)
+	stashServer.SetCollectorInfo(version.WithRevision(), configHash(cfg), eventcollector.GetNamespace())
+	stashServer.SetMaxStashAge(cfg.MaxStashAge)
+	setStashQuota(cfg, stashServer)
+	if err := stashServer.SetCompression(cfg.StashCompression); err != nil {
+		log.Error(err, "Invalid stash compression, stashes will be stored uncompressed")
 	}
+	stashServer.AddFilterSet(collectionFilter)
+
+	var actions []evcol.ActionFunc
+
+	rules := createTriggerRules(cfg, stashServer, kubeClient, &eventcollector)
+	for _, rule := range rules {
+		stashServer.AddFilterSet(rule.Filter)
+	}
+	if len(rules) != 0 {
+		actions = append(actions, rules.Handle)
+	}
+
+	if detector := addAnomalyDetector(cfg, &eventcollector, stashServer); detector != nil {
+		actions = append(actions, detector.Handle)
+	}
+
+	if tracker := addIncidentTracker(cfg, stashServer, kubeClient); tracker != nil {
+		actions = append(actions, tracker.Handle)
+	}
+
+	if len(actions) != 0 {
+		eventcollector.ActionCallback = func(in *corev1.Event) {
+			for _, action := range actions {
+				action(in)
+			}
+		}
+	}
+
+	silenceStore := silences.NewStore(stashServer.StashDir())
+	silenceStore.AddConfigured(cfg.Silences)
+	stashServer.SetSilencer(silenceStore)
+	stashServer.AddHandler("/silences", silenceStore)
+	stashServer.AddHandler("/silences/", silenceStore)
+
 	plugins.AddPlugins(stashServer, cfg.StashCompletionPlugins, kubeClient)
+	addAlertReceiver(cfg, &eventcollector, stashServer)
+
+	// Scheduled stashes retention is set before the server purges stashes
+	addScheduledStashes(cfg, stashServer)
 
 	// Start Server and Logger
 	go func() {
 		stashServer.Run(cfg.Port)
 	}()
 
+	addPodWatcher(cfg, &eventcollector, stashServer)
+	addConditionWatchers(cfg, &eventcollector, stashServer, dynamicClient)
+	addLogWatchers(cfg, &eventcollector, stashServer)
+
+	if cfg.WatchEventStashes {
+		controller := eventstash.NewController(dynamicClient, kubeClient, stashServer, eventcollector.GetNamespace())
+		go controller.Run(context.Background())
+	}
+
 	eventcollector.Run()
 }
 
-func addActionFunc(el *evcol.EventCollector, cfg config.EventCollectorConfiguration) {
+// getTriggerRuleConfigs returns the configured trigger rules, the legacy
+// stashTriggers and stashOnWarningEvents options are converted into rules
+func getTriggerRuleConfigs(cfg config.EventCollectorConfiguration) []config.StashTriggerConfiguration {
+	var ruleConfigs []config.StashTriggerConfiguration
+
 	if cfg.StashTrigger != nil {
-		eventType := cfg.StashTrigger.EventType
-		if eventType == "" && cfg.StashTrigger.EventFilters == nil {
-			eventType = corev1.EventTypeWarning
+		rule := *cfg.StashTrigger
+		if rule.Name == "" {
+			rule.Name = "stashTriggers"
 		}
-		configFilterFunc := createFilterFuncFromConfigFilters(cfg.StashTrigger.EventFilters, el.KubeClient)
+		ruleConfigs = append(ruleConfigs, rule)
+	} else if cfg.StashOnWarnings {
+		ruleConfigs = append(ruleConfigs, config.StashTriggerConfiguration{
+			Name:      "stashOnWarningEvents",
+			EventType: corev1.EventTypeWarning,
+		})
+	}
 
-		el.ActionFilterFunc = func(in *corev1.Event) bool {
-			if eventType != "" && in.Type != eventType {
-				return false
-			}
+	for i, rule := range cfg.TriggerRules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+		ruleConfigs = append(ruleConfigs, rule)
+	}
+
+	return ruleConfigs
+}
+
+// createTriggerRules creates the trigger rules which take stashes with the
+// rules own options and completion plugins, synthetic events are recorded
+// with the recorder
+func createTriggerRules(cfg config.EventCollectorConfiguration, stashServer *stashserver.StashServer, kubeClient kubernetes.Interface, recorder triggers.EventRecorder) triggers.Rules {
+	var rules triggers.Rules
+
+	for _, ruleConfig := range getTriggerRuleConfigs(cfg) {
+		fire := createStashFunc(stashServer, ruleConfig.Name, ruleConfig.Stash, ruleConfig.StashCompletionPlugins, kubeClient)
+		rule := triggers.NewRule(ruleConfig, cfg.TriggerLimits, kubeClient, recorder, fire)
+		rules = append(rules, rule)
+
+		log.Info("Added stash trigger rule", "rule", rule.Name)
+	}
+
+	return rules
+}
+
+// createStashFunc creates the function called when a trigger fires, which
+// takes a stash with the triggers own options and completion plugins
+func createStashFunc(stashServer *stashserver.StashServer, trigger string, stashConfig *config.StashConfiguration, pluginsConfig *config.CompletionPluginsConfiguration, kubeClient kubernetes.Interface) triggers.FireFunc {
+	getOpts := createStashOptionsFunc(stashServer, trigger, stashConfig, pluginsConfig, kubeClient)
+
+	return func(in *corev1.Event) {
+		opts := getOpts()
+		opts.TriggerEvent = in
+
+		stashServer.CreateTriggeredStash(opts)
+	}
+}
+
+// createStashOptionsFunc creates a function returning the options for a stash
+// taken by a trigger, the pre trigger window is relative to when it is called.
+// The triggers retention policy is set if it has one.
+func createStashOptionsFunc(stashServer *stashserver.StashServer, trigger string, stashConfig *config.StashConfiguration, pluginsConfig *config.CompletionPluginsConfiguration, kubeClient kubernetes.Interface) func() stashserver.StashOptions {
+	opts := stashserver.StashOptions{
+		Trigger:             trigger,
+		CompletionCallbacks: plugins.CreateCompletionFuncs(pluginsConfig, kubeClient),
+	}
 
-			return configFilterFunc(in)
+	var preTriggerWindow time.Duration
+	if stashConfig != nil {
+		opts.Labels = stashConfig.Labels
+		opts.Delay = stashConfig.PostTriggerDelay
+		opts.FreezeBuffer = stashConfig.FreezeBuffer
+		preTriggerWindow = stashConfig.PreTriggerWindow
+
+		if stashConfig.MaxStashes > 0 || stashConfig.MaxAge > 0 {
+			stashServer.SetTriggerRetention(trigger, stashserver.RetentionPolicy{
+				MaxStashes: stashConfig.MaxStashes,
+				MaxAge:     stashConfig.MaxAge,
+			})
 		}
-	} else if cfg.StashOnWarnings {
-		el.ActionFilterFunc = func(in *corev1.Event) bool {
-			return in.Type == corev1.EventTypeWarning
+	}
+
+	return func() stashserver.StashOptions {
+		opts := opts
+		if preTriggerWindow > 0 {
+			opts.Scope.Since = time.Now().Add(-preTriggerWindow)
 		}
+
+		return opts
+	}
+}
+
+// addAlertReceiver adds the Alertmanager webhook receiver if it is
+// configured, stashes are labelled and annotated with the alerts labels and
+// annotations
+func addAlertReceiver(cfg config.EventCollectorConfiguration, el *evcol.EventCollector, stashServer *stashserver.StashServer) {
+	amConfig := cfg.Alertmanager
+	if amConfig == nil {
+		return
+	}
+
+	name := amConfig.Name
+	if name == "" {
+		name = "alertmanager"
+	}
+
+	getOpts := createStashOptionsFunc(stashServer, name, amConfig.Stash, amConfig.StashCompletionPlugins, el.KubeClient)
+
+	receiver, err := triggers.NewAlertReceiver(*amConfig, el, func(alert triggers.Alert, in *corev1.Event) {
+		opts := getOpts()
+		opts.Source = stashserver.StashSourceAlert
+		opts.TriggerEvent = in
+
+		labels := map[string]string{}
+		for k, v := range alert.Labels {
+			labels[k] = v
+		}
+		for k, v := range opts.Labels {
+			labels[k] = v
+		}
+
+		opts.Labels = labels
+		opts.Annotations = alert.Annotations
+
+		stashServer.CreateTriggeredStash(opts)
+	})
+
+	if err != nil {
+		log.Error(err, "Invalid alertmanager configuration, ignoring")
+		return
+	}
+
+	stashServer.AddHandler("/alertmanager", receiver)
+	log.Info("Added alertmanager receiver", "trigger", receiver.Name)
+}
+
+// addPodWatcher starts the pod watcher if it is configured
+func addPodWatcher(cfg config.EventCollectorConfiguration, el *evcol.EventCollector, stashServer *stashserver.StashServer) {
+	podConfig := cfg.PodWatcher
+	if podConfig == nil {
+		return
 	}
+
+	name := podConfig.Name
+	if name == "" {
+		name = "podWatcher"
+	}
+
+	fire := createStashFunc(stashServer, name, podConfig.Stash, podConfig.StashCompletionPlugins, el.KubeClient)
+	watcher := triggers.NewPodWatcher(*podConfig, cfg.TriggerLimits, el.KubeClient, el.GetNamespace(), el, fire)
+	watcher.Run(context.Background())
+}
+
+// addAnomalyDetector starts the event rate anomaly detector if it is
+// configured, its state is served on /anomalies
+func addAnomalyDetector(cfg config.EventCollectorConfiguration, el *evcol.EventCollector, stashServer *stashserver.StashServer) *triggers.AnomalyDetector {
+	anomalyConfig := cfg.AnomalyDetection
+	if anomalyConfig == nil {
+		return nil
+	}
+
+	name := anomalyConfig.Name
+	if name == "" {
+		name = "anomalyDetection"
+	}
+
+	fire := createStashFunc(stashServer, name, anomalyConfig.Stash, anomalyConfig.StashCompletionPlugins, el.KubeClient)
+	detector := triggers.NewAnomalyDetector(*anomalyConfig, cfg.TriggerLimits, el.KubeClient, el, fire)
+
+	stashServer.AddFilterSet(detector.Filter)
+	stashServer.AddHandler("/anomalies", detector)
+
+	go detector.Run(context.Background())
+
+	return detector
 }
 
-func getKubeClient() (kubernetes.Interface, error) {
+// addIncidentTracker groups triggered stashes into incidents if configured,
+// incidents are served on /incidents
+func addIncidentTracker(cfg config.EventCollectorConfiguration, stashServer *stashserver.StashServer, kubeClient kubernetes.Interface) *incidents.Tracker {
+	if cfg.Incidents == nil {
+		return nil
+	}
+
+	tracker := incidents.NewTracker(*cfg.Incidents, stashServer, kubeClient)
+
+	if recoveryFilter := tracker.RecoveryFilter(); recoveryFilter != nil {
+		stashServer.AddFilterSet(recoveryFilter)
+	}
+
+	stashServer.SetGrouper(tracker)
+	stashServer.AddHandler("/incidents", tracker)
+	stashServer.AddHandler("/incidents/", tracker)
+
+	return tracker
+}
+
+// addConditionWatchers starts watching the configured resource conditions,
+// watchers whose resource can't be found are logged and ignored
+func addConditionWatchers(cfg config.EventCollectorConfiguration, el *evcol.EventCollector, stashServer *stashserver.StashServer, dynamicClient dynamic.Interface) {
+	for i, conditionConfig := range cfg.ConditionTriggers {
+		if conditionConfig.Name == "" {
+			conditionConfig.Name = fmt.Sprintf("condition-%d", i)
+		}
+
+		fire := createStashFunc(stashServer, conditionConfig.Name, conditionConfig.Stash, conditionConfig.StashCompletionPlugins, el.KubeClient)
+		watcher := triggers.NewConditionWatcher(conditionConfig, cfg.TriggerLimits, dynamicClient, el.KubeClient.Discovery(), el.GetNamespace(), el, fire)
+
+		if err := watcher.Run(context.Background()); err != nil {
+			log.Error(err, "Unable to watch resource conditions, ignoring", "trigger", watcher.Name)
+		}
+	}
+}
+
+// addLogWatchers starts following the logs of the configured pods, watchers
+// with invalid patterns are logged and ignored
+func addLogWatchers(cfg config.EventCollectorConfiguration, el *evcol.EventCollector, stashServer *stashserver.StashServer) {
+	for i, logConfig := range cfg.LogWatchers {
+		if logConfig.Name == "" {
+			logConfig.Name = fmt.Sprintf("logWatcher-%d", i)
+		}
+
+		fire := createStashFunc(stashServer, logConfig.Name, logConfig.Stash, logConfig.StashCompletionPlugins, el.KubeClient)
+		watcher, err := triggers.NewLogWatcher(logConfig, cfg.TriggerLimits, el.KubeClient, el.GetNamespace(), el, fire)
+
+		if err != nil {
+			log.Error(err, "Invalid log watcher, ignoring", "trigger", logConfig.Name)
+			continue
+		}
+
+		watcher.Run(context.Background())
+	}
+}
+
+// addScheduledStashes starts taking the configured scheduled stashes, invalid
+// schedules are logged and ignored
+func addScheduledStashes(cfg config.EventCollectorConfiguration, stashServer *stashserver.StashServer) {
+	scheduler := schedule.Scheduler{}
+
+	for i, scheduleConfig := range cfg.ScheduledStashes {
+		name := scheduleConfig.Name
+		if name == "" {
+			name = fmt.Sprintf("schedule-%d", i)
+		}
+
+		opts := stashserver.StashOptions{
+			Trigger:   "schedule/" + name,
+			Labels:    scheduleConfig.Labels,
+			Scheduled: true,
+		}
+
+		stashServer.SetTriggerRetention(opts.Trigger, stashserver.RetentionPolicy{
+			MaxStashes: scheduleConfig.MaxStashes,
+			MaxAge:     scheduleConfig.MaxAge,
+		})
+
+		err := scheduler.Add(name, scheduleConfig.Schedule, func() {
+			stashServer.CreateStash(opts)
+		})
+
+		if err != nil {
+			log.Error(err, "Invalid stash schedule, ignoring", "schedule", name)
+			continue
+		}
+
+		log.Info("Added scheduled stash", "schedule", name)
+	}
+
+	scheduler.Run(context.Background())
+}
+
+func getKubeClients() (kubernetes.Interface, dynamic.Interface, error) {
 	kubeConfig, err := getKubeConfig()
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(kubeConfig)
+
+	if err != nil {
+		return nil, nil, err
 	}
 
-	dynamic.NewForConfig(kubeConfig)
 	kubeClient, err := kubernetes.NewForConfig(kubeConfig)
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 
 	}
 
-	return kubeClient, nil
+	return kubeClient, dynamicClient, nil
 }
 
 func getKubeConfig() (*rest.Config, error) {
@@ -128,6 +441,35 @@ func getKubeConfig() (*rest.Config, error) {
 	return nil, errors.Join(errs...)
 }
 
+// configHash returns a hash of the config, which is recorded in stashes so
+// stashes taken with different configs can be told apart
+func configHash(cfg config.EventCollectorConfiguration) string {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		log.Error(err, "Failed to hash config")
+		return ""
+	}
+
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// setStashQuota sets the stash quota, which is a quantity such as 400Mi
+func setStashQuota(cfg config.EventCollectorConfiguration, stashServer *stashserver.StashServer) {
+	if cfg.StashQuota == "" {
+		return
+	}
+
+	quota, err := resource.ParseQuantity(cfg.StashQuota)
+	if err != nil {
+		log.Error(err, "Invalid stash quota, stashes will not be limited by size", "stashQuota", cfg.StashQuota)
+		return
+	}
+
+	stashServer.SetStashQuota(quota.Value())
+}
+
 func loadConfig() config.EventCollectorConfiguration {
 	viper.SetConfigName("config.yaml")
 	viper.SetConfigType("yaml")
@@ -140,6 +482,7 @@ func loadConfig() config.EventCollectorConfiguration {
 	viper.SetDefault("bufferSize", 100)
 	viper.SetDefault("port", "8080")
 	viper.SetDefault("maxStashes", "20")
+	viper.SetDefault("stashDir", stashserver.DefaultStashDir)
 
 	if err != nil {
 		log.Info("WARN: Failed to read config file", "error", err)
@@ -158,61 +501,6 @@ func loadConfig() config.EventCollectorConfiguration {
 	return cfg
 }
 
-func addFilterFunction(el *evcol.EventCollector, filters []config.KubernetesResourceFilter, kubeClient kubernetes.Interface) {
-	if len(filters) == 0 {
-		return
-	}
-
-	el.FilterFunc = createFilterFuncFromConfigFilters(filters, kubeClient)
-}
-
-func createFilterFuncFromConfigFilters(filters []config.KubernetesResourceFilter, kubeClient kubernetes.Interface) evcol.FilterFunc {
-	if len(filters) == 0 {
-		return func(in *corev1.Event) bool {
-			return true
-		}
-	}
-
-	selectors := make([]labels.Selector, len(filters))
-	for i, f := range filters {
-		if len(f.Labels) != 0 {
-			sel := labels.SelectorFromSet(labels.Set(f.Labels))
-			selectors[i] = sel
-		}
-	}
-
-	return func(in *corev1.Event) bool {
-		for i, f := range filters {
-			if f.APIVersion != "" && f.APIVersion != in.InvolvedObject.APIVersion {
-				continue
-			}
-
-			if f.Resource != "" && f.Resource != in.InvolvedObject.Kind {
-				continue
-			}
-
-			if sel := selectors[i]; sel != nil {
-				switch in.InvolvedObject.Kind {
-				case "Pod":
-					p, err := kubeClient.CoreV1().Pods(in.Namespace).Get(context.Background(), in.InvolvedObject.Name, metav1.GetOptions{})
-					return (err == nil) && sel.Matches(labels.Set(p.Labels))
-				case "Deployment":
-					d, err := kubeClient.AppsV1().Deployments(in.Namespace).Get(context.Background(), in.InvolvedObject.Name, metav1.GetOptions{})
-					return (err == nil) && sel.Matches(labels.Set(d.Labels))
-				case "PersistentVolumeClaim":
-					pvc, err := kubeClient.CoreV1().PersistentVolumeClaims(in.Namespace).Get(context.Background(), in.InvolvedObject.Name, metav1.GetOptions{})
-					return (err == nil) && sel.Matches(labels.Set(pvc.Labels))
-				default:
-					return false
-				}
-			}
-
-			return true
-		}
-		return false
-	}
-}
-
 func getNamespace() (string, error) {
 	b, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
 
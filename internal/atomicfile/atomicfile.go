@@ -0,0 +1,59 @@
+// Package atomicfile writes files so a crash or failed write never leaves a
+// partially written file in their place.
+package atomicfile
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+var log = logf.Log.WithName("atomicfile")
+
+// TempFileExtension is added to files while they are written, they are only
+// renamed to their final name once complete
+const TempFileExtension = ".tmp"
+
+// WriteFile writes a file by writing a temporary file, syncing it to disk and
+// renaming it. If writing fails the temporary file is removed and an existing
+// file is left as it was.
+func WriteFile(path string, write func(w io.Writer) error) error {
+	tmp := path + TempFileExtension
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+
+	if err != nil {
+		if rmErr := os.Remove(tmp); rmErr != nil && !errors.Is(rmErr, os.ErrNotExist) {
+			log.Error(rmErr, "Failed to remove partially written file", "file", tmp)
+		}
+
+		return err
+	}
+
+	// The rename is only durable once the directory is synced
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return nil
+}
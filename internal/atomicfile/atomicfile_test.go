@@ -0,0 +1,38 @@
+package atomicfile
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.json")
+
+	if err := WriteFile(path, func(w io.Writer) error {
+		_, err := w.Write([]byte("first"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed write leaves the existing file as it was
+	failed := errors.New("failed")
+	if err := WriteFile(path, func(w io.Writer) error {
+		w.Write([]byte("partial"))
+		return failed
+	}); !errors.Is(err, failed) {
+		t.Errorf("Expected the write to fail, got %v", err)
+	}
+
+	if b, err := os.ReadFile(path); err != nil || string(b) != "first" {
+		t.Errorf("Expected the existing file to be kept, got %q %v", b, err)
+	}
+
+	if _, err := os.Stat(path + TempFileExtension); !os.IsNotExist(err) {
+		t.Errorf("Expected the temporary file to be removed")
+	}
+}
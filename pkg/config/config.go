@@ -1,14 +1,34 @@
 package config
 
-// EventCollectorConfiguration is the top level config for the event collector
+import "time"
+
+// EventCollectorConfiguration is the top level config for the event collector.
+// It is decoded by viper using mapstructure, which ignores yaml tags and
+// matches keys to field names, so fields named differently to their keys
+// need mapstructure tags.
 type EventCollectorConfiguration struct {
 	Port                   string                          `yaml:"port"`
 	BufferSize             int                             `yaml:"bufferSize"`
 	StashCompletionPlugins *CompletionPluginsConfiguration `yaml:"stashCompletionPlugins"`
 	EventFilters           []KubernetesResourceFilter      `yaml:"eventFilter"`
-	StashOnWarnings        bool                            `yaml:"stashOnWarningEvents"`
-	StashTrigger           *StashTriggerConfiguration      `yaml:"stashTriggers"`
+	StashOnWarnings        bool                            `yaml:"stashOnWarningEvents" mapstructure:"stashOnWarningEvents"`
+	StashTrigger           *StashTriggerConfiguration      `yaml:"stashTriggers" mapstructure:"stashTriggers"`
+	TriggerRules           []StashTriggerConfiguration     `yaml:"triggerRules"`
+	TriggerLimits          *TriggerLimitsConfiguration     `yaml:"triggerLimits"`
 	MaxStashes             int                             `yaml:"maxStashes"`
+	MaxStashAge            time.Duration                   `yaml:"maxStashAge"`
+	StashDir               string                          `yaml:"stashDir"`
+	StashQuota             string                          `yaml:"stashQuota"`
+	StashCompression       string                          `yaml:"stashCompression"`
+	WatchEventStashes      bool                            `yaml:"watchEventStashes"`
+	ScheduledStashes       []ScheduledStashConfiguration   `yaml:"scheduledStashes"`
+	PodWatcher             *PodWatcherConfiguration        `yaml:"podWatcher"`
+	ConditionTriggers      []ConditionTriggerConfiguration `yaml:"conditionTriggers"`
+	Alertmanager           *AlertmanagerConfiguration      `yaml:"alertmanager"`
+	AnomalyDetection       *AnomalyDetectionConfiguration  `yaml:"anomalyDetection"`
+	LogWatchers            []LogWatcherConfiguration       `yaml:"logWatchers"`
+	Silences               []SilenceConfiguration          `yaml:"silences"`
+	Incidents              *IncidentConfiguration          `yaml:"incidents"`
 }
 
 // CompletionPluginsConfiguration is the config for the plugins
@@ -23,13 +43,261 @@ type KubernetesEventCompletionConfiguration struct {
 
 // KubernetesResourceFilter is a simple config to filter events based on API version, resource kind and/or labels
 type KubernetesResourceFilter struct {
-	APIVersion string            `yaml:"apiVersion"`
-	Resource   string            `yaml:"resource"`
-	Labels     map[string]string `yaml:"labels"`
+	APIVersion string `yaml:"apiVersion"`
+	Resource   string `yaml:"resource"`
+	// Name and Namespace optionally restrict the filter to a single object
+	Name      string            `yaml:"name"`
+	Namespace string            `yaml:"namespace"`
+	Labels    map[string]string `yaml:"labels"`
 }
 
 // StashTriggerConfiguration is a config for triggering automated stashes
 type StashTriggerConfiguration struct {
+	// Name identifies the rule, it is recorded against the stashes it triggers
+	Name         string `yaml:"name"`
 	EventType    string
 	EventFilters []KubernetesResourceFilter
+	// Threshold is optional, if set the trigger only fires when enough
+	// matching events are seen within a window
+	Threshold *ThresholdConfiguration `yaml:"threshold"`
+	// ExpectEvery optionally makes this an absence rule, which fires when no
+	// matching events have been seen for this long instead of when they are
+	ExpectEvery time.Duration `yaml:"expectEvery"`
+	// Limits overrides the top level trigger limits for this rule
+	Limits *TriggerLimitsConfiguration `yaml:"limits"`
+	// Stash is optional config for the stashes taken by this rule
+	Stash *StashConfiguration `yaml:"stash"`
+	// StashCompletionPlugins are run for stashes taken by this rule in
+	// addition to the top level plugins
+	StashCompletionPlugins *CompletionPluginsConfiguration `yaml:"stashCompletionPlugins"`
+}
+
+// StashConfiguration is a config for the stashes taken by a trigger rule
+type StashConfiguration struct {
+	// Labels are recorded against the stash
+	Labels map[string]string `yaml:"labels"`
+	// PreTriggerWindow only includes events which occurred within this long
+	// before the trigger fired
+	PreTriggerWindow time.Duration `yaml:"preTriggerWindow"`
+	// PostTriggerDelay keeps collecting events for this long after the
+	// trigger fires before writing the stash
+	PostTriggerDelay time.Duration `yaml:"postTriggerDelay"`
+	// FreezeBuffer stops events in the buffer being evicted between the
+	// trigger firing and the stash being written, once the buffers capacity of
+	// new events has been held any more are dropped
+	FreezeBuffer bool `yaml:"freezeBuffer"`
+	// MaxStashes is how many of the triggers stashes are kept, separately
+	// from other stashes, if set
+	MaxStashes int `yaml:"maxStashes"`
+	// MaxAge is how long the triggers stashes are kept, it defaults to the
+	// top level maxStashAge
+	MaxAge time.Duration `yaml:"maxAge"`
+}
+
+// ThresholdConfiguration is a config for triggers which fire when a number of matching events are seen within a window
+type ThresholdConfiguration struct {
+	// Count is the number of matching events needed for the trigger to fire
+	Count int `yaml:"count"`
+	// Window is the sliding window events are counted over, defaults to 5m
+	// if the count is more than one
+	Window time.Duration `yaml:"window"`
+	// GroupBy optionally counts events separately per "object", "reason" or "kind"
+	GroupBy string `yaml:"groupBy"`
+	// CountIncrements counts increments of an event's count rather than
+	// each event once, so repeated events are counted each time they occur
+	CountIncrements bool `yaml:"countIncrements"`
+}
+
+// TriggerLimitsConfiguration is a config for limiting how often automated stashes are taken
+type TriggerLimitsConfiguration struct {
+	// Debounce waits until no triggering events have been seen for this
+	// long before taking a stash
+	Debounce time.Duration `yaml:"debounce"`
+	// MaxWait is the longest a stash is delayed by debouncing, from the
+	// first triggering event, if set
+	MaxWait time.Duration `yaml:"maxWait"`
+	// Cooldown is the minimum time between stashes from a trigger
+	Cooldown time.Duration `yaml:"cooldown"`
+	// ObjectCooldown is the minimum time between stashes triggered by events
+	// for the same involved object
+	ObjectCooldown time.Duration `yaml:"objectCooldown"`
+	// MaxStashesPerHour limits the number of stashes the trigger takes in
+	// any hour, each trigger has its own limit
+	MaxStashesPerHour int `yaml:"maxStashesPerHour"`
+}
+
+// ScheduledStashConfiguration is a config for taking stashes periodically
+type ScheduledStashConfiguration struct {
+	// Name identifies the schedule, it is recorded against its stashes
+	Name string `yaml:"name"`
+	// Schedule is a cron expression such as "0 */6 * * *", a descriptor such
+	// as "@daily" or an interval such as "@every 6h"
+	Schedule string `yaml:"schedule"`
+	// MaxStashes is how many of this schedules stashes are kept, separately
+	// from other stashes, it defaults to the top level maxStashes
+	MaxStashes int `yaml:"maxStashes"`
+	// MaxAge is how long this schedules stashes are kept, it defaults to the
+	// top level maxStashAge
+	MaxAge time.Duration `yaml:"maxAge"`
+	// Labels are recorded against the stash
+	Labels map[string]string `yaml:"labels"`
+}
+
+// PodWatcherConfiguration is a config for triggering stashes when pod containers fail
+type PodWatcherConfiguration struct {
+	// Name identifies the trigger, it defaults to "podWatcher"
+	Name string `yaml:"name"`
+	// Labels optionally only watches pods with these labels
+	Labels map[string]string `yaml:"labels"`
+	// TerminationReasons are the container termination reasons which
+	// trigger a stash, it defaults to OOMKilled and Error
+	TerminationReasons []string `yaml:"terminationReasons"`
+	// RestartThreshold optionally triggers a stash when a container restarts
+	// this many times within the RestartWindow
+	RestartThreshold int `yaml:"restartThreshold"`
+	// RestartWindow defaults to 10 minutes
+	RestartWindow time.Duration `yaml:"restartWindow"`
+	// CrashLoopBackOff triggers a stash when a container enters CrashLoopBackOff
+	CrashLoopBackOff bool `yaml:"crashLoopBackOff"`
+
+	Limits                 *TriggerLimitsConfiguration     `yaml:"limits"`
+	Stash                  *StashConfiguration             `yaml:"stash"`
+	StashCompletionPlugins *CompletionPluginsConfiguration `yaml:"stashCompletionPlugins"`
+}
+
+// ConditionTriggerConfiguration is a config for triggering stashes when a resources status condition changes
+type ConditionTriggerConfiguration struct {
+	// Name identifies the trigger, it is recorded against the stashes it triggers
+	Name string `yaml:"name"`
+	// APIVersion and Kind are the type of resource to watch
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	// Resource is optional, it is the plural resource name and is looked up
+	// using API discovery if not set
+	Resource string `yaml:"resource"`
+	// Labels optionally only watches resources with these labels
+	Labels map[string]string `yaml:"labels"`
+	// Condition is the type of the status condition to watch
+	Condition string `yaml:"condition"`
+	// Status triggers a stash when the condition transitions to it
+	Status string `yaml:"status"`
+	// For optionally requires the condition to have the status for this
+	// long before triggering, measured from its last transition time so
+	// resources already in the status at startup also trigger
+	For time.Duration `yaml:"for"`
+
+	Limits                 *TriggerLimitsConfiguration     `yaml:"limits"`
+	Stash                  *StashConfiguration             `yaml:"stash"`
+	StashCompletionPlugins *CompletionPluginsConfiguration `yaml:"stashCompletionPlugins"`
+}
+
+// AlertmanagerConfiguration is a config for triggering stashes from Alertmanager webhook notifications
+type AlertmanagerConfiguration struct {
+	// Name identifies the trigger, it is recorded against the stashes it triggers
+	Name string `yaml:"name"`
+	// Matchers are Alertmanager style label matchers such as severity=~"critical|warning",
+	// firing alerts must match all of them to trigger a stash
+	Matchers []string `yaml:"matchers"`
+	// Secret optionally requires notifications to either have it as a bearer
+	// token or be signed with it using HMAC-SHA256
+	Secret string `yaml:"secret"`
+	// SecretFile optionally reads the secret from a file, such as a mounted Secret
+	SecretFile string `yaml:"secretFile"`
+	// DedupeWindow is how long a firing alert is remembered so repeated
+	// notifications don't trigger more stashes, defaults to 24h
+	DedupeWindow time.Duration `yaml:"dedupeWindow"`
+
+	Stash                  *StashConfiguration             `yaml:"stash"`
+	StashCompletionPlugins *CompletionPluginsConfiguration `yaml:"stashCompletionPlugins"`
+}
+
+// AnomalyDetectionConfiguration is a config for triggering stashes when event rates deviate from their baseline
+type AnomalyDetectionConfiguration struct {
+	// Name identifies the trigger, it is recorded against the stashes it triggers
+	Name string `yaml:"name"`
+	// EventType and EventFilters optionally limit which events are counted
+	EventType    string                     `yaml:"eventType"`
+	EventFilters []KubernetesResourceFilter `yaml:"eventFilters"`
+	// GroupBy learns a separate baseline per "reason", "kind" or "object",
+	// defaults to reason
+	GroupBy string `yaml:"groupBy"`
+	// Interval is the period rates are measured over, defaults to 1m
+	Interval time.Duration `yaml:"interval"`
+	// Window is roughly how far back the baseline rate is learnt over, as an
+	// exponentially weighted moving average, defaults to 1h
+	Window time.Duration `yaml:"window"`
+	// Threshold is the z-score above which a rate is anomalous, defaults to 3
+	Threshold float64 `yaml:"threshold"`
+	// MinSamples is the number of intervals a baseline is learnt for before
+	// it is used, defaults to 10
+	MinSamples int `yaml:"minSamples"`
+	// MinEvents is the fewest events in an interval which can be anomalous,
+	// so small absolute changes in quiet groups don't trigger, defaults to 5
+	MinEvents int `yaml:"minEvents"`
+	// MaxGroups is the most baselines learnt, the least recently active
+	// group is forgotten to make room for a new one, defaults to 1000
+	MaxGroups int `yaml:"maxGroups"`
+
+	Limits                 *TriggerLimitsConfiguration     `yaml:"limits"`
+	Stash                  *StashConfiguration             `yaml:"stash"`
+	StashCompletionPlugins *CompletionPluginsConfiguration `yaml:"stashCompletionPlugins"`
+}
+
+// LogWatcherConfiguration is a config for triggering stashes when pods log lines matching patterns
+type LogWatcherConfiguration struct {
+	// Name identifies the trigger, it is recorded against the stashes it triggers
+	Name string `yaml:"name"`
+	// Labels selects the pods whose logs are followed
+	Labels map[string]string `yaml:"labels"`
+	// Containers optionally only follows the logs of these containers
+	Containers []string `yaml:"containers"`
+	// Patterns are regular expressions, a log line matching any of them
+	// triggers a stash
+	Patterns []string `yaml:"patterns"`
+
+	Limits                 *TriggerLimitsConfiguration     `yaml:"limits"`
+	Stash                  *StashConfiguration             `yaml:"stash"`
+	StashCompletionPlugins *CompletionPluginsConfiguration `yaml:"stashCompletionPlugins"`
+}
+
+// SilenceConfiguration is a config for suppressing triggered stashes, either
+// between two times or during recurring maintenance windows
+type SilenceConfiguration struct {
+	Name    string `yaml:"name"`
+	Comment string `yaml:"comment"`
+	// StartsAt and EndsAt are RFC3339 times, StartsAt is optional
+	StartsAt string `yaml:"startsAt"`
+	EndsAt   string `yaml:"endsAt"`
+	// Schedule is a cron expression for when recurring maintenance windows
+	// start, each lasts for Duration
+	Schedule string        `yaml:"schedule"`
+	Duration time.Duration `yaml:"duration"`
+	// Triggers, Namespaces and Objects optionally limit which stashes are
+	// silenced, by trigger name and the involved object of the triggering event
+	Triggers   []string                      `yaml:"triggers"`
+	Namespaces []string                      `yaml:"namespaces"`
+	Objects    []SilencedObjectConfiguration `yaml:"objects"`
+}
+
+// SilencedObjectConfiguration matches the involved object of triggering events,
+// empty fields match any object
+type SilencedObjectConfiguration struct {
+	Kind      string `yaml:"kind"`
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace"`
+}
+
+// IncidentConfiguration is a config for grouping consecutive trigger firings into incidents
+type IncidentConfiguration struct {
+	// QuietPeriod resolves an incident once no triggers have fired for this
+	// long, defaults to 15m
+	QuietPeriod time.Duration `yaml:"quietPeriod"`
+	// RecoveryEventType, RecoveryEventFilters and RecoveryReasons optionally
+	// resolve an incident when a matching event is seen, at least one must
+	// be set for recovery events to be used
+	RecoveryEventType    string                     `yaml:"recoveryEventType"`
+	RecoveryEventFilters []KubernetesResourceFilter `yaml:"recoveryEventFilters"`
+	RecoveryReasons      []string                   `yaml:"recoveryReasons"`
+	// MaxIncidents is the number of incidents kept, defaults to 100
+	MaxIncidents int `yaml:"maxIncidents"`
 }
@@ -2,11 +2,15 @@ package evcol
 
 import (
 	"context"
-	"encoding/json"
 	"io"
+	"slices"
+	"sync"
+	"time"
 
+	"github.com/couchbase/k8s-event-collector/pkg/stash"
 	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/watch"
@@ -33,10 +37,13 @@ type EventCollector struct {
 	// not defined
 	FilterFunc FilterFunc
 
-	// ActionFilterFunc is optional and no actions will be triggered if not defined
+	// ActionFilterFunc is optional and ActionCallback will be called for
+	// every accepted event if not defined
 	ActionFilterFunc FilterFunc
-	ActionCallback   ActionFunc
+	// ActionCallback is optional and no actions will be triggered if not defined
+	ActionCallback ActionFunc
 
+	mx           sync.Mutex
 	closeChannel chan bool
 }
 
@@ -59,19 +66,29 @@ func (ec *EventCollector) Run() {
 
 	log.Info("Watcher created, starting event collection")
 
-	ec.closeChannel = make(chan bool, 2)
+	closeChannel := make(chan bool, 2)
+
+	ec.mx.Lock()
+	ec.closeChannel = closeChannel
+	ec.mx.Unlock()
+
 	for {
 		stop := false
 
 		select {
 		case event, ok := <-watcher.ResultChan():
 			stop = !ec.handleEventReceived(event, ok)
-		case <-ec.closeChannel:
+		case <-closeChannel:
 			stop = true
 		}
 
 		if stop {
-			ec.closeChannel = nil
+			ec.mx.Lock()
+			if ec.closeChannel == closeChannel {
+				ec.closeChannel = nil
+			}
+			ec.mx.Unlock()
+
 			break
 		}
 	}
@@ -99,40 +116,111 @@ func (ec *EventCollector) handleEventReceived(event apiWatch.Event, ok bool) boo
 	ec.Buffer.Add(e)
 	log.Info("Event added", "resource", e.Name, "msg", e.Message)
 
-	if ec.ActionFilterFunc != nil && ec.ActionFilterFunc(e) {
-		if ec.ActionCallback != nil {
-			ec.ActionCallback(e)
-		}
+	if ec.ActionCallback != nil && (ec.ActionFilterFunc == nil || ec.ActionFilterFunc(e)) {
+		ec.ActionCallback(e)
 	}
 
 	return true
 }
 
+// RecordEvent adds an event created by the collector to the buffer, the
+// event isn't filtered and doesn't trigger any actions
+func (ec *EventCollector) RecordEvent(e *corev1.Event) {
+	ec.Buffer.Add(e)
+	log.Info("Synthetic event added", "resource", e.Name, "msg", e.Message)
+}
+
 // Stop will stop the event collector.
 func (ec *EventCollector) Stop() {
+	ec.mx.Lock()
+	defer ec.mx.Unlock()
+
 	if ec.closeChannel != nil {
 		ec.closeChannel <- true
 		close(ec.closeChannel)
+		ec.closeChannel = nil
 	}
 }
 
-// Stash writes out the current buffer to the provided writer
-func (ec *EventCollector) Stash(w io.Writer) error {
+// Stash writes out the events in the current buffer which are within scope
+// to the provided writer, using the scopes encoder
+func (ec *EventCollector) Stash(w io.Writer, scope stash.Scope) (stash.Summary, error) {
 	tmpBuff := make([]*corev1.Event, 0, ec.Buffer.Size())
+	summary := stash.Summary{}
 
 	ec.Buffer.Do(func(e *corev1.Event) {
+		t := EventTime(e)
+		if !scope.Since.IsZero() && t.Before(scope.Since) {
+			return
+		}
+
+		if !scope.Until.IsZero() && t.After(scope.Until) {
+			return
+		}
+
+		if len(scope.Types) != 0 && !slices.Contains(scope.Types, e.Type) {
+			return
+		}
+
+		if scope.Filter != nil && !scope.Filter.Accepts(e) {
+			return
+		}
+
 		tmpBuff = append(tmpBuff, e)
+
+		if summary.FirstEventTime.IsZero() || t.Before(summary.FirstEventTime) {
+			summary.FirstEventTime = t
+		}
+
+		if t.After(summary.LastEventTime) {
+			summary.LastEventTime = t
+		}
 	})
 
-	encoder := json.NewEncoder(w)
-	err := encoder.Encode(tmpBuff)
+	summary.EventCount = len(tmpBuff)
+
+	envelope := stash.Envelope{Events: tmpBuff}
+	if scope.Envelope != nil {
+		envelope = stash.NewEnvelope(*scope.Envelope, tmpBuff, summary)
+	}
+
+	encode := scope.Encode
+	if encode == nil {
+		encode = stash.EncodeJSON
+	}
+
+	err := encode(w, &envelope)
 
 	if err != nil {
 		log.Error(err, "Failed to write entries")
-		return err
+		return stash.Summary{}, err
 	}
 
-	return nil
+	return summary, nil
+}
+
+// Freeze stops buffered events being evicted until Unfreeze is called
+func (ec *EventCollector) Freeze() {
+	ec.Buffer.Freeze()
+}
+
+// Unfreeze allows buffered events to be evicted again
+func (ec *EventCollector) Unfreeze() {
+	ec.Buffer.Unfreeze()
+}
+
+// GetEvent returns the buffered event with the given UID or nil if it isn't in
+// the buffer
+func (ec *EventCollector) GetEvent(uid types.UID) *corev1.Event {
+	var rv *corev1.Event
+
+	ec.Buffer.Do(func(e *corev1.Event) {
+		if e.UID == uid {
+			rv = e
+		}
+	})
+
+	return rv
 }
 
 // GetNamespace gets the namespace the collector is running in
@@ -143,3 +231,8 @@ func (ec *EventCollector) GetNamespace() string {
 
 	return ec.Namespace
 }
+
+// EventTime returns the time an event last occurred
+func EventTime(e *corev1.Event) time.Time {
+	return stash.EventTime(e)
+}
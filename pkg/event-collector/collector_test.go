@@ -2,11 +2,14 @@ package evcol
 
 import (
 	"encoding/json"
+	"io"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/couchbase/k8s-event-collector/pkg/stash"
 	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
@@ -94,7 +97,7 @@ func TestCollectorActionFunc(t *testing.T) {
 	mockClient, watcher := getMockClient()
 	defer watcher.Stop()
 
-	actionCounter := 0
+	var actionCounter atomic.Int32
 
 	collector := EventCollector{
 		KubeClient: mockClient,
@@ -103,7 +106,7 @@ func TestCollectorActionFunc(t *testing.T) {
 			return in.GetName() == "Action"
 		},
 		ActionCallback: func(in *corev1.Event) {
-			actionCounter++
+			actionCounter.Add(1)
 		},
 	}
 
@@ -127,11 +130,43 @@ func TestCollectorActionFunc(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 	collector.Stop()
 
-	if actionCounter != numActionEvents {
+	if int(actionCounter.Load()) != numActionEvents {
 		t.Error("Expected an event to be buffereed")
 	}
 }
 
+func TestCollectorActionFuncWithoutFilter(t *testing.T) {
+	mockClient, watcher := getMockClient()
+	defer watcher.Stop()
+
+	var actionCounter atomic.Int32
+
+	collector := EventCollector{
+		KubeClient: mockClient,
+		Buffer:     NewRingEventBuffer(5),
+		ActionCallback: func(in *corev1.Event) {
+			actionCounter.Add(1)
+		},
+	}
+
+	go func() {
+		collector.Run()
+	}()
+
+	numEvents := 3
+	for i := 0; i < numEvents; i++ {
+		e := createEvent()
+		watcher.Add(&e)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	collector.Stop()
+
+	if int(actionCounter.Load()) != numEvents {
+		t.Errorf("Expected the action to be called for every event")
+	}
+}
+
 func TestStash(t *testing.T) {
 	mockClient, watcher := getMockClient()
 	defer watcher.Stop()
@@ -158,7 +193,7 @@ func TestStash(t *testing.T) {
 
 	var builder strings.Builder
 
-	collector.Stash(&builder)
+	collector.Stash(&builder, stash.Scope{})
 	var readEvents []corev1.Event
 	json.Unmarshal([]byte(builder.String()), &readEvents)
 	if !reflect.DeepEqual(readEvents, events) {
@@ -166,6 +201,89 @@ func TestStash(t *testing.T) {
 	}
 }
 
+func TestStashScope(t *testing.T) {
+	collector := EventCollector{
+		Buffer: NewRingEventBuffer(5),
+	}
+
+	now := time.Now()
+	for _, age := range []time.Duration{time.Hour, time.Minute, time.Second} {
+		e := createEvent()
+		e.LastTimestamp = v1.NewTime(now.Add(-age))
+		collector.Buffer.Add(&e)
+	}
+
+	var builder strings.Builder
+	summary, err := collector.Stash(&builder, stash.Scope{Since: now.Add(-5 * time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var readEvents []corev1.Event
+	json.Unmarshal([]byte(builder.String()), &readEvents)
+	if len(readEvents) != 2 {
+		t.Errorf("Expected only events within scope to be stashed, got %v", len(readEvents))
+	}
+
+	// Event times are serialized to the second
+	first, last := now.Add(-time.Minute).Truncate(time.Second), now.Add(-time.Second).Truncate(time.Second)
+	if summary.EventCount != 2 || !summary.FirstEventTime.Truncate(time.Second).Equal(first) || !summary.LastEventTime.Truncate(time.Second).Equal(last) {
+		t.Errorf("Unexpected stash summary %+v", summary)
+	}
+}
+
+func TestStashScopeUntilAndTypes(t *testing.T) {
+	collector := EventCollector{
+		Buffer: NewRingEventBuffer(5),
+	}
+
+	now := time.Now()
+	for i, age := range []time.Duration{time.Hour, time.Minute, time.Second} {
+		e := createEvent()
+		e.LastTimestamp = v1.NewTime(now.Add(-age))
+		e.Type = corev1.EventTypeNormal
+		if i != 0 {
+			e.Type = corev1.EventTypeWarning
+		}
+
+		collector.Buffer.Add(&e)
+	}
+
+	summary, _ := collector.Stash(io.Discard, stash.Scope{
+		Until: now.Add(-30 * time.Second),
+		Types: []string{corev1.EventTypeWarning},
+	})
+
+	if summary.EventCount != 1 {
+		t.Errorf("Expected only the warning event before until to be stashed, got %v", summary.EventCount)
+	}
+}
+
+func TestStashEnvelope(t *testing.T) {
+	collector := EventCollector{
+		Buffer: NewRingEventBuffer(5),
+	}
+
+	e := createEvent()
+	e.LastTimestamp = v1.NewTime(time.Now().Truncate(time.Second))
+	collector.Buffer.Add(&e)
+
+	var builder strings.Builder
+	if _, err := collector.Stash(&builder, stash.Scope{Envelope: &stash.EnvelopeMetadata{Name: "stash", Trigger: "oom"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	envelope, err := stash.Decode(strings.NewReader(builder.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if envelope.APIVersion != stash.APIVersion || envelope.Kind != stash.Kind || envelope.Metadata.Name != "stash" ||
+		envelope.Metadata.Trigger != "oom" || envelope.Metadata.EventCount != 1 || !envelope.Metadata.LastEventTime.Equal(e.LastTimestamp.Time) || len(envelope.Events) != 1 {
+		t.Errorf("Expected the events to be written in an envelope: %+v", envelope)
+	}
+}
+
 func TestHandleTypeMismatches(t *testing.T) {
 	mockClient := fake.NewSimpleClientset()
 
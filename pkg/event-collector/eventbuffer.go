@@ -19,14 +19,25 @@ type EventBuffer interface {
 	Do(f func(*corev1.Event))
 	Capacity() int
 	Size() int
+	Freeze()
+	Unfreeze()
 }
 
 // The RingEventBuffer is a simple deduplicating buffer to store events in a ring,
 // the ring structure means old events will be overwritten by new events.
+//
+// The buffer can be frozen to stop events being overwritten, new events are
+// then held in an overflow of up to the buffers capacity until it is unfrozen.
+// Once the overflow is full any further events are dropped, so the events from
+// before the freeze are always kept.
 type RingEventBuffer struct {
 	r  *ring.Ring
 	s  map[types.UID]bool
 	mx sync.RWMutex
+
+	frozen   int
+	overflow []*corev1.Event
+	dropped  int
 }
 
 // NewRingEventBuffer creates a new event buffer of size `bufferSize`
@@ -47,17 +58,68 @@ func (b *RingEventBuffer) Add(e *corev1.Event) {
 		return
 	}
 
+	if b.frozen > 0 && b.r.Value != nil {
+		// Evicting from the ring would lose the events the freeze is
+		// protecting, so new events are dropped instead
+		if len(b.overflow) >= b.r.Len() {
+			b.dropped++
+			return
+		}
+
+		b.s[e.UID] = true
+		b.overflow = append(b.overflow, e)
+		return
+	}
+
+	b.s[e.UID] = true
+	b.insert(e)
+}
+
+// insert puts an event in the ring, overwriting the oldest event
+func (b *RingEventBuffer) insert(e *corev1.Event) {
 	if b.r.Value != nil {
 		uid := b.r.Value.(*corev1.Event).UID
 		delete(b.s, uid)
 	}
 
-	b.s[e.UID] = true
-
 	b.r.Value = e
 	b.r = b.r.Next()
 }
 
+// Freeze stops events in the buffer being overwritten until Unfreeze is
+// called, calls can be nested
+func (b *RingEventBuffer) Freeze() {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	b.frozen++
+}
+
+// Unfreeze allows events to be overwritten again, any events held in the
+// overflow are moved into the ring
+func (b *RingEventBuffer) Unfreeze() {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if b.frozen == 0 {
+		return
+	}
+
+	b.frozen--
+	if b.frozen > 0 {
+		return
+	}
+
+	if b.dropped > 0 {
+		log.Info("WARN, Frozen buffer overflowed, events were dropped", "dropped", b.dropped)
+	}
+
+	for _, e := range b.overflow {
+		b.insert(e)
+	}
+	b.overflow = nil
+	b.dropped = 0
+}
+
 // Do performs a function on all events in the buffer
 func (b *RingEventBuffer) Do(f func(*corev1.Event)) {
 	b.mx.Lock()
@@ -68,6 +130,10 @@ func (b *RingEventBuffer) Do(f func(*corev1.Event)) {
 		}
 		f(v.(*corev1.Event))
 	})
+
+	for _, e := range b.overflow {
+		f(e)
+	}
 }
 
 // Capacity returns the max capacity of the buffer
@@ -67,12 +67,98 @@ func TestConcurrentAccess(t *testing.T) {
 	})
 	time.Sleep(10 * time.Millisecond)
 
-	e = createEvent()
-	go b.Add(&e)
+	added := make(chan struct{})
+	other := createEvent()
+	go func() {
+		b.Add(&other)
+		close(added)
+	}()
+
+	select {
+	case <-added:
+		t.Errorf("Expected adding to wait for the buffer to be read")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	<-added
+	if b.Size() != 2 {
+		t.Errorf("Expected both events to be added, found %v events", b.Size())
+	}
+}
 
-	time.Sleep(500 * time.Millisecond)
+func TestFreeze(t *testing.T) {
+	bufferSize := 3
+	b := NewRingEventBuffer(bufferSize)
 
-	if len(b.s) != 1 {
-		t.Errorf("The buffer ring should be of size: %v", bufferSize)
+	first := createEvent()
+	b.Add(&first)
+	for i := 1; i < bufferSize; i++ {
+		e := createEvent()
+		b.Add(&e)
+	}
+
+	b.Freeze()
+	for i := 0; i < bufferSize; i++ {
+		e := createEvent()
+		b.Add(&e)
+	}
+
+	if b.Size() != 2*bufferSize {
+		t.Errorf("Expected no events to be evicted while frozen, found %v events", b.Size())
+	}
+
+	found := false
+	b.Do(func(e *corev1.Event) {
+		found = found || e.UID == first.UID
+	})
+	if !found {
+		t.Errorf("Expected the oldest event to be kept while frozen")
+	}
+
+	b.Unfreeze()
+
+	if b.Size() != bufferSize {
+		t.Errorf("Expected old events to be evicted once unfrozen, found %v events", b.Size())
+	}
+}
+
+func TestFreezeOverflowLimit(t *testing.T) {
+	bufferSize := 2
+	b := NewRingEventBuffer(bufferSize)
+
+	var before []types.UID
+	for i := 0; i < bufferSize; i++ {
+		e := createEvent()
+		b.Add(&e)
+		before = append(before, e.UID)
+	}
+
+	b.Freeze()
+	var after []types.UID
+	for i := 0; i < 10; i++ {
+		e := createEvent()
+		b.Add(&e)
+		after = append(after, e.UID)
+	}
+
+	if b.Size() != 2*bufferSize {
+		t.Errorf("Expected the overflow to be limited to the buffer capacity, found %v events", b.Size())
+	}
+
+	seen := map[types.UID]bool{}
+	b.Do(func(e *corev1.Event) {
+		seen[e.UID] = true
+	})
+
+	for _, uid := range append(before, after[:bufferSize]...) {
+		if !seen[uid] {
+			t.Errorf("Expected event %v to be kept while frozen", uid)
+		}
+	}
+
+	for _, uid := range after[bufferSize:] {
+		if seen[uid] {
+			t.Errorf("Expected event %v to be dropped once the overflow was full", uid)
+		}
 	}
 }
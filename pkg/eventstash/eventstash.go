@@ -0,0 +1,319 @@
+package eventstash
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	"github.com/couchbase/k8s-event-collector/pkg/filters"
+	"github.com/couchbase/k8s-event-collector/pkg/stashserver"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+var log = logf.Log.WithName("eventstash")
+
+// GroupVersionResource is the resource watched for EventStash requests
+var GroupVersionResource = schema.GroupVersionResource{
+	Group:    "events.couchbase.com",
+	Version:  "v1alpha1",
+	Resource: "eventstashes",
+}
+
+// EventStashPhase mirrors the StashStatus of the stash taken for an EventStash
+type EventStashPhase string
+
+const (
+	// EventStashPending phase is when the EventStash hasn't been processed yet
+	EventStashPending EventStashPhase = ""
+	// EventStashStarted phase is when the stash has been started but not complete
+	EventStashStarted EventStashPhase = EventStashPhase(stashserver.StashStarted)
+	// EventStashComplete phase is when the stash has succesfully completed
+	EventStashComplete EventStashPhase = EventStashPhase(stashserver.StashComplete)
+	// EventStashFailed phase is when the stash has failed
+	EventStashFailed EventStashPhase = EventStashPhase(stashserver.StashFailed)
+)
+
+// EventStashSpec describes the stash to take
+type EventStashSpec struct {
+	// Name is optional, if not set a name is generated
+	Name   string            `json:"name,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// Window optionally only includes events which occurred this long
+	// before the EventStash was processed
+	Window metav1.Duration `json:"window,omitempty"`
+	// EventFilters optionally only includes events matching any filter
+	EventFilters []EventFilter `json:"eventFilters,omitempty"`
+}
+
+// EventFilter is a filter on the involved objects of events, it has the same
+// fields as the event filters in the config file
+type EventFilter struct {
+	APIVersion string `json:"apiVersion,omitempty"`
+	Resource   string `json:"resource,omitempty"`
+	// Name and Namespace optionally restrict the filter to a single object
+	Name      string            `json:"name,omitempty"`
+	Namespace string            `json:"namespace,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// resourceFilters converts the filters of a spec to config filters
+func resourceFilters(eventFilters []EventFilter) []config.KubernetesResourceFilter {
+	resourceFilters := make([]config.KubernetesResourceFilter, 0, len(eventFilters))
+	for _, f := range eventFilters {
+		resourceFilters = append(resourceFilters, config.KubernetesResourceFilter{
+			APIVersion: f.APIVersion,
+			Resource:   f.Resource,
+			Name:       f.Name,
+			Namespace:  f.Namespace,
+			Labels:     f.Labels,
+		})
+	}
+
+	return resourceFilters
+}
+
+// EventStashStatus reports the progress of the stash
+type EventStashStatus struct {
+	Phase        EventStashPhase `json:"phase,omitempty"`
+	StashName    string          `json:"stashName,omitempty"`
+	EventCount   int             `json:"eventCount,omitempty"`
+	DownloadPath string          `json:"downloadPath,omitempty"`
+	Message      string          `json:"message,omitempty"`
+}
+
+// EventStash is a request for a stash of the event buffer
+type EventStash struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   EventStashSpec   `json:"spec,omitempty"`
+	Status EventStashStatus `json:"status,omitempty"`
+}
+
+// The StashCreator interface creates stashes for EventStash resources
+type StashCreator interface {
+	CreateStash(stashserver.StashOptions) (stashserver.Stash, error)
+}
+
+// Controller watches EventStash resources in a namespace and takes the
+// stashes they request, writing the result back to the resources status
+type Controller struct {
+	client     dynamic.Interface
+	kubeClient kubernetes.Interface
+	creator    StashCreator
+	namespace  string
+
+	queue   workqueue.RateLimitingInterface
+	indexer cache.Indexer
+
+	// pending holds the final status of stashes which have been taken but
+	// couldn't be written back, keyed by namespace/name, so retries only
+	// retry the update. It's only used by the worker.
+	pending map[string]EventStashStatus
+}
+
+// NewController creates a new Controller
+func NewController(client dynamic.Interface, kubeClient kubernetes.Interface, creator StashCreator, namespace string) *Controller {
+	return &Controller{
+		client:     client,
+		kubeClient: kubeClient,
+		creator:    creator,
+		namespace:  namespace,
+		queue:      workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		pending:    map[string]EventStashStatus{},
+	}
+}
+
+// Run starts watching EventStash resources until the context is done
+func (c *Controller) Run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		c.queue.ShutDown()
+	}()
+
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(c.client, 0, c.namespace, nil)
+	informer := factory.ForResource(GroupVersionResource).Informer()
+	c.indexer = informer.GetIndexer()
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueue,
+	})
+
+	factory.Start(ctx.Done())
+
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return
+	}
+
+	log.Info("Watching EventStash resources", "namespace", c.namespace)
+
+	for c.processNextItem(ctx) {
+	}
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		log.Error(err, "Failed to get EventStash key")
+		return
+	}
+
+	c.queue.Add(key)
+}
+
+// processNextItem processes the next EventStash in the queue, EventStashes
+// which fail are requeued with backoff. It returns false once the queue has
+// been shut down.
+func (c *Controller) processNextItem(ctx context.Context) bool {
+	item, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+
+	defer c.queue.Done(item)
+
+	key := item.(string)
+
+	obj, exists, err := c.indexer.GetByKey(key)
+	if err != nil {
+		log.Error(err, "Failed to get EventStash", "key", key)
+		c.queue.AddRateLimited(key)
+
+		return true
+	}
+
+	if !exists {
+		delete(c.pending, key)
+		c.queue.Forget(key)
+
+		return true
+	}
+
+	if err := c.process(ctx, obj.(*unstructured.Unstructured)); err != nil {
+		log.Error(err, "Failed to process EventStash, retrying", "key", key)
+		c.queue.AddRateLimited(key)
+
+		return true
+	}
+
+	c.queue.Forget(key)
+
+	return true
+}
+
+// process takes the stash for an EventStash, resources which have already
+// been completed or failed are ignored so they aren't retaken on restart. An
+// error is returned if the status couldn't be updated, if the stash was taken
+// its status is kept so processing it again only retries the update.
+func (c *Controller) process(ctx context.Context, obj *unstructured.Unstructured) error {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return err
+	}
+
+	if status, ok := c.pending[key]; ok {
+		if _, err := c.updateStatus(ctx, obj, status); err != nil {
+			return fmt.Errorf("failed to update EventStash status: %w", err)
+		}
+
+		delete(c.pending, key)
+
+		return nil
+	}
+
+	es, err := fromUnstructured(obj)
+	if err != nil {
+		// Retrying won't fix a resource which can't be decoded
+		log.Error(err, "Failed to decode EventStash", "name", obj.GetName())
+		return nil
+	}
+
+	if es.Status.Phase == EventStashComplete || es.Status.Phase == EventStashFailed {
+		return nil
+	}
+
+	log.Info("Processing EventStash", "name", es.Name)
+
+	obj, err = c.updateStatus(ctx, obj, EventStashStatus{Phase: EventStashStarted})
+	if err != nil {
+		return fmt.Errorf("failed to update EventStash status: %w", err)
+	}
+
+	opts := stashserver.StashOptions{
+		Name:    es.Spec.Name,
+		Trigger: fmt.Sprintf("eventstash/%s", es.Name),
+		Source:  stashserver.StashSourceEventStash,
+		Labels:  es.Spec.Labels,
+	}
+
+	if es.Spec.Window.Duration > 0 {
+		opts.Scope.Since = time.Now().Add(-es.Spec.Window.Duration)
+	}
+
+	if len(es.Spec.EventFilters) != 0 {
+		opts.Scope.Filter = filters.NewFilterSet(es.Name, "", resourceFilters(es.Spec.EventFilters), c.kubeClient)
+	}
+
+	stash, err := c.creator.CreateStash(opts)
+
+	status := EventStashStatus{
+		Phase:      EventStashPhase(stash.Status),
+		StashName:  stash.Name,
+		EventCount: stash.EventCount,
+	}
+
+	if err != nil {
+		status.Phase = EventStashFailed
+		status.Message = err.Error()
+	} else {
+		status.DownloadPath = "/stashes/" + stash.Name
+	}
+
+	if _, err := c.updateStatus(ctx, obj, status); err != nil {
+		c.pending[key] = status
+		return fmt.Errorf("failed to update EventStash status: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Controller) updateStatus(ctx context.Context, obj *unstructured.Unstructured, status EventStashStatus) (*unstructured.Unstructured, error) {
+	b, err := json.Marshal(status)
+	if err != nil {
+		return nil, err
+	}
+
+	statusMap := map[string]interface{}{}
+	if err := json.Unmarshal(b, &statusMap); err != nil {
+		return nil, err
+	}
+
+	obj = obj.DeepCopy()
+	obj.Object["status"] = statusMap
+
+	return c.client.Resource(GroupVersionResource).Namespace(obj.GetNamespace()).UpdateStatus(ctx, obj, metav1.UpdateOptions{})
+}
+
+func fromUnstructured(obj *unstructured.Unstructured) (*EventStash, error) {
+	b, err := json.Marshal(obj.Object)
+	if err != nil {
+		return nil, err
+	}
+
+	es := &EventStash{}
+	if err := json.Unmarshal(b, es); err != nil {
+		return nil, err
+	}
+
+	return es, nil
+}
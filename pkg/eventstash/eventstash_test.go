@@ -0,0 +1,251 @@
+package eventstash
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	"github.com/couchbase/k8s-event-collector/pkg/stashserver"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+type testCreator struct {
+	opts []stashserver.StashOptions
+	err  error
+}
+
+func (c *testCreator) CreateStash(opts stashserver.StashOptions) (stashserver.Stash, error) {
+	c.opts = append(c.opts, opts)
+
+	if c.err != nil {
+		return stashserver.Stash{Status: stashserver.StashFailed, Name: "event-log-" + opts.Name}, c.err
+	}
+
+	return stashserver.Stash{Status: stashserver.StashComplete, Name: "event-log-" + opts.Name, EventCount: 3}, nil
+}
+
+func createEventStash(name string, spec map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": GroupVersionResource.GroupVersion().String(),
+		"kind":       "EventStash",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": "default",
+		},
+		"spec": spec,
+	}}
+}
+
+func initTestController(t *testing.T, creator StashCreator, obj *unstructured.Unstructured) *Controller {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		GroupVersionResource: "EventStashList",
+	})
+
+	// Objects are created through the client as the fake can't guess the
+	// plural resource name when adding them directly
+	_, err := client.Resource(GroupVersionResource).Namespace("default").Create(context.Background(), obj, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewController(client, nil, creator, "default")
+}
+
+func getStatus(t *testing.T, c *Controller, name string) EventStashStatus {
+	obj, err := c.client.Resource(GroupVersionResource).Namespace("default").Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	es, err := fromUnstructured(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return es.Status
+}
+
+func mustProcess(t *testing.T, c *Controller, obj *unstructured.Unstructured) {
+	if err := c.process(context.Background(), obj); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProcessEventStash(t *testing.T) {
+	obj := createEventStash("incident", map[string]interface{}{
+		"name":   "incident",
+		"labels": map[string]interface{}{"ticket": "K8S-123"},
+		"window": "15m",
+		"eventFilters": []interface{}{
+			map[string]interface{}{
+				"apiVersion": "couchbase.com/v2",
+				"labels":     map[string]interface{}{"app": "couchbase"},
+			},
+		},
+	})
+
+	creator := &testCreator{}
+	c := initTestController(t, creator, obj)
+	mustProcess(t, c, obj)
+
+	if len(creator.opts) != 1 {
+		t.Fatalf("Expected a stash to be created")
+	}
+
+	opts := creator.opts[0]
+	if opts.Name != "incident" || opts.Labels["ticket"] != "K8S-123" || opts.Trigger != "eventstash/incident" {
+		t.Errorf("Unexpected stash options: %+v", opts)
+	}
+
+	if opts.Scope.Filter == nil || time.Since(opts.Scope.Since) < 15*time.Minute {
+		t.Errorf("Expected the stash to be scoped by the spec: %+v", opts.Scope)
+	}
+
+	status := getStatus(t, c, "incident")
+	expected := EventStashStatus{
+		Phase:        EventStashComplete,
+		StashName:    "event-log-incident",
+		EventCount:   3,
+		DownloadPath: "/stashes/event-log-incident",
+	}
+
+	if status != expected {
+		t.Errorf("Unexpected status, expected: %+v got: %+v", expected, status)
+	}
+}
+
+func TestProcessFailedEventStash(t *testing.T) {
+	obj := createEventStash("incident", map[string]interface{}{})
+
+	creator := &testCreator{err: fmt.Errorf("disk full")}
+	c := initTestController(t, creator, obj)
+	mustProcess(t, c, obj)
+
+	status := getStatus(t, c, "incident")
+	if status.Phase != EventStashFailed || status.Message != "disk full" {
+		t.Errorf("Expected the failure to be reported: %+v", status)
+	}
+}
+
+func TestProcessedEventStashIgnored(t *testing.T) {
+	obj := createEventStash("incident", map[string]interface{}{})
+	obj.Object["status"] = map[string]interface{}{"phase": string(EventStashComplete)}
+
+	creator := &testCreator{}
+	c := initTestController(t, creator, obj)
+	mustProcess(t, c, obj)
+
+	if len(creator.opts) != 0 {
+		t.Errorf("Expected a completed EventStash not to be retaken")
+	}
+}
+
+func TestEventStashFilterDecoding(t *testing.T) {
+	obj := createEventStash("incident", map[string]interface{}{
+		"eventFilters": []interface{}{
+			map[string]interface{}{
+				"apiVersion": "couchbase.com/v2",
+				"resource":   "couchbaseclusters",
+				"name":       "cb-example",
+				"namespace":  "default",
+				"labels":     map[string]interface{}{"app": "couchbase"},
+			},
+		},
+	})
+
+	es, err := fromUnstructured(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := config.KubernetesResourceFilter{
+		APIVersion: "couchbase.com/v2",
+		Resource:   "couchbaseclusters",
+		Name:       "cb-example",
+		Namespace:  "default",
+		Labels:     map[string]string{"app": "couchbase"},
+	}
+
+	resourceFilters := resourceFilters(es.Spec.EventFilters)
+	if len(resourceFilters) != 1 || !reflect.DeepEqual(resourceFilters[0], expected) {
+		t.Errorf("Unexpected filters, expected: %+v got: %+v", expected, resourceFilters)
+	}
+}
+
+func TestFailedStatusUpdateRetried(t *testing.T) {
+	obj := createEventStash("incident", map[string]interface{}{})
+
+	creator := &testCreator{}
+	c := initTestController(t, creator, obj)
+
+	// Fail the update of the final status once
+	updates := 0
+	c.client.(*dynamicfake.FakeDynamicClient).PrependReactor("update", "eventstashes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		updates++
+		if updates == 2 {
+			return true, nil, fmt.Errorf("connection refused")
+		}
+
+		return false, nil, nil
+	})
+
+	if err := c.process(context.Background(), obj); err == nil {
+		t.Fatalf("Expected the failed status update to be reported")
+	}
+
+	obj, err := c.client.Resource(GroupVersionResource).Namespace("default").Get(context.Background(), "incident", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mustProcess(t, c, obj)
+
+	if len(creator.opts) != 1 {
+		t.Errorf("Expected the stash not to be retaken, got %d stashes", len(creator.opts))
+	}
+
+	if status := getStatus(t, c, "incident"); status.Phase != EventStashComplete {
+		t.Errorf("Expected the status update to be retried: %+v", status)
+	}
+}
+
+func TestRunProcessesEventStashes(t *testing.T) {
+	obj := createEventStash("incident", map[string]interface{}{})
+
+	creator := &testCreator{}
+	c := initTestController(t, creator, obj)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+
+	timeout := time.After(10 * time.Second)
+	for getStatus(t, c, "incident").Phase != EventStashComplete {
+		select {
+		case <-timeout:
+			t.Fatalf("Timed out waiting for the EventStash to be processed")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for the controller to stop")
+	}
+}
@@ -0,0 +1,247 @@
+package filters
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// FilterResult is the outcome of evaluating a single filter against an event
+type FilterResult struct {
+	Filter  config.KubernetesResourceFilter
+	Matched bool
+	Reason  string
+}
+
+// FilterSetResult is the outcome of evaluating a filter set against an event
+type FilterSetResult struct {
+	Name    string
+	Matched bool
+	Reason  string
+	Filters []FilterResult
+}
+
+// Counters records how many events have been accepted and rejected
+type Counters struct {
+	Accepted uint64
+	Rejected uint64
+}
+
+// FilterSetStats are the live counters for a filter set and each of its filters
+type FilterSetStats struct {
+	Name     string
+	Counters Counters
+	Filters  []Counters
+}
+
+// FilterSet is a named set of resource filters, an event is accepted if it
+// matches the optional event type and any of the filters. An empty set of
+// filters accepts every event.
+type FilterSet struct {
+	Name      string
+	EventType string
+
+	filters    []config.KubernetesResourceFilter
+	selectors  []labels.Selector
+	kubeClient kubernetes.Interface
+
+	mx             sync.Mutex
+	counters       Counters
+	filterCounters []Counters
+}
+
+// NewFilterSet creates a new FilterSet from the config filters
+func NewFilterSet(name, eventType string, filters []config.KubernetesResourceFilter, kubeClient kubernetes.Interface) *FilterSet {
+	selectors := make([]labels.Selector, len(filters))
+	for i, f := range filters {
+		if len(f.Labels) != 0 {
+			selectors[i] = labels.SelectorFromSet(labels.Set(f.Labels))
+		}
+	}
+
+	return &FilterSet{
+		Name:           name,
+		EventType:      eventType,
+		filters:        filters,
+		selectors:      selectors,
+		kubeClient:     kubeClient,
+		filterCounters: make([]Counters, len(filters)),
+	}
+}
+
+// Filters returns the config filters of the filter set
+func (s *FilterSet) Filters() []config.KubernetesResourceFilter {
+	return s.filters
+}
+
+// Match returns whether the event is accepted by the filter set and records
+// the result in the live counters
+func (s *FilterSet) Match(in *corev1.Event) bool {
+	res := s.evaluate(in, false)
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	count(&s.counters, res.Matched)
+	for i, f := range res.Filters {
+		count(&s.filterCounters[i], f.Matched)
+	}
+
+	return res.Matched
+}
+
+// Accepts returns whether the event is accepted by the filter set without
+// updating the live counters
+func (s *FilterSet) Accepts(in *corev1.Event) bool {
+	return s.evaluate(in, false).Matched
+}
+
+// Explain evaluates every filter in the set against the event without
+// updating the live counters
+func (s *FilterSet) Explain(in *corev1.Event) FilterSetResult {
+	return s.evaluate(in, true)
+}
+
+// Stats returns the live counters for the filter set
+func (s *FilterSet) Stats() FilterSetStats {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return FilterSetStats{
+		Name:     s.Name,
+		Counters: s.counters,
+		Filters:  append([]Counters{}, s.filterCounters...),
+	}
+}
+
+// evaluate checks the event against the set. When all is false evaluation
+// stops at the first matching filter, as the remaining results can't change
+// the outcome and label matching requires API calls.
+func (s *FilterSet) evaluate(in *corev1.Event, all bool) FilterSetResult {
+	res := FilterSetResult{Name: s.Name}
+
+	if s.EventType != "" && in.Type != s.EventType {
+		res.Reason = fmt.Sprintf("event type %q does not match %q", in.Type, s.EventType)
+		return res
+	}
+
+	if len(s.filters) == 0 {
+		res.Matched = true
+		res.Reason = "no filters configured, all events match"
+		return res
+	}
+
+	for i := range s.filters {
+		fr := s.evaluateFilter(i, in)
+		res.Filters = append(res.Filters, fr)
+
+		if fr.Matched && !res.Matched {
+			res.Matched = true
+			res.Reason = fmt.Sprintf("matched filter %d", i)
+
+			if !all {
+				break
+			}
+		}
+	}
+
+	if !res.Matched {
+		res.Reason = "no filters matched"
+	}
+
+	return res
+}
+
+func (s *FilterSet) evaluateFilter(i int, in *corev1.Event) FilterResult {
+	f := s.filters[i]
+	res := FilterResult{Filter: f}
+
+	if f.APIVersion != "" && f.APIVersion != in.InvolvedObject.APIVersion {
+		res.Reason = fmt.Sprintf("apiVersion %q does not match %q", in.InvolvedObject.APIVersion, f.APIVersion)
+		return res
+	}
+
+	if f.Resource != "" && f.Resource != in.InvolvedObject.Kind {
+		res.Reason = fmt.Sprintf("kind %q does not match %q", in.InvolvedObject.Kind, f.Resource)
+		return res
+	}
+
+	if f.Name != "" && f.Name != in.InvolvedObject.Name {
+		res.Reason = fmt.Sprintf("name %q does not match %q", in.InvolvedObject.Name, f.Name)
+		return res
+	}
+
+	if namespace := objectNamespace(in); f.Namespace != "" && f.Namespace != namespace {
+		res.Reason = fmt.Sprintf("namespace %q does not match %q", namespace, f.Namespace)
+		return res
+	}
+
+	if sel := s.selectors[i]; sel != nil {
+		objectLabels, err := s.getObjectLabels(in)
+		if err != nil {
+			res.Reason = err.Error()
+			return res
+		}
+
+		if !sel.Matches(objectLabels) {
+			res.Reason = fmt.Sprintf("labels %q do not match selector %q", objectLabels.String(), sel.String())
+			return res
+		}
+	}
+
+	res.Matched = true
+	res.Reason = "all conditions matched"
+
+	return res
+}
+
+// objectNamespace returns the namespace of the events involved object, which
+// is the events namespace if it isn't set
+func objectNamespace(in *corev1.Event) string {
+	if in.InvolvedObject.Namespace != "" {
+		return in.InvolvedObject.Namespace
+	}
+
+	return in.Namespace
+}
+
+// getObjectLabels fetches the labels of the events involved object, this is
+// currently limited to Pods, Deployments and PersistentVolumeClaims
+func (s *FilterSet) getObjectLabels(in *corev1.Event) (labels.Set, error) {
+	if s.kubeClient == nil {
+		return nil, fmt.Errorf("no kubernetes client available for label matching")
+	}
+
+	var obj metav1.Object
+	var err error
+
+	switch in.InvolvedObject.Kind {
+	case "Pod":
+		obj, err = s.kubeClient.CoreV1().Pods(in.Namespace).Get(context.Background(), in.InvolvedObject.Name, metav1.GetOptions{})
+	case "Deployment":
+		obj, err = s.kubeClient.AppsV1().Deployments(in.Namespace).Get(context.Background(), in.InvolvedObject.Name, metav1.GetOptions{})
+	case "PersistentVolumeClaim":
+		obj, err = s.kubeClient.CoreV1().PersistentVolumeClaims(in.Namespace).Get(context.Background(), in.InvolvedObject.Name, metav1.GetOptions{})
+	default:
+		return nil, fmt.Errorf("label matching is not supported for kind %q", in.InvolvedObject.Kind)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s %s: %w", in.InvolvedObject.Kind, in.InvolvedObject.Name, err)
+	}
+
+	return labels.Set(obj.GetLabels()), nil
+}
+
+func count(c *Counters, matched bool) {
+	if matched {
+		c.Accepted++
+	} else {
+		c.Rejected++
+	}
+}
@@ -0,0 +1,167 @@
+package filters
+
+import (
+	"testing"
+
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func createEvent(kind, name, eventType string) *corev1.Event {
+	return &corev1.Event{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      name + "-event",
+			Namespace: "default",
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       kind,
+			Name:       name,
+			Namespace:  "default",
+		},
+		Type: eventType,
+	}
+}
+
+func TestEmptyFilterSetMatchesAll(t *testing.T) {
+	s := NewFilterSet("all", "", nil, nil)
+
+	if !s.Match(createEvent("Pod", "pod", corev1.EventTypeNormal)) {
+		t.Errorf("Expected an empty filter set to match")
+	}
+
+	if stats := s.Stats(); stats.Counters.Accepted != 1 || stats.Counters.Rejected != 0 {
+		t.Errorf("Unexpected counters: %+v", stats.Counters)
+	}
+}
+
+func TestFilterSetEventType(t *testing.T) {
+	s := NewFilterSet("warnings", corev1.EventTypeWarning, nil, nil)
+
+	if s.Match(createEvent("Pod", "pod", corev1.EventTypeNormal)) {
+		t.Errorf("Expected normal event to be rejected")
+	}
+
+	if !s.Match(createEvent("Pod", "pod", corev1.EventTypeWarning)) {
+		t.Errorf("Expected warning event to be accepted")
+	}
+
+	if stats := s.Stats(); stats.Counters.Accepted != 1 || stats.Counters.Rejected != 1 {
+		t.Errorf("Unexpected counters: %+v", stats.Counters)
+	}
+}
+
+func TestFilterSetMatchesAnyFilter(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "operator",
+			Namespace: "default",
+			Labels:    map[string]string{"app": "couchbase-operator"},
+		},
+	})
+
+	s := NewFilterSet("labels", "", []config.KubernetesResourceFilter{
+		{Labels: map[string]string{"app": "couchbase"}},
+		{Labels: map[string]string{"app": "couchbase-operator"}},
+	}, client)
+
+	if !s.Match(createEvent("Pod", "operator", corev1.EventTypeNormal)) {
+		t.Errorf("Expected event to match the second filter")
+	}
+
+	stats := s.Stats()
+	if stats.Filters[0].Rejected != 1 || stats.Filters[1].Accepted != 1 {
+		t.Errorf("Unexpected filter counters: %+v", stats.Filters)
+	}
+}
+
+func TestFilterObjectName(t *testing.T) {
+	s := NewFilterSet("objects", "", []config.KubernetesResourceFilter{
+		{Resource: "Pod", Name: "operator", Namespace: "default"},
+	}, nil)
+
+	if !s.Match(createEvent("Pod", "operator", corev1.EventTypeNormal)) {
+		t.Errorf("Expected event for the object to match")
+	}
+
+	if s.Match(createEvent("Pod", "cb-example-0000", corev1.EventTypeNormal)) {
+		t.Errorf("Expected event for another object not to match")
+	}
+
+	e := createEvent("Pod", "operator", corev1.EventTypeNormal)
+	e.InvolvedObject.Namespace = ""
+	e.Namespace = "other"
+
+	if res := s.Explain(e); res.Matched || res.Filters[0].Reason != `namespace "other" does not match "default"` {
+		t.Errorf("Expected event in another namespace not to match: %+v", res)
+	}
+}
+
+func TestExplainDoesNotCount(t *testing.T) {
+	s := NewFilterSet("resources", "", []config.KubernetesResourceFilter{
+		{Resource: "Pod"},
+		{APIVersion: "couchbase.com/v2"},
+		{Resource: "Deployment", Labels: map[string]string{"app": "couchbase"}},
+	}, nil)
+
+	res := s.Explain(createEvent("Pod", "pod", corev1.EventTypeNormal))
+
+	if !res.Matched {
+		t.Errorf("Expected event to match")
+	}
+
+	if len(res.Filters) != 3 {
+		t.Fatalf("Expected every filter to be explained, got %v", len(res.Filters))
+	}
+
+	for i, expected := range []bool{true, false, false} {
+		if res.Filters[i].Matched != expected || res.Filters[i].Reason == "" {
+			t.Errorf("Unexpected result for filter %v: %+v", i, res.Filters[i])
+		}
+	}
+
+	if stats := s.Stats(); stats.Counters.Accepted != 0 || stats.Counters.Rejected != 0 {
+		t.Errorf("Explain should not update counters: %+v", stats.Counters)
+	}
+}
+
+func TestUnsupportedLabelKind(t *testing.T) {
+	s := NewFilterSet("labels", "", []config.KubernetesResourceFilter{
+		{Labels: map[string]string{"app": "couchbase"}},
+	}, fake.NewSimpleClientset())
+
+	res := s.Explain(createEvent("Service", "svc", corev1.EventTypeNormal))
+
+	if res.Matched {
+		t.Errorf("Expected event for unsupported kind not to match")
+	}
+
+	if res.Filters[0].Reason != `label matching is not supported for kind "Service"` {
+		t.Errorf("Unexpected reason: %s", res.Filters[0].Reason)
+	}
+}
+
+func TestLabelMismatchFallsThrough(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "operator",
+			Namespace: "default",
+			Labels:    map[string]string{"app": "couchbase-operator"},
+		},
+	}
+
+	s := NewFilterSet("labels", "", []config.KubernetesResourceFilter{
+		{Labels: map[string]string{"app": "couchbase", "couchbase_server": "true"}},
+		{Labels: map[string]string{"app": "couchbase-operator"}},
+	}, fake.NewSimpleClientset(pod))
+
+	if !s.Match(createEvent("Pod", "operator", corev1.EventTypeNormal)) {
+		t.Errorf("Expected an event not matching the first filters labels to match the second filter")
+	}
+
+	if stats := s.Stats(); stats.Filters[0].Rejected != 1 || stats.Filters[1].Accepted != 1 {
+		t.Errorf("Unexpected filter counters: %+v", stats.Filters)
+	}
+}
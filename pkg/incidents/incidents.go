@@ -0,0 +1,359 @@
+package incidents
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	"github.com/couchbase/k8s-event-collector/pkg/filters"
+	"github.com/couchbase/k8s-event-collector/pkg/stashserver"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+var log = logf.Log.WithName("incidents")
+
+// IncidentStatus is the state of an incident
+type IncidentStatus string
+
+const (
+	// IncidentOpen status is when triggers are still firing
+	IncidentOpen IncidentStatus = "Open"
+	// IncidentResolved status is when the quiet period passed or a recovery
+	// event was seen
+	IncidentResolved IncidentStatus = "Resolved"
+)
+
+// IncidentLabel is the stash label recording the incident it is for
+const IncidentLabel = "incident"
+
+const (
+	defaultQuietPeriod  = 15 * time.Minute
+	defaultMaxIncidents = 100
+)
+
+// maxFirings limits the trigger history kept for an incident, the earliest
+// firings are kept as they are most relevant to the cause
+const maxFirings = 100
+
+var tsFormat = "20060102T150405"
+
+// Firing is a trigger firing which was grouped into an incident
+type Firing struct {
+	Time    time.Time
+	Trigger string
+	// Reason, Object and Message describe the triggering event, if any
+	Reason  string
+	Object  string
+	Message string
+}
+
+// Incident is a group of consecutive trigger firings, with a single stash
+// which is updated while the incident is open
+type Incident struct {
+	ID         string
+	Status     IncidentStatus
+	StartTime  time.Time
+	EndTime    time.Time
+	ResolvedBy string
+	StashName  string
+	// FiringCount is the total number of firings, Firings only has the first
+	FiringCount int
+	Firings     []Firing
+
+	opts stashserver.StashOptions
+}
+
+// The StashCreator interface creates stashes for incidents
+type StashCreator interface {
+	CreateStash(stashserver.StashOptions) (stashserver.Stash, error)
+}
+
+// Tracker groups trigger firings into incidents. It is used as the stash
+// servers Grouper so all triggered stashes for an incident are written to
+// the same stash, which is updated a final time when the incident resolves.
+type Tracker struct {
+	cfg            config.IncidentConfiguration
+	creator        StashCreator
+	recoveryFilter *filters.FilterSet
+
+	mx        sync.Mutex
+	open      *Incident
+	incidents []*Incident
+	timer     *time.Timer
+}
+
+// NewTracker creates a new Tracker
+func NewTracker(cfg config.IncidentConfiguration, creator StashCreator, kubeClient kubernetes.Interface) *Tracker {
+	if cfg.QuietPeriod <= 0 {
+		cfg.QuietPeriod = defaultQuietPeriod
+	}
+
+	if cfg.MaxIncidents <= 0 {
+		cfg.MaxIncidents = defaultMaxIncidents
+	}
+
+	t := &Tracker{
+		cfg:     cfg,
+		creator: creator,
+	}
+
+	if cfg.RecoveryEventType != "" || len(cfg.RecoveryEventFilters) != 0 || len(cfg.RecoveryReasons) != 0 {
+		t.recoveryFilter = filters.NewFilterSet("incidentRecovery", cfg.RecoveryEventType, cfg.RecoveryEventFilters, kubeClient)
+	}
+
+	return t
+}
+
+// RecoveryFilter returns the filter set for recovery events, which is nil if
+// they aren't configured
+func (t *Tracker) RecoveryFilter() *filters.FilterSet {
+	return t.recoveryFilter
+}
+
+// Group records a trigger firing, opening an incident if none is open, and
+// returns the options to write it to the incidents stash
+func (t *Tracker) Group(opts stashserver.StashOptions) stashserver.StashOptions {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	now := time.Now()
+	incident := t.open
+
+	if incident == nil {
+		incident = t.openIncident(opts, now)
+
+		// The stash servers name for the stash is only known once written
+		opts.CompletionCallbacks = append(slices.Clone(opts.CompletionCallbacks), func(d *stashserver.Stash) {
+			t.mx.Lock()
+			defer t.mx.Unlock()
+			incident.StashName = d.Name
+		})
+	} else {
+		// Completion callbacks have already been run for the incidents stash
+		opts.CompletionCallbacks = nil
+		opts.SkipCompletion = true
+	}
+
+	incident.FiringCount++
+	if len(incident.Firings) < maxFirings {
+		incident.Firings = append(incident.Firings, newFiring(opts, now))
+	}
+
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+
+	t.timer = time.AfterFunc(t.cfg.QuietPeriod, func() {
+		t.resolve(incident, fmt.Sprintf("no triggers fired for %s", t.cfg.QuietPeriod))
+	})
+
+	grouped := incident.opts
+	grouped.Delay = opts.Delay
+	grouped.FreezeBuffer = opts.FreezeBuffer
+	grouped.CompletionCallbacks = opts.CompletionCallbacks
+	grouped.SkipCompletion = opts.SkipCompletion
+
+	return grouped
+}
+
+// openIncident opens an incident, its stash uses the options of the trigger
+// which opened it and is kept open, so retention doesn't purge it, until the
+// incident resolves. It must be called with the lock held.
+func (t *Tracker) openIncident(opts stashserver.StashOptions, now time.Time) *Incident {
+	id := "incident-" + now.Format(tsFormat)
+	for i := 2; t.get(id) != nil; i++ {
+		id = fmt.Sprintf("incident-%s-%d", now.Format(tsFormat), i)
+	}
+
+	labels := map[string]string{IncidentLabel: id}
+	for k, v := range opts.Labels {
+		labels[k] = v
+	}
+
+	incident := &Incident{
+		ID:        id,
+		Status:    IncidentOpen,
+		StartTime: now,
+	}
+
+	// The stash records the trigger and event which opened the incident
+	incident.opts = stashserver.StashOptions{
+		Name:         id,
+		Trigger:      opts.Trigger,
+		Source:       opts.Source,
+		Labels:       labels,
+		Annotations:  opts.Annotations,
+		TriggerEvent: opts.TriggerEvent,
+		Scope:        opts.Scope,
+		Replace:      true,
+		Open:         true,
+	}
+
+	t.open = incident
+	t.incidents = append(t.incidents, incident)
+
+	if len(t.incidents) > t.cfg.MaxIncidents {
+		t.incidents = t.incidents[len(t.incidents)-t.cfg.MaxIncidents:]
+	}
+
+	log.Info("Incident opened", "incident", id, "trigger", opts.Trigger)
+
+	return incident
+}
+
+// Handle resolves the open incident if the event is a recovery event
+func (t *Tracker) Handle(in *corev1.Event) {
+	if t.recoveryFilter == nil {
+		return
+	}
+
+	t.mx.Lock()
+	incident := t.open
+	t.mx.Unlock()
+
+	if incident == nil {
+		return
+	}
+
+	if len(t.cfg.RecoveryReasons) != 0 && !slices.Contains(t.cfg.RecoveryReasons, in.Reason) {
+		return
+	}
+
+	if !t.recoveryFilter.Match(in) {
+		return
+	}
+
+	go t.resolve(incident, fmt.Sprintf("recovery event %s for %s", in.Reason, objectName(in)))
+}
+
+// resolve resolves the incident if it is still open and writes its stash a
+// final time, so it includes the events up to the incident resolving
+func (t *Tracker) resolve(incident *Incident, reason string) {
+	t.mx.Lock()
+
+	if t.open != incident {
+		t.mx.Unlock()
+		return
+	}
+
+	t.open = nil
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+
+	incident.Status = IncidentResolved
+	incident.EndTime = time.Now()
+	incident.ResolvedBy = reason
+	opts := incident.opts
+	opts.Open = false
+	opts.SkipCompletion = true
+
+	t.mx.Unlock()
+
+	log.Info("Incident resolved", "incident", incident.ID, "reason", reason)
+
+	if _, err := t.creator.CreateStash(opts); err != nil {
+		log.Error(err, "Failed to update incident stash", "incident", incident.ID)
+	}
+}
+
+// List returns the incidents, most recent first
+func (t *Tracker) List() []Incident {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	incidents := make([]Incident, 0, len(t.incidents))
+	for i := len(t.incidents) - 1; i >= 0; i-- {
+		incidents = append(incidents, t.incidents[i].copy())
+	}
+
+	return incidents
+}
+
+// Get returns an incident
+func (t *Tracker) Get(id string) (Incident, bool) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if incident := t.get(id); incident != nil {
+		return incident.copy(), true
+	}
+
+	return Incident{}, false
+}
+
+func (t *Tracker) get(id string) *Incident {
+	for _, incident := range t.incidents {
+		if incident.ID == id {
+			return incident
+		}
+	}
+
+	return nil
+}
+
+// ServeHTTP serves the incidents API on /incidents and /incidents/<id>
+func (t *Tracker) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/incidents"), "/")
+
+	var v interface{}
+
+	if id == "" {
+		v = t.List()
+	} else {
+		incident, exists := t.Get(id)
+		if !exists {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		v = incident
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(v)
+}
+
+func (i *Incident) copy() Incident {
+	c := *i
+	c.Firings = slices.Clone(i.Firings)
+
+	return c
+}
+
+func newFiring(opts stashserver.StashOptions, now time.Time) Firing {
+	f := Firing{
+		Time:    now,
+		Trigger: opts.Trigger,
+	}
+
+	if in := opts.TriggerEvent; in != nil {
+		f.Reason = in.Reason
+		f.Object = objectName(in)
+		f.Message = in.Message
+	}
+
+	return f
+}
+
+func objectName(in *corev1.Event) string {
+	obj := in.InvolvedObject
+	if obj.Namespace == "" {
+		return fmt.Sprintf("%s/%s", obj.Kind, obj.Name)
+	}
+
+	return fmt.Sprintf("%s/%s/%s", obj.Kind, obj.Namespace, obj.Name)
+}
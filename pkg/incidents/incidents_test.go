@@ -0,0 +1,182 @@
+package incidents
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	"github.com/couchbase/k8s-event-collector/pkg/stashserver"
+	corev1 "k8s.io/api/core/v1"
+)
+
+type testCreator struct {
+	mx      sync.Mutex
+	created []stashserver.StashOptions
+}
+
+func (c *testCreator) CreateStash(opts stashserver.StashOptions) (stashserver.Stash, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.created = append(c.created, opts)
+
+	return stashserver.Stash{Name: opts.Name, Status: stashserver.StashComplete}, nil
+}
+
+func (c *testCreator) count() int {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	return len(c.created)
+}
+
+func createEvent(eventType, reason, kind string) *corev1.Event {
+	return &corev1.Event{
+		InvolvedObject: corev1.ObjectReference{
+			Kind:      kind,
+			Name:      "cb-example",
+			Namespace: "default",
+		},
+		Reason: reason,
+		Type:   eventType,
+	}
+}
+
+func triggerOpts(trigger string, in *corev1.Event) stashserver.StashOptions {
+	return stashserver.StashOptions{
+		Trigger:             trigger,
+		Labels:              map[string]string{"team": "operator"},
+		TriggerEvent:        in,
+		CompletionCallbacks: []stashserver.StashCompletionFunc{func(*stashserver.Stash) {}},
+	}
+}
+
+func TestTrackerGroupsFirings(t *testing.T) {
+	tracker := NewTracker(config.IncidentConfiguration{}, &testCreator{}, nil)
+
+	first := tracker.Group(triggerOpts("warnings", createEvent(corev1.EventTypeWarning, "BackOff", "Pod")))
+	second := tracker.Group(triggerOpts("oom", createEvent(corev1.EventTypeWarning, "ContainerTerminated", "Pod")))
+
+	if first.Name == "" || first.Name != second.Name || !first.Replace || !second.Replace {
+		t.Fatalf("expected both firings to replace the same stash, got %q and %q", first.Name, second.Name)
+	}
+
+	if first.Labels[IncidentLabel] != first.Name || first.Labels["team"] != "operator" {
+		t.Fatalf("unexpected incident stash labels %v", first.Labels)
+	}
+
+	// The triggers callbacks and one recording the stash name, the servers
+	// callbacks are also only run for the first write
+	if len(first.CompletionCallbacks) != 2 || len(second.CompletionCallbacks) != 0 || first.SkipCompletion || !second.SkipCompletion {
+		t.Fatalf("expected completion callbacks only for the first firing")
+	}
+
+	// The stash isn't purged while the incident is open
+	if !first.Open || !second.Open {
+		t.Fatalf("expected the incident stash to be kept open")
+	}
+
+	first.CompletionCallbacks[1](&stashserver.Stash{Name: "event-log-" + first.Name})
+
+	incidents := tracker.List()
+	if len(incidents) != 1 {
+		t.Fatalf("expected 1 incident, got %d", len(incidents))
+	}
+
+	incident := incidents[0]
+	if incident.Status != IncidentOpen || incident.FiringCount != 2 || len(incident.Firings) != 2 || incident.StashName != "event-log-"+first.Name {
+		t.Fatalf("unexpected incident %+v", incident)
+	}
+
+	if incident.Firings[1].Trigger != "oom" || incident.Firings[1].Reason != "ContainerTerminated" || incident.Firings[1].Object != "Pod/default/cb-example" {
+		t.Fatalf("unexpected firing %+v", incident.Firings[1])
+	}
+}
+
+func TestTrackerQuietPeriod(t *testing.T) {
+	creator := &testCreator{}
+	tracker := NewTracker(config.IncidentConfiguration{QuietPeriod: 200 * time.Millisecond}, creator, nil)
+
+	first := tracker.Group(triggerOpts("warnings", nil))
+	time.Sleep(100 * time.Millisecond)
+	tracker.Group(triggerOpts("warnings", nil))
+	time.Sleep(150 * time.Millisecond)
+
+	// The second firing extended the incident
+	if incident, _ := tracker.Get(first.Name); incident.Status != IncidentOpen {
+		t.Fatalf("expected the incident to still be open, got %s", incident.Status)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	incident, _ := tracker.Get(first.Name)
+	if incident.Status != IncidentResolved || incident.EndTime.IsZero() || incident.ResolvedBy == "" {
+		t.Fatalf("expected the incident to be resolved, got %+v", incident)
+	}
+
+	// The stash is updated a final time, closing it without notifying again
+	if creator.count() != 1 || creator.created[0].Open || !creator.created[0].SkipCompletion {
+		t.Fatalf("expected the incident stash to be updated, got %+v", creator.created)
+	}
+
+	// Later firings open a new incident
+	if next := tracker.Group(triggerOpts("warnings", nil)); next.Name == first.Name {
+		t.Fatal("expected a new incident to be opened")
+	}
+}
+
+func TestTrackerRecoveryEvent(t *testing.T) {
+	creator := &testCreator{}
+	tracker := NewTracker(config.IncidentConfiguration{
+		RecoveryEventType:    corev1.EventTypeNormal,
+		RecoveryEventFilters: []config.KubernetesResourceFilter{{Resource: "CouchbaseCluster"}},
+		RecoveryReasons:      []string{"ClusterReady"},
+	}, creator, nil)
+
+	opts := tracker.Group(triggerOpts("warnings", nil))
+
+	tracker.Handle(createEvent(corev1.EventTypeNormal, "ClusterReady", "Pod"))
+	tracker.Handle(createEvent(corev1.EventTypeNormal, "Scheduled", "CouchbaseCluster"))
+	tracker.Handle(createEvent(corev1.EventTypeNormal, "ClusterReady", "CouchbaseCluster"))
+
+	time.Sleep(100 * time.Millisecond)
+
+	incident, _ := tracker.Get(opts.Name)
+	if incident.Status != IncidentResolved || creator.count() != 1 {
+		t.Fatalf("expected the recovery event to resolve the incident, got %+v", incident)
+	}
+}
+
+func TestIncidentsAPI(t *testing.T) {
+	tracker := NewTracker(config.IncidentConfiguration{}, &testCreator{}, nil)
+	opts := tracker.Group(triggerOpts("warnings", nil))
+
+	rw := httptest.NewRecorder()
+	tracker.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/incidents", nil))
+
+	incidents := []Incident{}
+	if err := json.NewDecoder(rw.Body).Decode(&incidents); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(incidents) != 1 || incidents[0].ID != opts.Name {
+		t.Fatalf("unexpected incidents %+v", incidents)
+	}
+
+	rw = httptest.NewRecorder()
+	tracker.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/incidents/"+opts.Name, nil))
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	tracker.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/incidents/missing", nil))
+
+	if rw.Code != http.StatusNotFound {
+		t.Fatalf("expected %d, got %d", http.StatusNotFound, rw.Code)
+	}
+}
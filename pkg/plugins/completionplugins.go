@@ -18,18 +18,30 @@ var log = logf.Log.WithName("completion-plugins")
 
 // AddPlugins parses the config and adds the specified plugins
 func AddPlugins(ss *stashserver.StashServer, cfg *config.CompletionPluginsConfiguration, kubeClient kubernetes.Interface) {
+	for _, callback := range CreateCompletionFuncs(cfg, kubeClient) {
+		ss.AddCompletionCallback(callback)
+	}
+}
+
+// CreateCompletionFuncs parses the config and creates the completion
+// callbacks for the specified plugins
+func CreateCompletionFuncs(cfg *config.CompletionPluginsConfiguration, kubeClient kubernetes.Interface) []stashserver.StashCompletionFunc {
 	if cfg == nil {
-		return
+		return nil
 	}
 
+	var callbacks []stashserver.StashCompletionFunc
+
 	if ke := cfg.KubernetesEvent; ke != nil {
 		if ke.Enabled {
-			ss.AddCompletionCallback(func(d *stashserver.Stash) {
+			callbacks = append(callbacks, func(d *stashserver.Stash) {
 				CreateStashEvent(d, kubeClient)
 			})
 			log.Info("Added Kubernetes Event Completion plugin")
 		}
 	}
+
+	return callbacks
 }
 
 func CreateStashEvent(d *stashserver.Stash, c kubernetes.Interface) {
@@ -42,6 +54,9 @@ func CreateStashEvent(d *stashserver.Stash, c kubernetes.Interface) {
 	t := time.Now()
 
 	msg := fmt.Sprintf("Stash %s created", d.Name)
+	if d.Trigger != "" {
+		msg = fmt.Sprintf("Stash %s created by trigger %s", d.Name, d.Trigger)
+	}
 	e := &v1.Event{
 		ObjectMeta: metav1.ObjectMeta{
 			GenerateName: selfPod.Name,
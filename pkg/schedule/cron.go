@@ -0,0 +1,199 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule reports the next time after t it is due
+type Schedule interface {
+	Next(t time.Time) time.Time
+}
+
+// CronSchedule is a standard five field cron schedule of minute, hour, day of
+// month, month and day of week
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// As with cron if both day of month and day of week are restricted a
+	// day matches if either does
+	domRestricted, dowRestricted bool
+}
+
+// EverySchedule is due at a fixed interval
+type EverySchedule struct {
+	Interval time.Duration
+}
+
+// maxSearchYears limits how far ahead a schedule is searched, which stops
+// schedules which can never be due such as 30th February looping forever
+const maxSearchYears = 5
+
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse parses a cron expression, the @hourly style descriptors and
+// "@every <duration>" are also supported
+func Parse(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+
+	if interval, ok := strings.CutPrefix(spec, "@every "); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(interval))
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval in schedule %q: %w", spec, err)
+		}
+
+		if d < time.Second {
+			return nil, fmt.Errorf("interval in schedule %q must be at least 1s", spec)
+		}
+
+		return EverySchedule{Interval: d}, nil
+	}
+
+	if expanded, ok := descriptors[spec]; ok {
+		spec = expanded
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q must have 5 fields", spec)
+	}
+
+	s := &CronSchedule{}
+	var err error
+
+	if s.minute, err = parseField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("invalid minute in schedule %q: %w", spec, err)
+	}
+
+	if s.hour, err = parseField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("invalid hour in schedule %q: %w", spec, err)
+	}
+
+	if s.dom, err = parseField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("invalid day of month in schedule %q: %w", spec, err)
+	}
+
+	if s.month, err = parseField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("invalid month in schedule %q: %w", spec, err)
+	}
+
+	if s.dow, err = parseField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("invalid day of week in schedule %q: %w", spec, err)
+	}
+
+	// Sunday can be either 0 or 7
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+
+	s.domRestricted = !strings.HasPrefix(fields[2], "*")
+	s.dowRestricted = !strings.HasPrefix(fields[4], "*")
+
+	return s, nil
+}
+
+// parseField parses a comma separated list of values, ranges and steps into
+// a bit set
+func parseField(field string, min, max int) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+		}
+
+		start, end := min, max
+
+		if rangePart != "*" {
+			startPart, endPart, isRange := strings.Cut(rangePart, "-")
+
+			var err error
+			if start, err = strconv.Atoi(startPart); err != nil {
+				return 0, fmt.Errorf("invalid value %q", startPart)
+			}
+
+			end = start
+			if isRange {
+				if end, err = strconv.Atoi(endPart); err != nil {
+					return 0, fmt.Errorf("invalid value %q", endPart)
+				}
+			} else if hasStep {
+				end = max
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("%q is outside of the range %d-%d", part, min, max)
+		}
+
+		for i := start; i <= end; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+
+	return bits, nil
+}
+
+// Next returns the next time after t the schedule is due
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(maxSearchYears, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+func (s *CronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+
+	if s.domRestricted && s.dowRestricted {
+		return domMatch || dowMatch
+	}
+
+	return domMatch && dowMatch
+}
+
+// Next returns the next time after t the schedule is due
+func (s EverySchedule) Next(t time.Time) time.Time {
+	return t.Add(s.Interval)
+}
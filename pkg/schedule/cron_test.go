@@ -0,0 +1,66 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func mustParse(t *testing.T, spec string) Schedule {
+	s, err := Parse(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestCronNext(t *testing.T) {
+	start := time.Date(2024, time.January, 31, 22, 17, 30, 0, time.UTC)
+
+	tests := []struct {
+		spec     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2024, time.January, 31, 22, 18, 0, 0, time.UTC)},
+		{"0 */6 * * *", time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 9 * * 1-5", time.Date(2024, time.February, 1, 9, 30, 0, 0, time.UTC)},
+		{"15,45 22 * * *", time.Date(2024, time.January, 31, 22, 45, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, time.February, 4, 0, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"@every 6h", start.Add(6 * time.Hour)},
+	}
+
+	for _, test := range tests {
+		if next := mustParse(t, test.spec).Next(start); !next.Equal(test.expected) {
+			t.Errorf("Unexpected next time for %q, expected: %v got: %v", test.spec, test.expected, next)
+		}
+	}
+}
+
+func TestCronDayOfMonthOrDayOfWeek(t *testing.T) {
+	// 1st of the month or a Monday, 1st Feb 2024 is a Thursday
+	s := mustParse(t, "0 0 1 * 1")
+	start := time.Date(2024, time.February, 1, 12, 0, 0, 0, time.UTC)
+
+	expected := time.Date(2024, time.February, 5, 0, 0, 0, 0, time.UTC)
+	if next := s.Next(start); !next.Equal(expected) {
+		t.Errorf("Expected either day field to match, expected: %v got: %v", expected, next)
+	}
+}
+
+func TestCronNeverDue(t *testing.T) {
+	s := mustParse(t, "0 0 30 2 *")
+
+	if next := s.Next(time.Now()); !next.IsZero() {
+		t.Errorf("Expected a schedule which is never due to return zero time, got: %v", next)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "*/0 * * * *", "5-1 * * * *", "@every", "@every 1ms", "a * * * *"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Expected %q to be invalid", spec)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package schedule
+
+import (
+	"context"
+	"time"
+
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+var log = logf.Log.WithName("scheduler")
+
+type job struct {
+	name     string
+	schedule Schedule
+	run      func()
+}
+
+// Scheduler runs jobs on their schedules
+type Scheduler struct {
+	jobs []job
+}
+
+// Add parses the schedule spec and adds a job to run on it
+func (s *Scheduler) Add(name, spec string, run func()) error {
+	schedule, err := Parse(spec)
+	if err != nil {
+		return err
+	}
+
+	s.jobs = append(s.jobs, job{name: name, schedule: schedule, run: run})
+
+	return nil
+}
+
+// Run runs the jobs on their schedules until the context is done
+func (s *Scheduler) Run(ctx context.Context) {
+	for _, j := range s.jobs {
+		go s.runJob(ctx, j)
+	}
+}
+
+func (s *Scheduler) runJob(ctx context.Context, j job) {
+	for {
+		next := j.schedule.Next(time.Now())
+		if next.IsZero() {
+			log.Info("WARN: Schedule is never due, stopping job", "job", j.name)
+			return
+		}
+
+		log.Info("Next scheduled run", "job", j.name, "time", next)
+		timer := time.NewTimer(time.Until(next))
+
+		select {
+		case <-timer.C:
+			j.run()
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,454 @@
+package silences
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/k8s-event-collector/internal/atomicfile"
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	"github.com/couchbase/k8s-event-collector/pkg/schedule"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+var log = logf.Log.WithName("silences")
+
+// FileName is the name of the file silences are persisted in
+const FileName = "silences.json"
+
+var (
+	// ErrNotFound is returned when a silence doesn't exist
+	ErrNotFound = errors.New("silence not found")
+	// ErrConfigured is returned when deleting a silence from the config file
+	ErrConfigured = errors.New("configured silences can't be deleted")
+	// ErrInvalid is returned when adding an invalid silence
+	ErrInvalid = errors.New("invalid silence")
+)
+
+// Silence suppresses triggered stashes, either between StartsAt and EndsAt
+// or during recurring windows starting on the Schedule and lasting for the
+// Duration. A silence with no Triggers, Namespaces or Objects silences every
+// triggered stash.
+type Silence struct {
+	ID       string
+	Comment  string
+	StartsAt time.Time
+	EndsAt   time.Time
+	Schedule string
+	// Duration is a Go duration such as "2h"
+	Duration   string
+	Triggers   []string
+	Namespaces []string
+	Objects    []config.SilencedObjectConfiguration
+	// Configured silences are from the config file and aren't persisted
+	Configured bool
+
+	schedule schedule.Schedule
+	duration time.Duration
+}
+
+// FromConfig creates a silence from the config file
+func FromConfig(cfg config.SilenceConfiguration) (Silence, error) {
+	s := Silence{
+		ID:         "config-" + cfg.Name,
+		Comment:    cfg.Comment,
+		Schedule:   cfg.Schedule,
+		Triggers:   cfg.Triggers,
+		Namespaces: cfg.Namespaces,
+		Objects:    cfg.Objects,
+		Configured: true,
+	}
+
+	if cfg.Duration > 0 {
+		s.Duration = cfg.Duration.String()
+	}
+
+	var err error
+
+	if cfg.StartsAt != "" {
+		if s.StartsAt, err = time.Parse(time.RFC3339, cfg.StartsAt); err != nil {
+			return s, fmt.Errorf("invalid startsAt: %w", err)
+		}
+	}
+
+	if cfg.EndsAt != "" {
+		if s.EndsAt, err = time.Parse(time.RFC3339, cfg.EndsAt); err != nil {
+			return s, fmt.Errorf("invalid endsAt: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+// validate checks the silence is either between two times or recurring,
+// parsing its schedule
+func (s *Silence) validate() error {
+	if s.Schedule == "" {
+		if s.EndsAt.IsZero() {
+			return fmt.Errorf("silences must have an end time or a schedule")
+		}
+
+		if !s.StartsAt.IsZero() && !s.EndsAt.After(s.StartsAt) {
+			return fmt.Errorf("silences must end after they start")
+		}
+
+		return nil
+	}
+
+	sched, err := schedule.Parse(s.Schedule)
+	if err != nil {
+		return err
+	}
+
+	if _, isInterval := sched.(schedule.EverySchedule); isInterval {
+		return fmt.Errorf("silence schedules must be cron expressions")
+	}
+
+	if s.duration, err = time.ParseDuration(s.Duration); err != nil || s.duration <= 0 {
+		return fmt.Errorf("recurring silences must have a positive duration")
+	}
+
+	s.schedule = sched
+
+	return nil
+}
+
+// Active returns whether the silence is in effect at the time
+func (s *Silence) Active(t time.Time) bool {
+	if s.schedule != nil {
+		// The window is active if it started within the duration before t
+		start := s.schedule.Next(t.Add(-s.duration))
+		return !start.IsZero() && !start.After(t)
+	}
+
+	return !t.Before(s.StartsAt) && t.Before(s.EndsAt)
+}
+
+// Expired returns whether the silence will never be in effect again
+func (s *Silence) Expired(t time.Time) bool {
+	return s.schedule == nil && !t.Before(s.EndsAt)
+}
+
+// Matches returns whether the silence applies to a stash taken by the
+// trigger for the event, the event may be nil
+func (s *Silence) Matches(trigger string, in *corev1.Event) bool {
+	if len(s.Triggers) != 0 && !slices.Contains(s.Triggers, trigger) {
+		return false
+	}
+
+	if len(s.Namespaces) == 0 && len(s.Objects) == 0 {
+		return true
+	}
+
+	if in == nil {
+		return false
+	}
+
+	obj := in.InvolvedObject
+	namespace := obj.Namespace
+	if namespace == "" {
+		namespace = in.Namespace
+	}
+
+	if len(s.Namespaces) != 0 && !slices.Contains(s.Namespaces, namespace) {
+		return false
+	}
+
+	if len(s.Objects) == 0 {
+		return true
+	}
+
+	for _, o := range s.Objects {
+		if (o.Kind == "" || o.Kind == obj.Kind) && (o.Name == "" || o.Name == obj.Name) && (o.Namespace == "" || o.Namespace == namespace) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Store holds silences, those created through the API are persisted so they
+// survive restarts
+type Store struct {
+	path string
+
+	mx       sync.RWMutex
+	silences map[string]*Silence
+}
+
+// NewStore creates a new Store, loading any silences persisted in the directory
+func NewStore(dir string) *Store {
+	s := &Store{
+		path:     filepath.Join(dir, FileName),
+		silences: make(map[string]*Silence),
+	}
+
+	s.load()
+
+	return s
+}
+
+func (s *Store) load() {
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+
+	var silences []Silence
+	if err == nil {
+		err = json.Unmarshal(b, &silences)
+	}
+
+	if err != nil {
+		log.Error(err, "Couldn't load silences")
+		return
+	}
+
+	for i := range silences {
+		silence := silences[i]
+
+		if err := silence.validate(); err != nil {
+			log.Error(err, "Ignoring invalid silence", "id", silence.ID)
+			continue
+		}
+
+		s.silences[silence.ID] = &silence
+	}
+}
+
+// save persists the silences which weren't configured, expired silences are
+// removed first. It must be called with the lock held.
+func (s *Store) save() error {
+	now := time.Now()
+	silences := []*Silence{}
+
+	for id, silence := range s.silences {
+		if silence.Expired(now) {
+			delete(s.silences, id)
+			continue
+		}
+
+		if !silence.Configured {
+			silences = append(silences, silence)
+		}
+	}
+
+	b, err := json.Marshal(silences)
+	if err != nil {
+		return err
+	}
+
+	// Written atomically so a crash can't leave partial silences
+	return atomicfile.WriteFile(s.path, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
+
+// AddConfigured adds silences from the config file, invalid silences are
+// logged and ignored
+func (s *Store) AddConfigured(cfgs []config.SilenceConfiguration) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for i, cfg := range cfgs {
+		if cfg.Name == "" {
+			cfg.Name = fmt.Sprint(i)
+		}
+
+		silence, err := FromConfig(cfg)
+		if err == nil {
+			err = silence.validate()
+		}
+
+		if err != nil {
+			log.Error(err, "Invalid silence, ignoring", "name", cfg.Name)
+			continue
+		}
+
+		s.silences[silence.ID] = &silence
+	}
+}
+
+// Add adds a silence with a generated ID and persists it
+func (s *Store) Add(silence Silence) (Silence, error) {
+	silence.ID = string(uuid.NewUUID())
+	silence.Configured = false
+
+	if silence.StartsAt.IsZero() && silence.Schedule == "" {
+		silence.StartsAt = time.Now()
+	}
+
+	if err := silence.validate(); err != nil {
+		return Silence{}, fmt.Errorf("%w: %s", ErrInvalid, err.Error())
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.silences[silence.ID] = &silence
+
+	if err := s.save(); err != nil {
+		delete(s.silences, silence.ID)
+		return Silence{}, fmt.Errorf("failed to persist silence: %w", err)
+	}
+
+	log.Info("Silence added", "id", silence.ID, "comment", silence.Comment)
+
+	return silence, nil
+}
+
+// Delete removes a silence created through the API
+func (s *Store) Delete(id string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	silence, exists := s.silences[id]
+	if !exists {
+		return ErrNotFound
+	}
+
+	if silence.Configured {
+		return ErrConfigured
+	}
+
+	delete(s.silences, id)
+
+	log.Info("Silence deleted", "id", id)
+
+	return s.save()
+}
+
+// Get returns a silence
+func (s *Store) Get(id string) (Silence, bool) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	silence, exists := s.silences[id]
+	if !exists || silence.Expired(time.Now()) {
+		return Silence{}, false
+	}
+
+	return *silence, true
+}
+
+// List returns the silences which haven't expired
+func (s *Store) List() []Silence {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	now := time.Now()
+	silences := []Silence{}
+
+	for _, silence := range s.silences {
+		if !silence.Expired(now) {
+			silences = append(silences, *silence)
+		}
+	}
+
+	sort.Slice(silences, func(i, j int) bool {
+		return silences[i].ID < silences[j].ID
+	})
+
+	return silences
+}
+
+// Silenced returns the ID of an active silence matching the trigger and event
+func (s *Store) Silenced(trigger string, in *corev1.Event) (string, bool) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	now := time.Now()
+
+	for id, silence := range s.silences {
+		if silence.Active(now) && silence.Matches(trigger, in) {
+			return id, true
+		}
+	}
+
+	return "", false
+}
+
+// ServeHTTP serves the silences API on /silences and /silences/<id>
+func (s *Store) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/silences"), "/")
+
+	if id == "" {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(rw, http.StatusOK, s.List())
+		case http.MethodPost:
+			s.handlePost(rw, r)
+		default:
+			rw.WriteHeader(http.StatusBadRequest)
+		}
+
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		silence, exists := s.Get(id)
+		if !exists {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		writeJSON(rw, http.StatusOK, silence)
+	case http.MethodDelete:
+		err := s.Delete(id)
+
+		switch {
+		case errors.Is(err, ErrNotFound):
+			rw.WriteHeader(http.StatusNotFound)
+		case errors.Is(err, ErrConfigured):
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte(err.Error()))
+		case err != nil:
+			rw.WriteHeader(http.StatusInternalServerError)
+		default:
+			rw.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		rw.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (s *Store) handlePost(rw http.ResponseWriter, r *http.Request) {
+	silence := Silence{}
+	if err := json.NewDecoder(r.Body).Decode(&silence); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	silence, err := s.Add(silence)
+	if errors.Is(err, ErrInvalid) {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	writeJSON(rw, http.StatusCreated, silence)
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(v)
+}
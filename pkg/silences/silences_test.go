@@ -0,0 +1,196 @@
+package silences
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func createEvent(namespace, kind, name string) *corev1.Event {
+	return &corev1.Event{
+		InvolvedObject: corev1.ObjectReference{
+			Kind:      kind,
+			Name:      name,
+			Namespace: namespace,
+		},
+	}
+}
+
+func mustAdd(t *testing.T, store *Store, silence Silence) Silence {
+	silence, err := store.Add(silence)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return silence
+}
+
+func TestSilenceMatches(t *testing.T) {
+	s := Silence{
+		Triggers:   []string{"warnings"},
+		Namespaces: []string{"default"},
+		Objects:    []config.SilencedObjectConfiguration{{Kind: "Pod", Name: "cb-0000"}, {Kind: "CouchbaseCluster"}},
+	}
+
+	tests := []struct {
+		trigger  string
+		event    *corev1.Event
+		expected bool
+	}{
+		{"warnings", createEvent("default", "Pod", "cb-0000"), true},
+		{"warnings", createEvent("default", "CouchbaseCluster", "cb"), true},
+		{"warnings", createEvent("default", "Pod", "cb-0001"), false},
+		{"warnings", createEvent("other", "Pod", "cb-0000"), false},
+		{"alerts", createEvent("default", "Pod", "cb-0000"), false},
+		{"warnings", nil, false},
+	}
+
+	for i, test := range tests {
+		if s.Matches(test.trigger, test.event) != test.expected {
+			t.Errorf("test %d: expected match %v", i, test.expected)
+		}
+	}
+
+	if !(&Silence{}).Matches("anything", nil) {
+		t.Error("expected a silence without matchers to match everything")
+	}
+}
+
+func TestRecurringSilence(t *testing.T) {
+	s := Silence{Schedule: "0 2 * * 6", Duration: "4h"}
+	if err := s.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 2024-01-06 is a Saturday
+	saturday := time.Date(2024, 1, 6, 0, 0, 0, 0, time.Local)
+
+	tests := map[time.Duration]bool{
+		1 * time.Hour:  false,
+		2 * time.Hour:  true,
+		5 * time.Hour:  true,
+		6 * time.Hour:  false,
+		26 * time.Hour: false,
+	}
+
+	for offset, expected := range tests {
+		if s.Active(saturday.Add(offset)) != expected {
+			t.Errorf("expected silence active at %s to be %v", saturday.Add(offset), expected)
+		}
+	}
+
+	if s.Expired(saturday.AddDate(1, 0, 0)) {
+		t.Error("expected recurring silences never to expire")
+	}
+
+	if err := (&Silence{Schedule: "@every 1h", Duration: "1h"}).validate(); err == nil {
+		t.Error("expected interval schedules to be invalid")
+	}
+
+	if err := (&Silence{Schedule: "@daily"}).validate(); err == nil {
+		t.Error("expected recurring silences without a duration to be invalid")
+	}
+}
+
+func TestStoreSilenced(t *testing.T) {
+	store := NewStore(t.TempDir())
+
+	mustAdd(t, store, Silence{EndsAt: time.Now().Add(time.Hour), Namespaces: []string{"default"}})
+	mustAdd(t, store, Silence{StartsAt: time.Now().Add(time.Hour), EndsAt: time.Now().Add(2 * time.Hour)})
+
+	if _, silenced := store.Silenced("warnings", createEvent("default", "Pod", "cb-0000")); !silenced {
+		t.Error("expected the event to be silenced")
+	}
+
+	if _, silenced := store.Silenced("warnings", createEvent("other", "Pod", "cb-0000")); silenced {
+		t.Error("expected the pending silence not to be active")
+	}
+
+	if _, err := store.Add(Silence{EndsAt: time.Now().Add(-time.Hour)}); err == nil {
+		t.Error("expected a silence ending in the past to be invalid")
+	}
+}
+
+func TestStorePersisted(t *testing.T) {
+	dir := t.TempDir()
+	store := NewStore(dir)
+	store.AddConfigured([]config.SilenceConfiguration{{Name: "upgrade", Schedule: "0 2 * * 6", Duration: 4 * time.Hour}})
+
+	silence := mustAdd(t, store, Silence{Comment: "rebalance", EndsAt: time.Now().Add(time.Hour)})
+	mustAdd(t, store, Silence{Comment: "deleted", EndsAt: time.Now().Add(time.Hour)})
+
+	if len(store.List()) != 3 {
+		t.Fatalf("expected 3 silences, got %d", len(store.List()))
+	}
+
+	if err := store.Delete("config-upgrade"); err != ErrConfigured {
+		t.Fatalf("expected configured silences not to be deletable, got %v", err)
+	}
+
+	for _, s := range store.List() {
+		if s.Comment == "deleted" {
+			if err := store.Delete(s.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Only silences created through the API are persisted
+	restarted := NewStore(dir)
+	silences := restarted.List()
+
+	if len(silences) != 1 || silences[0].ID != silence.ID || silences[0].Comment != "rebalance" {
+		t.Fatalf("expected the silence to be persisted, got %v", silences)
+	}
+}
+
+func TestSilencesAPI(t *testing.T) {
+	store := NewStore(t.TempDir())
+
+	body, _ := json.Marshal(Silence{Comment: "upgrade", EndsAt: time.Now().Add(time.Hour), Triggers: []string{"warnings"}})
+	rw := httptest.NewRecorder()
+	store.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/silences", bytes.NewReader(body)))
+
+	if rw.Code != http.StatusCreated {
+		t.Fatalf("expected %d, got %d: %s", http.StatusCreated, rw.Code, rw.Body.String())
+	}
+
+	created := Silence{}
+	if err := json.NewDecoder(rw.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+
+	rw = httptest.NewRecorder()
+	store.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/silences/"+created.ID, nil))
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	store.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/silences", bytes.NewReader([]byte(`{"Comment":"no end"}`))))
+
+	if rw.Code != http.StatusBadRequest {
+		t.Fatalf("expected %d for an invalid silence, got %d", http.StatusBadRequest, rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	store.ServeHTTP(rw, httptest.NewRequest(http.MethodDelete, "/silences/"+created.ID, nil))
+
+	if rw.Code != http.StatusNoContent {
+		t.Fatalf("expected %d, got %d", http.StatusNoContent, rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	store.ServeHTTP(rw, httptest.NewRequest(http.MethodDelete, "/silences/"+created.ID, nil))
+
+	if rw.Code != http.StatusNotFound {
+		t.Fatalf("expected %d, got %d", http.StatusNotFound, rw.Code)
+	}
+}
@@ -0,0 +1,136 @@
+package stash
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// APIVersion is the version of the stash envelope format
+	APIVersion = "events.couchbase.com/v1"
+	// Kind is the kind of a stash envelope
+	Kind = "Stash"
+)
+
+// Envelope is the versioned format stashes are written in, it records where
+// the events came from alongside them. Stashes taken by earlier versions are
+// a bare JSON array of events.
+type Envelope struct {
+	APIVersion string           `json:"apiVersion"`
+	Kind       string           `json:"kind"`
+	Metadata   EnvelopeMetadata `json:"metadata"`
+	Events     []*corev1.Event  `json:"events"`
+}
+
+// EnvelopeMetadata describes the collector which took a stash and which
+// events it includes
+type EnvelopeMetadata struct {
+	Name             string            `json:"name"`
+	CreationTime     time.Time         `json:"creationTime"`
+	CollectorVersion string            `json:"collectorVersion,omitempty"`
+	ConfigHash       string            `json:"configHash,omitempty"`
+	Namespace        string            `json:"namespace,omitempty"`
+	Source           string            `json:"source,omitempty"`
+	Trigger          string            `json:"trigger,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	Filter           *EnvelopeFilter   `json:"filter,omitempty"`
+	EventCount       int               `json:"eventCount"`
+	FirstEventTime   time.Time         `json:"firstEventTime"`
+	LastEventTime    time.Time         `json:"lastEventTime"`
+}
+
+// EnvelopeFilter is the scope the events of a stash were restricted to,
+// Since and Until are nil if the stash wasn't restricted by time
+type EnvelopeFilter struct {
+	Since     *time.Time               `json:"since,omitempty"`
+	Until     *time.Time               `json:"until,omitempty"`
+	Types     []string                 `json:"types,omitempty"`
+	Resources []EnvelopeResourceFilter `json:"resources,omitempty"`
+}
+
+// EnvelopeResourceFilter is a filter on the involved objects of events
+type EnvelopeResourceFilter struct {
+	APIVersion string            `json:"apiVersion,omitempty"`
+	Resource   string            `json:"resource,omitempty"`
+	Name       string            `json:"name,omitempty"`
+	Namespace  string            `json:"namespace,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// NewEnvelope returns the envelope to write events in, the metadata is
+// completed from the summary of the events
+func NewEnvelope(metadata EnvelopeMetadata, events []*corev1.Event, summary Summary) Envelope {
+	metadata.EventCount = summary.EventCount
+	metadata.FirstEventTime = summary.FirstEventTime
+	metadata.LastEventTime = summary.LastEventTime
+
+	if events == nil {
+		events = []*corev1.Event{}
+	}
+
+	return Envelope{
+		APIVersion: APIVersion,
+		Kind:       Kind,
+		Metadata:   metadata,
+		Events:     events,
+	}
+}
+
+// IsLegacy returns whether the envelope was decoded from a stash taken
+// before the envelope format, which only has events
+func (e *Envelope) IsLegacy() bool {
+	return e.APIVersion == ""
+}
+
+// Decode decodes a stash in either the envelope or the legacy format
+func Decode(r io.Reader) (*Envelope, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Envelope{}
+
+	if IsLegacyFormat(b) {
+		err := json.Unmarshal(b, &e.Events)
+		return e, err
+	}
+
+	if err := json.Unmarshal(b, e); err != nil {
+		return nil, err
+	}
+
+	if e.APIVersion != APIVersion || e.Kind != Kind {
+		return nil, fmt.Errorf("unsupported stash format %s %s", e.APIVersion, e.Kind)
+	}
+
+	return e, nil
+}
+
+// ConvertLegacy converts a stash taken before the envelope format to an
+// envelope with the metadata, a stash which is already an envelope is
+// written unchanged. The summary of the stashes events is returned.
+func ConvertLegacy(r io.Reader, w io.Writer, metadata EnvelopeMetadata) (Summary, error) {
+	e, err := Decode(r)
+	if err != nil {
+		return Summary{}, err
+	}
+
+	summary := Summarize(e.Events)
+	if e.IsLegacy() {
+		*e = NewEnvelope(metadata, e.Events, summary)
+	}
+
+	return summary, json.NewEncoder(w).Encode(e)
+}
+
+// IsLegacyFormat returns whether the stash is a bare array of events
+func IsLegacyFormat(b []byte) bool {
+	b = bytes.TrimSpace(b)
+	return len(b) != 0 && b[0] == '['
+}
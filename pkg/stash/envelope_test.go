@@ -0,0 +1,75 @@
+package stash
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestConvertLegacy(t *testing.T) {
+	legacy := `[{"metadata":{"name":"pod.1"},"reason":"BackOff","lastTimestamp":"2023-01-01T10:00:00Z"},
+		{"metadata":{"name":"pod.2"},"reason":"Pulled","lastTimestamp":"2023-01-01T09:00:00Z"}]`
+
+	decoded, err := Decode(strings.NewReader(legacy))
+	if err != nil || !decoded.IsLegacy() || len(decoded.Events) != 2 {
+		t.Fatalf("Expected a legacy stash to be decoded: %+v, %v", decoded, err)
+	}
+
+	var b bytes.Buffer
+	summary, err := ConvertLegacy(strings.NewReader(legacy), &b, EnvelopeMetadata{Name: "stash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if summary.EventCount != 2 || !summary.FirstEventTime.Equal(time.Date(2023, 1, 1, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the summary of the converted events: %+v", summary)
+	}
+
+	e, err := Decode(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.IsLegacy() || e.Kind != Kind || e.Metadata.Name != "stash" || e.Metadata.EventCount != 2 ||
+		!e.Metadata.FirstEventTime.Equal(time.Date(2023, 1, 1, 9, 0, 0, 0, time.UTC)) ||
+		!e.Metadata.LastEventTime.Equal(time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the stash to be converted to an envelope: %+v", e)
+	}
+}
+
+func TestDecodeUnsupported(t *testing.T) {
+	if _, err := Decode(strings.NewReader(`{"apiVersion":"events.couchbase.com/v2","kind":"Stash"}`)); err == nil {
+		t.Errorf("Expected an unsupported envelope version to fail")
+	}
+}
+
+func TestEventTime(t *testing.T) {
+	first := metav1.NewTime(time.Date(2023, 1, 1, 9, 0, 0, 0, time.UTC))
+	last := metav1.NewTime(time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC))
+
+	e := &corev1.Event{FirstTimestamp: first}
+	if !EventTime(e).Equal(first.Time) {
+		t.Errorf("Expected the first timestamp without a last timestamp, got %v", EventTime(e))
+	}
+
+	e.LastTimestamp = last
+	if !EventTime(e).Equal(last.Time) {
+		t.Errorf("Expected the last timestamp, got %v", EventTime(e))
+	}
+}
+
+func TestEnvelopeFilterOmitsUnsetTimes(t *testing.T) {
+	b, err := json.Marshal(EnvelopeFilter{Types: []string{"Warning"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != `{"types":["Warning"]}` {
+		t.Errorf("Expected unset times to be omitted, got %s", b)
+	}
+}
@@ -0,0 +1,101 @@
+package stash
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/couchbase/k8s-event-collector/pkg/filters"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Summary describes the events written to a stash
+type Summary struct {
+	EventCount int
+	// FirstEventTime and LastEventTime are the time range the events cover,
+	// they are zero if there were no events
+	FirstEventTime time.Time
+	LastEventTime  time.Time
+}
+
+// Scope restricts which buffered events are written to a stash, the zero
+// value includes every event
+type Scope struct {
+	// Since excludes events which last occurred before this time
+	Since time.Time
+	// Until excludes events which last occurred after this time
+	Until time.Time
+	// Types optionally excludes events not of one of these types
+	Types []string
+	// Filter optionally excludes events not accepted by the filter set
+	Filter *filters.FilterSet
+	// Envelope is the metadata to write the events in a versioned Envelope
+	// with, if nil the envelope only has the events
+	Envelope *EnvelopeMetadata
+	// Encode writes the events, EncodeJSON is used if it isn't set
+	Encode EncodeFunc
+}
+
+// EncodeFunc writes events in a format. Envelopes decoded from legacy
+// stashes or for the buffer only have events, formats which include
+// metadata write a bare list of events for them.
+type EncodeFunc func(w io.Writer, e *Envelope) error
+
+// EncodeJSON writes the envelope, or a bare array of events if it only has
+// events, it is the default format
+func EncodeJSON(w io.Writer, e *Envelope) error {
+	if e.IsLegacy() {
+		return EncodeLegacy(w, e)
+	}
+
+	return json.NewEncoder(w).Encode(e)
+}
+
+// EncodeLegacy writes a bare array of events, as stashes were before the
+// envelope format
+func EncodeLegacy(w io.Writer, e *Envelope) error {
+	events := e.Events
+	if events == nil {
+		events = []*corev1.Event{}
+	}
+
+	return json.NewEncoder(w).Encode(events)
+}
+
+// Summarize returns the summary of the events
+func Summarize(events []*corev1.Event) Summary {
+	summary := Summary{EventCount: len(events)}
+
+	for _, e := range events {
+		t := EventTime(e)
+		if t.IsZero() {
+			continue
+		}
+
+		if summary.FirstEventTime.IsZero() || t.Before(summary.FirstEventTime) {
+			summary.FirstEventTime = t
+		}
+
+		if t.After(summary.LastEventTime) {
+			summary.LastEventTime = t
+		}
+	}
+
+	return summary
+}
+
+// EventTime returns the time an event last occurred
+func EventTime(e *corev1.Event) time.Time {
+	switch {
+	case e.Series != nil && !e.Series.LastObservedTime.IsZero():
+		return e.Series.LastObservedTime.Time
+	case !e.LastTimestamp.IsZero():
+		return e.LastTimestamp.Time
+	case !e.EventTime.IsZero():
+		return e.EventTime.Time
+	case !e.FirstTimestamp.IsZero():
+		return e.FirstTimestamp.Time
+	default:
+		return e.CreationTimestamp.Time
+	}
+}
@@ -0,0 +1,93 @@
+package stashserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/couchbase/k8s-event-collector/internal/atomicfile"
+)
+
+// tempFileExtension is added to files while they are written, they are only
+// renamed to their final name once complete so a crash can't leave a
+// partial stash or metadata file
+const tempFileExtension = atomicfile.TempFileExtension
+
+// ErrStashCorrupt is recorded as the error of existing stashes which fail
+// validation when they are loaded
+var ErrStashCorrupt = errors.New("stash is corrupt")
+
+// removeTempFiles removes files left partially written by a crash, and
+// metadata files whose stash file no longer exists, it must be called with
+// the lock held before any stashes are written
+func (dm *StashServer) removeTempFiles(entries []os.DirEntry) {
+	stashFiles := map[string]bool{}
+	for _, entry := range entries {
+		stashFiles[entry.Name()] = true
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), dm.stashPrefix) {
+			continue
+		}
+
+		if strings.HasSuffix(entry.Name(), tempFileExtension) {
+			log.Info("Removing partially written file", "file", entry.Name())
+		} else if stashName, isMetadata := strings.CutSuffix(entry.Name(), metadataFileExtension); isMetadata && !stashFiles[stashName+stashFileExtension] {
+			log.Info("Removing metadata of missing stash", "file", entry.Name())
+		} else {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(dm.stashDir, entry.Name())); err != nil {
+			log.Error(err, "Failed to remove file", "file", entry.Name())
+		}
+	}
+}
+
+// validateStash checks an existing stash file is intact, using its checksum
+// if it has one. Stashes taken before checksums were recorded are checked
+// to be valid JSON instead.
+func (dm *StashServer) validateStash(d *Stash) error {
+	if d.Checksum == "" {
+		f, err := dm.openStash(d)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrStashCorrupt, err.Error())
+		}
+		defer f.Close()
+
+		b, err := io.ReadAll(f)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrStashCorrupt, err.Error())
+		}
+
+		if !json.Valid(b) {
+			return fmt.Errorf("%w: it isn't valid JSON", ErrStashCorrupt)
+		}
+
+		return nil
+	}
+
+	f, err := os.Open(dm.getStashLocation(d.Name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	if checksum := hex.EncodeToString(h.Sum(nil)); checksum != d.Checksum {
+		return fmt.Errorf("%w: its checksum is %s but %s was recorded", ErrStashCorrupt, checksum, d.Checksum)
+	}
+
+	return nil
+}
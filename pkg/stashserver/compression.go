@@ -0,0 +1,168 @@
+package stashserver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The compressions stashes can be stored with, they are also the
+// Content-Encoding they are served with
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// SetCompression sets how new stashes are stored, gzip or none. Existing
+// stashes are kept as they are.
+func (dm *StashServer) SetCompression(compression string) error {
+	switch compression {
+	case CompressionNone, "none":
+		compression = CompressionNone
+	case CompressionGzip:
+	case "zstd":
+		return fmt.Errorf("unsupported stash compression %q, zstd isn't available, use gzip or none", compression)
+	default:
+		return fmt.Errorf("unsupported stash compression %q, use gzip or none", compression)
+	}
+
+	dm.stashesMutex.Lock()
+	defer dm.stashesMutex.Unlock()
+
+	dm.compression = compression
+
+	return nil
+}
+
+// compressWriter returns a writer which compresses to w, it must be closed to
+// flush the compressed data
+func compressWriter(w io.Writer, compression string) io.WriteCloser {
+	if compression == CompressionGzip {
+		return gzip.NewWriter(w)
+	}
+
+	return nopWriteCloser{w}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// openStash opens a stash file for reading, decompressing it if needed
+func (dm *StashServer) openStash(d *Stash) (io.ReadCloser, error) {
+	f, err := os.Open(dm.getStashLocation(d.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	if d.Encoding != CompressionGzip {
+		return f, nil
+	}
+
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &gzipReadCloser{zr, f}, nil
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (r *gzipReadCloser) Close() error {
+	r.Reader.Close()
+	return r.f.Close()
+}
+
+// sniffCompression returns the compression of a stash file from its content,
+// for stashes without metadata
+func sniffCompression(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return CompressionNone
+	}
+	defer f.Close()
+
+	header := make([]byte, len(gzipMagic))
+	if _, err := io.ReadFull(f, header); err != nil || !bytes.Equal(header, gzipMagic) {
+		return CompressionNone
+	}
+
+	return CompressionGzip
+}
+
+// acceptsGzip returns whether the client accepts gzip encoded responses. An
+// explicit gzip coding takes precedence over the * wildcard, whichever order
+// they're listed in, and a coding with a q-value of 0 isn't acceptable.
+func acceptsGzip(r *http.Request) bool {
+	gzipQ, wildcardQ := -1.0, -1.0
+
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+
+		switch coding {
+		case CompressionGzip:
+			gzipQ = max(gzipQ, qValue(params))
+		case "*":
+			wildcardQ = max(wildcardQ, qValue(params))
+		}
+	}
+
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+
+	return wildcardQ > 0
+}
+
+// qValue returns the quality value from the parameters of an Accept-Encoding
+// coding, which defaults to 1. Invalid values are treated as 0 so the coding
+// isn't used.
+func qValue(params string) float64 {
+	for _, param := range strings.Split(params, ";") {
+		name, value, _ := strings.Cut(param, "=")
+		if !strings.EqualFold(strings.TrimSpace(name), "q") {
+			continue
+		}
+
+		q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || q < 0 || q > 1 {
+			return 0
+		}
+
+		return q
+	}
+
+	return 1
+}
+
+// compressResponse compresses the response with gzip if the client accepts
+// it, the returned writer must be closed to flush the response
+func compressResponse(rw http.ResponseWriter, r *http.Request) io.WriteCloser {
+	rw.Header().Add("Vary", "Accept-Encoding")
+
+	if !acceptsGzip(r) {
+		return nopWriteCloser{rw}
+	}
+
+	rw.Header().Set("Content-Encoding", CompressionGzip)
+
+	return gzip.NewWriter(rw)
+}
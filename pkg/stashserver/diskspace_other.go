@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package stashserver
+
+import "errors"
+
+// availableBytes isn't supported on this platform, so free space isn't
+// checked before writing stashes
+func availableBytes(dir string) (uint64, error) {
+	return 0, errors.New("free space checks are not supported on this platform")
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin
+
+package stashserver
+
+import "syscall"
+
+// availableBytes returns the free space available to the collector on the
+// filesystem of the directory
+func availableBytes(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,102 @@
+package stashserver
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"github.com/couchbase/k8s-event-collector/pkg/stash"
+)
+
+// envelopeMetadata returns the envelope metadata for a stash
+func envelopeMetadata(d *Stash, scope stash.Scope) stash.EnvelopeMetadata {
+	metadata := stash.EnvelopeMetadata{
+		Name:             d.Name,
+		CreationTime:     d.CreationTime,
+		CollectorVersion: d.CollectorVersion,
+		ConfigHash:       d.ConfigHash,
+		Namespace:        d.Namespace,
+		Source:           string(d.Source),
+		Trigger:          d.Trigger,
+		Labels:           d.Labels,
+	}
+
+	if scope.Since.IsZero() && scope.Until.IsZero() && len(scope.Types) == 0 && scope.Filter == nil {
+		return metadata
+	}
+
+	metadata.Filter = &stash.EnvelopeFilter{
+		Since: optionalTime(scope.Since),
+		Until: optionalTime(scope.Until),
+		Types: scope.Types,
+	}
+
+	if scope.Filter != nil {
+		for _, f := range scope.Filter.Filters() {
+			metadata.Filter.Resources = append(metadata.Filter.Resources, stash.EnvelopeResourceFilter{
+				APIVersion: f.APIVersion,
+				Resource:   f.Resource,
+				Name:       f.Name,
+				Namespace:  f.Namespace,
+				Labels:     f.Labels,
+			})
+		}
+	}
+
+	return metadata
+}
+
+// optionalTime returns nil for the zero time, so it is omitted when encoded
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
+
+// summarizeLegacyStash records the event summary of an existing stash taken
+// before the envelope format, which is left as it is and converted to an
+// envelope when served. It must be called with the lock held.
+func (dm *StashServer) summarizeLegacyStash(d *Stash) error {
+	// The summary is kept in the metadata once the stash has been loaded
+	if d.Legacy {
+		return nil
+	}
+
+	f, err := dm.openStash(d)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b, err := io.ReadAll(f)
+	if err != nil || !stash.IsLegacyFormat(b) {
+		return err
+	}
+
+	e, err := stash.Decode(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	summary := stash.Summarize(e.Events)
+
+	d.Legacy = true
+	d.EventCount = summary.EventCount
+	d.FirstEventTime = summary.FirstEventTime
+	d.LastEventTime = summary.LastEventTime
+	dm.saveStashMetadata(d)
+
+	return nil
+}
+
+// upgradeLegacyEnvelope fills in the envelope of a stash decoded from the
+// legacy format from the stashes metadata
+func upgradeLegacyEnvelope(d *Stash, e *stash.Envelope) {
+	if !e.IsLegacy() {
+		return
+	}
+
+	*e = stash.NewEnvelope(envelopeMetadata(d, stash.Scope{}), e.Events, stash.Summarize(e.Events))
+}
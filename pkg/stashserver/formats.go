@@ -0,0 +1,297 @@
+package stashserver
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/couchbase/k8s-event-collector/pkg/stash"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"sigs.k8s.io/yaml"
+)
+
+// Format is a format stashes and the buffer can be served in
+type Format struct {
+	// Name is used to request the format with the format query parameter
+	Name string
+	// ContentType is what the format is served as, it is also used to
+	// request the format with the Accept header
+	ContentType string
+	// Aliases are other media types which request the format
+	Aliases []string
+	Encode  stash.EncodeFunc
+}
+
+// The formats built in, JSONFormat is how stashes are stored
+const (
+	JSONFormat      = "json"
+	LegacyFormat    = "legacy"
+	NDJSONFormat    = "ndjson"
+	YAMLFormat      = "yaml"
+	CSVFormat       = "csv"
+	EventListFormat = "eventlist"
+	TableFormat     = "table"
+)
+
+// ErrUnknownFormat is returned when a requested format isn't registered
+var ErrUnknownFormat = errors.New("unknown format")
+
+var (
+	formatsMutex sync.RWMutex
+	formats      []Format
+)
+
+func init() {
+	RegisterFormat(Format{Name: JSONFormat, ContentType: "application/json", Encode: stash.EncodeJSON})
+	RegisterFormat(Format{Name: LegacyFormat, ContentType: "application/json", Encode: stash.EncodeLegacy})
+	RegisterFormat(Format{Name: NDJSONFormat, ContentType: "application/x-ndjson", Encode: encodeNDJSON})
+	RegisterFormat(Format{Name: YAMLFormat, ContentType: "application/yaml", Aliases: []string{"application/x-yaml", "text/yaml"}, Encode: encodeYAML})
+	RegisterFormat(Format{Name: CSVFormat, ContentType: "text/csv", Encode: encodeCSV})
+	RegisterFormat(Format{Name: EventListFormat, ContentType: "application/json", Encode: encodeEventList})
+	RegisterFormat(Format{Name: TableFormat, ContentType: "text/plain", Encode: encodeTable})
+}
+
+// RegisterFormat adds a format stashes and the buffer can be served in, a
+// format with the same name is replaced
+func RegisterFormat(f Format) {
+	formatsMutex.Lock()
+	defer formatsMutex.Unlock()
+
+	for i := range formats {
+		if formats[i].Name == f.Name {
+			formats[i] = f
+			return
+		}
+	}
+
+	formats = append(formats, f)
+}
+
+// GetFormat returns the registered format with the name
+func GetFormat(name string) (Format, error) {
+	formatsMutex.RLock()
+	defer formatsMutex.RUnlock()
+
+	for _, f := range formats {
+		if f.Name == name {
+			return f, nil
+		}
+	}
+
+	return Format{}, fmt.Errorf("%w: %s", ErrUnknownFormat, name)
+}
+
+// requestFormat returns the format requested, if it is unknown or none are
+// acceptable the error response is written
+func requestFormat(rw http.ResponseWriter, r *http.Request) (Format, bool) {
+	name := r.URL.Query().Get("format")
+
+	format, err := negotiateFormat(name, r.Header.Get("Accept"))
+	if err != nil {
+		if name != "" {
+			rw.WriteHeader(http.StatusBadRequest)
+		} else {
+			rw.WriteHeader(http.StatusNotAcceptable)
+		}
+
+		rw.Write([]byte(err.Error()))
+
+		return format, false
+	}
+
+	return format, true
+}
+
+// negotiateFormat returns the format requested by the format query parameter
+// or otherwise the Accept header, JSON is the default. If no format is
+// acceptable ErrUnknownFormat is returned.
+func negotiateFormat(name, accept string) (Format, error) {
+	if name != "" {
+		return GetFormat(name)
+	}
+
+	if accept == "" {
+		return GetFormat(JSONFormat)
+	}
+
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		if q > 0 {
+			ranges = append(ranges, mediaRange{mediaType, q})
+		}
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+
+	formatsMutex.RLock()
+	defer formatsMutex.RUnlock()
+
+	// The first format registered for a media type is used, so JSON is
+	// preferred to the other JSON formats
+	for _, r := range ranges {
+		for _, f := range formats {
+			if r.mediaType == "*/*" || r.mediaType == f.ContentType || slices.Contains(f.Aliases, r.mediaType) ||
+				(strings.HasSuffix(r.mediaType, "/*") && strings.HasPrefix(f.ContentType, strings.TrimSuffix(r.mediaType, "*"))) {
+				return f, nil
+			}
+		}
+	}
+
+	return Format{}, fmt.Errorf("%w: none of %s", ErrUnknownFormat, accept)
+}
+
+// encodeNDJSON writes an event per line so the events can be streamed
+func encodeNDJSON(w io.Writer, e *stash.Envelope) error {
+	encoder := json.NewEncoder(w)
+	for _, event := range e.Events {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func encodeYAML(w io.Writer, e *stash.Envelope) error {
+	var v interface{} = e
+	if e.IsLegacy() {
+		v = e.Events
+	}
+
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+
+	return err
+}
+
+// encodeEventList writes the events as a v1 EventList, as returned by
+// kubectl get events -o json
+func encodeEventList(w io.Writer, e *stash.Envelope) error {
+	list := corev1.EventList{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "EventList"},
+		Items:    make([]corev1.Event, 0, len(e.Events)),
+	}
+
+	for _, event := range e.Events {
+		list.Items = append(list.Items, *event)
+	}
+
+	return json.NewEncoder(w).Encode(list)
+}
+
+var csvHeader = []string{"LastSeen", "Type", "Reason", "Kind", "Namespace", "Name", "Count", "Source", "Message"}
+
+func encodeCSV(w io.Writer, e *stash.Envelope) error {
+	cw := csv.NewWriter(w)
+
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+
+	for _, event := range e.Events {
+		obj := event.InvolvedObject
+		record := []string{
+			formatTime(stash.EventTime(event)),
+			event.Type,
+			event.Reason,
+			obj.Kind,
+			obj.Namespace,
+			obj.Name,
+			strconv.Itoa(int(eventCount(event))),
+			eventSource(event),
+			event.Message,
+		}
+
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+
+	return cw.Error()
+}
+
+// encodeTable writes the events as a table similar to kubectl get events
+func encodeTable(w io.Writer, e *stash.Envelope) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(tw, "LAST SEEN\tTYPE\tREASON\tOBJECT\tMESSAGE")
+
+	now := time.Now()
+	for _, event := range e.Events {
+		obj := event.InvolvedObject
+		object := strings.ToLower(obj.Kind) + "/" + obj.Name
+		if obj.Namespace != "" {
+			object = obj.Namespace + "/" + object
+		}
+
+		lastSeen := "<unknown>"
+		if t := stash.EventTime(event); !t.IsZero() {
+			lastSeen = duration.HumanDuration(now.Sub(t))
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", lastSeen, event.Type, event.Reason, object, strings.TrimSpace(event.Message))
+	}
+
+	return tw.Flush()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format(time.RFC3339)
+}
+
+func eventCount(e *corev1.Event) int32 {
+	if e.Series != nil {
+		return e.Series.Count
+	}
+
+	return e.Count
+}
+
+func eventSource(e *corev1.Event) string {
+	if e.ReportingController != "" {
+		return e.ReportingController
+	}
+
+	return e.Source.Component
+}
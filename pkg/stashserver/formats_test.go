@@ -0,0 +1,162 @@
+package stashserver
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbase/k8s-event-collector/pkg/stash"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func testEnvelope() *stash.Envelope {
+	events := []*corev1.Event{
+		{
+			ObjectMeta:     metav1.ObjectMeta{Name: "pod.1", Namespace: "default"},
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: "pod", Namespace: "default"},
+			Type:           corev1.EventTypeWarning,
+			Reason:         "BackOff",
+			Message:        "Back-off restarting failed container, \"app\"",
+			Count:          3,
+			LastTimestamp:  metav1.NewTime(time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)),
+		},
+		{
+			ObjectMeta:     metav1.ObjectMeta{Name: "node.1"},
+			InvolvedObject: corev1.ObjectReference{Kind: "Node", Name: "node"},
+			Type:           corev1.EventTypeNormal,
+			Reason:         "NodeReady",
+			Message:        "Node node status is now: NodeReady",
+		},
+	}
+
+	e := stash.NewEnvelope(stash.EnvelopeMetadata{Name: "stash"}, events, stash.Summarize(events))
+
+	return &e
+}
+
+func encode(t *testing.T, name string, e *stash.Envelope) string {
+	format, err := GetFormat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := format.Encode(&b, e); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.String()
+}
+
+func TestJSONFormats(t *testing.T) {
+	e := testEnvelope()
+
+	decoded, err := stash.Decode(strings.NewReader(encode(t, JSONFormat, e)))
+	if err != nil || decoded.IsLegacy() || decoded.Metadata.Name != "stash" || len(decoded.Events) != 2 {
+		t.Errorf("Expected JSON to be the envelope, got: %+v %v", decoded, err)
+	}
+
+	var events []*corev1.Event
+	if err := json.Unmarshal([]byte(encode(t, LegacyFormat, e)), &events); err != nil || len(events) != 2 {
+		t.Errorf("Expected the legacy format to be the events, got: %v %v", events, err)
+	}
+
+	// The buffer only has events so they are a bare array as JSON
+	events = nil
+	if err := json.Unmarshal([]byte(encode(t, JSONFormat, &stash.Envelope{Events: e.Events})), &events); err != nil || len(events) != 2 {
+		t.Errorf("Expected JSON of events without metadata to be an array, got: %v %v", events, err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(encode(t, NDJSONFormat, e)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected an event per line, got: %v", lines)
+	}
+
+	event := &corev1.Event{}
+	if err := json.Unmarshal([]byte(lines[0]), event); err != nil || event.Reason != "BackOff" {
+		t.Errorf("Expected each line to be an event, got: %v %v", event, err)
+	}
+
+	list := &corev1.EventList{}
+	if err := json.Unmarshal([]byte(encode(t, EventListFormat, e)), list); err != nil || list.Kind != "EventList" || list.APIVersion != "v1" || len(list.Items) != 2 {
+		t.Errorf("Expected a v1 EventList, got: %+v %v", list, err)
+	}
+}
+
+func TestYAMLFormat(t *testing.T) {
+	decoded := &stash.Envelope{}
+	if err := yaml.Unmarshal([]byte(encode(t, YAMLFormat, testEnvelope())), decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Kind != stash.Kind || decoded.Metadata.EventCount != 2 || len(decoded.Events) != 2 || decoded.Events[0].Reason != "BackOff" {
+		t.Errorf("Expected YAML to be the envelope, got: %+v", decoded)
+	}
+}
+
+func TestCSVFormat(t *testing.T) {
+	records, err := csv.NewReader(strings.NewReader(encode(t, CSVFormat, testEnvelope()))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"2023-01-01T10:00:00Z", "Warning", "BackOff", "Pod", "default", "pod", "3", "", "Back-off restarting failed container, \"app\""}
+	if len(records) != 3 || strings.Join(records[0], ",") != strings.Join(csvHeader, ",") || strings.Join(records[1], "|") != strings.Join(expected, "|") {
+		t.Errorf("Unexpected CSV: %v", records)
+	}
+}
+
+func TestTableFormat(t *testing.T) {
+	lines := strings.Split(strings.TrimSpace(encode(t, TableFormat, testEnvelope())), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected a header and a line per event, got: %v", lines)
+	}
+
+	if fields := strings.Fields(lines[0]); strings.Join(fields, " ") != "LAST SEEN TYPE REASON OBJECT MESSAGE" {
+		t.Errorf("Unexpected header: %s", lines[0])
+	}
+
+	if !strings.Contains(lines[1], "default/pod/pod") || !strings.Contains(lines[1], "BackOff") || !strings.HasPrefix(lines[2], "<unknown>") {
+		t.Errorf("Unexpected table: %v", lines)
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		format   string
+		accept   string
+		expected string
+	}{
+		{"", "", JSONFormat},
+		{"csv", "application/json", CSVFormat},
+		{"", "text/html,application/xhtml+xml,*/*;q=0.8", JSONFormat},
+		{"", "application/x-ndjson", NDJSONFormat},
+		{"", "text/yaml", YAMLFormat},
+		{"", "application/json;q=0.5, text/csv", CSVFormat},
+		{"", "text/*", CSVFormat},
+		{"", "text/plain", TableFormat},
+	}
+
+	for _, test := range tests {
+		format, err := negotiateFormat(test.format, test.accept)
+		if err != nil || format.Name != test.expected {
+			t.Errorf("Expected format %s for %q %q, got %s %v", test.expected, test.format, test.accept, format.Name, err)
+		}
+	}
+
+	for _, accept := range []string{"image/png", "application/json;q=0"} {
+		if _, err := negotiateFormat("", accept); !errors.Is(err, ErrUnknownFormat) {
+			t.Errorf("Expected no acceptable format for %q, got %v", accept, err)
+		}
+	}
+
+	if _, err := negotiateFormat("xml", ""); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("Expected an unknown format, got %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package stashserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/couchbase/k8s-event-collector/internal/atomicfile"
+)
+
+// metadataFileExtension is the extension of the sidecar file each stashes
+// metadata is persisted in, it isn't the stash file extension so sidecars
+// can't be mistaken for stashes
+const metadataFileExtension = ".meta"
+
+func (dm *StashServer) getMetadataLocation(stashName string) string {
+	return filepath.Join(dm.stashDir, stashName) + metadataFileExtension
+}
+
+// saveStashMetadata persists the stashes metadata in its sidecar file, it is
+// written atomically so a crash can't leave partial metadata
+func (dm *StashServer) saveStashMetadata(d *Stash) {
+	b, err := json.Marshal(d)
+	if err != nil {
+		log.Error(err, "Failed to encode stash metadata", "stash-name", d.Name)
+		return
+	}
+
+	err = atomicfile.WriteFile(dm.getMetadataLocation(d.Name), func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+
+	if err != nil {
+		log.Error(err, "Failed to write stash metadata", "stash-name", d.Name)
+	}
+}
+
+// loadStashMetadata loads the metadata of an existing stash from its sidecar
+// file. Stashes taken before metadata was persisted only have what can be
+// found from the stash file itself.
+func (dm *StashServer) loadStashMetadata(stashName string, entry os.DirEntry) *Stash {
+	d := &Stash{}
+
+	b, err := os.ReadFile(dm.getMetadataLocation(stashName))
+	if err == nil {
+		err = json.Unmarshal(b, d)
+	}
+
+	if err == nil && d.Name != stashName {
+		err = fmt.Errorf("metadata is for stash %s", d.Name)
+	}
+
+	if err == nil {
+		return d
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		log.Error(err, "Couldn't load stash metadata", "stash-name", stashName)
+	}
+
+	d = &Stash{Status: StashComplete, Name: stashName, Encoding: sniffCompression(dm.getStashLocation(stashName))}
+
+	if info, err := entry.Info(); err == nil {
+		d.CreationTime = info.ModTime()
+		d.Size = info.Size()
+	}
+
+	return d
+}
@@ -0,0 +1,363 @@
+package stashserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	"github.com/couchbase/k8s-event-collector/pkg/filters"
+	"github.com/couchbase/k8s-event-collector/pkg/stash"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// eventSortKeys are the fields events can be sorted by, they are compared as
+// strings other than time and count
+var eventSortKeys = map[string]func(e *corev1.Event) string{
+	"type":      func(e *corev1.Event) string { return e.Type },
+	"reason":    func(e *corev1.Event) string { return e.Reason },
+	"kind":      func(e *corev1.Event) string { return e.InvolvedObject.Kind },
+	"namespace": func(e *corev1.Event) string { return e.InvolvedObject.Namespace },
+	"name":      func(e *corev1.Event) string { return e.InvolvedObject.Name },
+}
+
+// EventQuery selects, orders and pages the events of a stash. The involved
+// object is matched by a filter set, as collected events are.
+type EventQuery struct {
+	Filter *filters.FilterSet
+	// Types optionally restricts events to those with one of the types
+	Types []string
+	// Reasons optionally restricts events to those with one of the reasons
+	Reasons []string
+	// Message optionally restricts events to those with messages containing
+	// it, ignoring case
+	Message string
+	Since   time.Time
+	Until   time.Time
+	// Sort is the field events are sorted by, time by default
+	Sort       string
+	Descending bool
+	// Fields optionally projects events to only these fields, nested fields
+	// are separated by dots such as involvedObject.name
+	Fields []string
+	// Limit is the maximum number of events returned, zero is unlimited, and
+	// Offset is how many matching events to skip
+	Limit  int
+	Offset int
+}
+
+// EventsPage is a page of the events of a stash which match a query
+type EventsPage struct {
+	// Total is the number of events which match the query
+	Total int
+	// Continue is the continue parameter to get the next page, it is empty
+	// on the last page
+	Continue string
+	Events   []interface{}
+}
+
+// parseEventQuery parses an event query from the query parameters
+func parseEventQuery(values url.Values) (*EventQuery, error) {
+	q := &EventQuery{
+		Types:   splitValues(values["type"]),
+		Reasons: splitValues(values["reason"]),
+		Message: values.Get("message"),
+		Sort:    values.Get("sort"),
+		Fields:  splitValues(values["fields"]),
+	}
+
+	resources := resourceFilters(
+		splitValues(values["apiVersion"]),
+		splitValues(values["kind"]),
+		splitValues(values["name"]),
+		splitValues(values["namespace"]),
+	)
+
+	q.Filter = filters.NewFilterSet("eventQuery", "", resources, nil)
+
+	for param, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if v := values.Get(param); v != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				return nil, fmt.Errorf("invalid %s %q, it must be an RFC3339 time", param, v)
+			}
+		}
+	}
+
+	if !q.Since.IsZero() && !q.Until.IsZero() && !q.Until.After(q.Since) {
+		return nil, fmt.Errorf("until must be after since")
+	}
+
+	q.Sort, q.Descending = strings.CutPrefix(q.Sort, "-")
+	if _, ok := eventSortKeys[q.Sort]; !ok && q.Sort != "" && q.Sort != "time" && q.Sort != "count" {
+		return nil, fmt.Errorf("events can't be sorted by %q", q.Sort)
+	}
+
+	for _, field := range q.Fields {
+		if slices.Contains(strings.Split(field, "."), "") {
+			return nil, fmt.Errorf("invalid field %q", field)
+		}
+	}
+
+	for param, n := range map[string]*int{"limit": &q.Limit, "continue": &q.Offset} {
+		if v := values.Get(param); v != "" {
+			var err error
+			if *n, err = strconv.Atoi(v); err != nil || *n < 0 {
+				return nil, fmt.Errorf("invalid %s %q", param, v)
+			}
+		}
+	}
+
+	return q, nil
+}
+
+// resourceFilters returns a filter for each combination of the involved
+// object parameters, so an event matches if its involved object has any of
+// the values of each parameter. No filters are returned if none are set.
+func resourceFilters(apiVersions, kinds, names, namespaces []string) []config.KubernetesResourceFilter {
+	if len(apiVersions) == 0 && len(kinds) == 0 && len(names) == 0 && len(namespaces) == 0 {
+		return nil
+	}
+
+	// An unset parameter matches any value
+	orAny := func(values []string) []string {
+		if len(values) == 0 {
+			return []string{""}
+		}
+
+		return values
+	}
+
+	var resources []config.KubernetesResourceFilter
+	for _, apiVersion := range orAny(apiVersions) {
+		for _, kind := range orAny(kinds) {
+			for _, name := range orAny(names) {
+				for _, namespace := range orAny(namespaces) {
+					resources = append(resources, config.KubernetesResourceFilter{
+						APIVersion: apiVersion,
+						Resource:   kind,
+						Name:       name,
+						Namespace:  namespace,
+					})
+				}
+			}
+		}
+	}
+
+	return resources
+}
+
+// splitValues splits comma separated parameter values
+func splitValues(values []string) []string {
+	var split []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				split = append(split, s)
+			}
+		}
+	}
+
+	return split
+}
+
+// Matches returns whether the event matches the query
+func (q *EventQuery) Matches(e *corev1.Event) bool {
+	if q.Filter != nil && !q.Filter.Accepts(e) {
+		return false
+	}
+
+	if len(q.Types) != 0 && !slices.Contains(q.Types, e.Type) {
+		return false
+	}
+
+	if len(q.Reasons) != 0 && !slices.Contains(q.Reasons, e.Reason) {
+		return false
+	}
+
+	if q.Message != "" && !strings.Contains(strings.ToLower(e.Message), strings.ToLower(q.Message)) {
+		return false
+	}
+
+	t := stash.EventTime(e)
+
+	return (q.Since.IsZero() || !t.Before(q.Since)) && (q.Until.IsZero() || !t.After(q.Until))
+}
+
+// Run returns the page of the events which match the query
+func (q *EventQuery) Run(events []*corev1.Event) (EventsPage, error) {
+	var matched []*corev1.Event
+	for _, e := range events {
+		if q.Matches(e) {
+			matched = append(matched, e)
+		}
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		if q.Descending {
+			return q.less(matched[j], matched[i])
+		}
+
+		return q.less(matched[i], matched[j])
+	})
+
+	page := EventsPage{
+		Total:  len(matched),
+		Events: []interface{}{},
+	}
+
+	if q.Offset >= len(matched) {
+		return page, nil
+	}
+
+	matched = matched[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(matched) {
+		matched = matched[:q.Limit]
+		page.Continue = strconv.Itoa(q.Offset + q.Limit)
+	}
+
+	for _, e := range matched {
+		if len(q.Fields) == 0 {
+			page.Events = append(page.Events, e)
+			continue
+		}
+
+		projected, err := project(e, q.Fields)
+		if err != nil {
+			return page, err
+		}
+
+		page.Events = append(page.Events, projected)
+	}
+
+	return page, nil
+}
+
+// less orders events by the sort field, then by time
+func (q *EventQuery) less(a, b *corev1.Event) bool {
+	switch q.Sort {
+	case "", "time":
+	case "count":
+		if ac, bc := eventCount(a), eventCount(b); ac != bc {
+			return ac < bc
+		}
+	default:
+		if av, bv := eventSortKeys[q.Sort](a), eventSortKeys[q.Sort](b); av != bv {
+			return av < bv
+		}
+	}
+
+	return stash.EventTime(a).Before(stash.EventTime(b))
+}
+
+// project returns only the fields of the event, fields which aren't set are
+// omitted
+func project(e *corev1.Event, fields []string) (map[string]interface{}, error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	var full map[string]interface{}
+	if err := json.Unmarshal(b, &full); err != nil {
+		return nil, err
+	}
+
+	projected := map[string]interface{}{}
+
+	for _, field := range fields {
+		path := strings.Split(field, ".")
+
+		var v interface{} = full
+		for _, key := range path {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				v = nil
+				break
+			}
+
+			v = m[key]
+		}
+
+		if v == nil {
+			continue
+		}
+
+		// Nested fields keep their structure
+		dst := projected
+		for _, key := range path[:len(path)-1] {
+			next, ok := dst[key].(map[string]interface{})
+			if !ok {
+				next = map[string]interface{}{}
+				dst[key] = next
+			}
+
+			dst = next
+		}
+
+		dst[path[len(path)-1]] = v
+	}
+
+	return projected, nil
+}
+
+// handleGetStashEvents serves the events of a stash which match the query
+// parameters
+func (dm *StashServer) handleGetStashEvents(rw http.ResponseWriter, r *http.Request, stashName string) {
+	q, err := parseEventQuery(r.URL.Query())
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	dm.stashesMutex.RLock()
+	d, exists := dm.stashes[stashName]
+	if exists {
+		d = d.progress()
+	}
+	dm.stashesMutex.RUnlock()
+
+	if !exists || d.Status == StashFailed {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	} else if d.Status == StashStarted {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	f, err := dm.openStash(d)
+	if err != nil {
+		// The stash may have been deleted since it was looked up
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	e, err := stash.Decode(f)
+	if err != nil {
+		log.Error(err, "Failed to decode stash", "stash-name", stashName)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	page, err := q.Run(e.Events)
+	if err != nil {
+		log.Error(err, "Failed to query stash", "stash-name", stashName)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+
+	w := compressResponse(rw, r)
+	defer w.Close()
+
+	json.NewEncoder(w).Encode(page)
+}
@@ -0,0 +1,166 @@
+package stashserver
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func queryEvents() []*corev1.Event {
+	start := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	event := func(i int, eventType, reason, kind, namespace, name, message string, count int32) *corev1.Event {
+		return &corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: name + "." + reason, Namespace: namespace},
+			InvolvedObject: corev1.ObjectReference{Kind: kind, Name: name, Namespace: namespace},
+			Type:           eventType,
+			Reason:         reason,
+			Message:        message,
+			Count:          count,
+			LastTimestamp:  metav1.NewTime(start.Add(time.Duration(i) * time.Minute)),
+		}
+	}
+
+	return []*corev1.Event{
+		event(0, corev1.EventTypeNormal, "Scheduled", "Pod", "default", "app-0", "Successfully assigned default/app-0", 1),
+		event(1, corev1.EventTypeWarning, "BackOff", "Pod", "default", "app-0", "Back-off restarting failed container", 5),
+		event(2, corev1.EventTypeWarning, "FailedMount", "Pod", "other", "app-1", "Unable to attach or mount volumes", 2),
+		event(3, corev1.EventTypeNormal, "NodeReady", "Node", "", "node-0", "Node node-0 status is now: NodeReady", 1),
+		event(4, corev1.EventTypeWarning, "BackOff", "Pod", "other", "app-1", "Back-off pulling image", 3),
+	}
+}
+
+func runQuery(t *testing.T, query string) EventsPage {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := parseEventQuery(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := q.Run(queryEvents())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return page
+}
+
+func pageReasons(page EventsPage) []string {
+	reasons := []string{}
+	for _, e := range page.Events {
+		reasons = append(reasons, e.(*corev1.Event).Reason+"/"+e.(*corev1.Event).InvolvedObject.Name)
+	}
+
+	return reasons
+}
+
+func TestEventQueryFilters(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"", []string{"Scheduled/app-0", "BackOff/app-0", "FailedMount/app-1", "NodeReady/node-0", "BackOff/app-1"}},
+		{"type=Warning", []string{"BackOff/app-0", "FailedMount/app-1", "BackOff/app-1"}},
+		{"type=Warning,Normal", []string{"Scheduled/app-0", "BackOff/app-0", "FailedMount/app-1", "NodeReady/node-0", "BackOff/app-1"}},
+		{"type=Normal&type=Warning", []string{"Scheduled/app-0", "BackOff/app-0", "FailedMount/app-1", "NodeReady/node-0", "BackOff/app-1"}},
+		{"reason=BackOff,NodeReady", []string{"BackOff/app-0", "NodeReady/node-0", "BackOff/app-1"}},
+		{"reason=Scheduled&reason=NodeReady", []string{"Scheduled/app-0", "NodeReady/node-0"}},
+		{"kind=Pod&namespace=other", []string{"FailedMount/app-1", "BackOff/app-1"}},
+		{"kind=Pod&name=app-0&type=Warning", []string{"BackOff/app-0"}},
+		{"message=BACK-OFF", []string{"BackOff/app-0", "BackOff/app-1"}},
+		{"since=2023-01-01T10:01:00Z&until=2023-01-01T10:03:00Z", []string{"BackOff/app-0", "FailedMount/app-1", "NodeReady/node-0"}},
+		{"kind=Deployment", []string{}},
+		{"kind=Pod,Node&name=app-0,node-0", []string{"Scheduled/app-0", "BackOff/app-0", "NodeReady/node-0"}},
+		{"name=app-0&name=app-1&reason=BackOff", []string{"BackOff/app-0", "BackOff/app-1"}},
+		{"namespace=default,other&kind=Deployment,Pod&type=Normal", []string{"Scheduled/app-0"}},
+	}
+
+	for _, test := range tests {
+		page := runQuery(t, test.query)
+		if reasons := pageReasons(page); !reflect.DeepEqual(reasons, test.expected) || page.Total != len(test.expected) {
+			t.Errorf("Query %q returned %v (total %d), expected %v", test.query, reasons, page.Total, test.expected)
+		}
+	}
+}
+
+func TestEventQuerySort(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"sort=-time", []string{"BackOff/app-1", "NodeReady/node-0", "FailedMount/app-1", "BackOff/app-0", "Scheduled/app-0"}},
+		{"sort=reason", []string{"BackOff/app-0", "BackOff/app-1", "FailedMount/app-1", "NodeReady/node-0", "Scheduled/app-0"}},
+		{"sort=-count&type=Warning", []string{"BackOff/app-0", "BackOff/app-1", "FailedMount/app-1"}},
+		{"sort=name&kind=Pod", []string{"Scheduled/app-0", "BackOff/app-0", "FailedMount/app-1", "BackOff/app-1"}},
+	}
+
+	for _, test := range tests {
+		if reasons := pageReasons(runQuery(t, test.query)); !reflect.DeepEqual(reasons, test.expected) {
+			t.Errorf("Query %q returned %v, expected %v", test.query, reasons, test.expected)
+		}
+	}
+}
+
+func TestEventQueryPages(t *testing.T) {
+	var reasons []string
+	pages := 0
+
+	for query := "limit=2"; ; pages++ {
+		page := runQuery(t, query)
+		if page.Total != 5 {
+			t.Errorf("Expected the total to be every matching event, got %d", page.Total)
+		}
+
+		reasons = append(reasons, pageReasons(page)...)
+		if page.Continue == "" {
+			break
+		}
+
+		query = "limit=2&continue=" + page.Continue
+	}
+
+	if pages != 2 || len(reasons) != 5 || reasons[4] != "BackOff/app-1" {
+		t.Errorf("Expected 3 pages of all events, got %d: %v", pages+1, reasons)
+	}
+
+	if page := runQuery(t, "continue=10"); len(page.Events) != 0 || page.Continue != "" {
+		t.Errorf("Expected no events past the end, got %+v", page)
+	}
+}
+
+func TestEventQueryFields(t *testing.T) {
+	page := runQuery(t, "fields=reason,involvedObject.name,involvedObject.kind,series.count&limit=1")
+
+	expected := map[string]interface{}{
+		"reason":         "Scheduled",
+		"involvedObject": map[string]interface{}{"name": "app-0", "kind": "Pod"},
+	}
+
+	if len(page.Events) != 1 || !reflect.DeepEqual(page.Events[0], expected) {
+		t.Errorf("Expected only the fields to be returned, got %v", page.Events)
+	}
+}
+
+func TestEventQueryInvalid(t *testing.T) {
+	for _, query := range []string{
+		"since=yesterday",
+		"since=2023-01-01T10:00:00Z&until=2023-01-01T09:00:00Z",
+		"sort=colour",
+		"fields=involvedObject..name",
+		"limit=-1",
+		"continue=abc",
+	} {
+		values, _ := url.ParseQuery(query)
+		if _, err := parseEventQuery(values); err == nil {
+			t.Errorf("Expected query %q to be invalid", query)
+		}
+	}
+}
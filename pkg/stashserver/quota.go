@@ -0,0 +1,138 @@
+package stashserver
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	// ErrQuotaExceeded is returned when there isn't room for a stash within
+	// the stash quota
+	ErrQuotaExceeded = errors.New("stash quota exceeded")
+	// ErrInsufficientSpace is returned when there isn't enough free space in
+	// the stash directory for a stash
+	ErrInsufficientSpace = errors.New("insufficient free space for stash")
+)
+
+// SetStashQuota sets the total size in bytes stashes may use, zero is
+// unlimited
+func (dm *StashServer) SetStashQuota(quota int64) {
+	dm.stashesMutex.Lock()
+	defer dm.stashesMutex.Unlock()
+
+	dm.quota = quota
+}
+
+// makeRoom evicts the oldest unpinned stashes until there is room for the
+// new stash within the quota and in the stash directory. The size of the new
+// stash is estimated from the last stash taken. If evicting every stash
+// which can be evicted wouldn't make enough room none are evicted, and the
+// new stash fails. It must be called with the lock held.
+func (dm *StashServer) makeRoom(d *Stash) error {
+	estimate := dm.lastStashSize
+
+	if dm.quota > 0 {
+		kept := dm.stashesSize() - dm.evictableSize(d)
+
+		for dm.stashesSize()+estimate > dm.quota {
+			if kept+estimate > dm.quota || !dm.evictOldest(d) {
+				return fmt.Errorf("%w: %d bytes are used of the %d byte quota by stashes which can't be evicted", ErrQuotaExceeded, kept, dm.quota)
+			}
+		}
+	}
+
+	for {
+		available, err := availableBytes(dm.stashDir)
+		if err != nil {
+			// The check is best effort, writing the stash fails if it's full
+			log.V(1).Info("Couldn't check free space", "error", err.Error())
+			return nil
+		}
+
+		if available >= uint64(estimate) {
+			return nil
+		}
+
+		// Other files in the stash directory can use the space, so evicting
+		// stashes may not be enough
+		if evictable := dm.evictableSize(d); available+uint64(evictable) < uint64(estimate) || !dm.evictOldest(d) {
+			return fmt.Errorf("%w: %d bytes are available in %s and about %d are needed, evicting stashes would free %d", ErrInsufficientSpace, available, dm.stashDir, estimate, evictable)
+		}
+	}
+}
+
+// enforceQuota evicts the oldest unpinned stashes other than the new stash
+// until the stashes are within the quota. A stash larger than the quota is
+// kept. It must be called with the lock held.
+func (dm *StashServer) enforceQuota(d *Stash) {
+	for dm.quota > 0 && dm.stashesSize() > dm.quota {
+		if !dm.evictOldest(d) {
+			log.Info("Stashes exceed the quota but none can be evicted", "quota", dm.quota, "size", dm.stashesSize())
+			return
+		}
+	}
+}
+
+// stashesSize returns the total size of the stashes, it must be called with
+// the lock held
+func (dm *StashServer) stashesSize() int64 {
+	var size int64
+	for _, stash := range dm.stashes {
+		size += stash.Size
+	}
+
+	return size
+}
+
+// evictionCandidates returns the stashes which can be evicted to make room
+// for the new stash, those which aren't pinned, being written or the new
+// stash. It must be called with the lock held.
+func (dm *StashServer) evictionCandidates(d *Stash) []*Stash {
+	var candidates []*Stash
+	for _, stash := range dm.stashes {
+		if stash != d && !stash.Pinned && stash.Status != StashStarted {
+			candidates = append(candidates, stash)
+		}
+	}
+
+	return candidates
+}
+
+// evictableSize returns the total size of the stashes which can be evicted,
+// it must be called with the lock held
+func (dm *StashServer) evictableSize(d *Stash) int64 {
+	var size int64
+	for _, stash := range dm.evictionCandidates(d) {
+		size += stash.Size
+	}
+
+	return size
+}
+
+// evictOldest removes the oldest stash which can be evicted, it returns false
+// if there is none. It must be called with the lock held.
+func (dm *StashServer) evictOldest(d *Stash) bool {
+	candidates := dm.evictionCandidates(d)
+	if len(candidates) == 0 {
+		return false
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return olderThan(candidates[i], candidates[j])
+	})
+
+	log.Info("Evicting stash to stay within quota", "stashName", candidates[0].Name, "size", candidates[0].Size)
+	dm.removeStash(candidates[0].Name)
+
+	return true
+}
+
+// olderThan orders stashes by when they were taken, then by name
+func olderThan(a, b *Stash) bool {
+	if !a.CreationTime.Equal(b.CreationTime) {
+		return a.CreationTime.Before(b.CreationTime)
+	}
+
+	return a.Name < b.Name
+}
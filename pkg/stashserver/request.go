@@ -0,0 +1,108 @@
+package stashserver
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	"github.com/couchbase/k8s-event-collector/pkg/filters"
+	"github.com/couchbase/k8s-event-collector/pkg/stash"
+)
+
+// StashRequest is the optional body of a request to take a stash
+type StashRequest struct {
+	// Name is optional, a unique name is generated if not set
+	Name        string
+	Labels      map[string]string
+	Description string
+	Filter      StashRequestFilter
+}
+
+// StashRequestFilter restricts which buffered events are written to a
+// requested stash. Events must be of one of the Types, if set, and involve
+// one of the Kinds or Objects, if either are set.
+type StashRequestFilter struct {
+	Types   []string
+	Kinds   []string
+	Objects []StashRequestObject
+	// Window includes events from this long ago, it is a Go duration such
+	// as "30m" and is an alternative to Since
+	Window string
+	Since  time.Time
+	Until  time.Time
+}
+
+// StashRequestObject identifies an involved object, the namespace is optional
+type StashRequestObject struct {
+	Kind      string
+	Name      string
+	Namespace string
+}
+
+// options returns the options to take the requested stash with
+func (r *StashRequest) options() (StashOptions, error) {
+	opts := StashOptions{
+		Name:        r.Name,
+		Source:      StashSourceManual,
+		Labels:      r.Labels,
+		Description: r.Description,
+	}
+
+	scope, err := r.Filter.scope()
+	if err != nil {
+		return opts, err
+	}
+
+	opts.Scope = scope
+
+	return opts, nil
+}
+
+func (f *StashRequestFilter) scope() (stash.Scope, error) {
+	scope := stash.Scope{
+		Since: f.Since,
+		Until: f.Until,
+		Types: f.Types,
+	}
+
+	if f.Window != "" {
+		if !f.Since.IsZero() {
+			return scope, fmt.Errorf("only one of window and since can be set")
+		}
+
+		window, err := time.ParseDuration(f.Window)
+		if err != nil || window <= 0 {
+			return scope, fmt.Errorf("invalid window %q, it must be a positive duration", f.Window)
+		}
+
+		scope.Since = time.Now().Add(-window)
+	}
+
+	if !scope.Until.IsZero() && !scope.Until.After(scope.Since) {
+		return scope, fmt.Errorf("until must be after since")
+	}
+
+	var resourceFilters []config.KubernetesResourceFilter
+
+	for _, kind := range f.Kinds {
+		resourceFilters = append(resourceFilters, config.KubernetesResourceFilter{Resource: kind})
+	}
+
+	for _, o := range f.Objects {
+		if o.Kind == "" || o.Name == "" {
+			return scope, fmt.Errorf("objects must have a kind and name")
+		}
+
+		resourceFilters = append(resourceFilters, config.KubernetesResourceFilter{
+			Resource:  o.Kind,
+			Name:      o.Name,
+			Namespace: o.Namespace,
+		})
+	}
+
+	if len(resourceFilters) != 0 {
+		scope.Filter = filters.NewFilterSet("stashRequest", "", resourceFilters, nil)
+	}
+
+	return scope, nil
+}
@@ -0,0 +1,171 @@
+package stashserver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrStashNotFound is returned when a stash doesn't exist
+	ErrStashNotFound = errors.New("stash not found")
+	// ErrStashPinned is returned when deleting a pinned stash
+	ErrStashPinned = errors.New("pinned stashes must be unpinned before they can be deleted")
+	// ErrStashInProgress is returned when deleting a stash being written
+	ErrStashInProgress = errors.New("stash is still being written")
+)
+
+// retentionInterval is how often stashes are checked against their maximum
+// age when no stashes are being taken
+const retentionInterval = time.Hour
+
+// RetentionPolicy limits how many of a triggers stashes are kept and for how
+// long, zero values fall back to the servers limits
+type RetentionPolicy struct {
+	// MaxStashes retains the triggers stashes separately from other stashes
+	MaxStashes int
+	MaxAge     time.Duration
+}
+
+// SetMaxStashAge sets how long stashes are kept, zero keeps them until they
+// are purged by the maximum number of stashes
+func (dm *StashServer) SetMaxStashAge(maxAge time.Duration) {
+	dm.maxAge = maxAge
+}
+
+// SetTriggerRetention sets the retention policy for the stashes taken by a
+// trigger
+func (dm *StashServer) SetTriggerRetention(trigger string, policy RetentionPolicy) {
+	dm.stashesMutex.Lock()
+	defer dm.stashesMutex.Unlock()
+
+	dm.triggerRetention[trigger] = policy
+}
+
+// runRetention purges stashes which have outlived their retention policy
+// now and then periodically, stashes are also purged as each is taken
+func (dm *StashServer) runRetention() {
+	for {
+		dm.stashesMutex.Lock()
+		dm.purgeStashes()
+		dm.stashesMutex.Unlock()
+
+		time.Sleep(retentionInterval)
+	}
+}
+
+// purgeStashes removes stashes older than their maximum age, then the oldest
+// stashes in each retention group until there are at most the maximum number
+// of stashes. Stashes taken by triggers with their own maximum number of
+// stashes and scheduled stashes are retained separately for each trigger, all
+// other stashes are retained together. Pinned and open stashes and stashes
+// still being written are never removed. It must be called with the lock
+// held.
+func (dm *StashServer) purgeStashes() {
+	now := time.Now()
+	groups := map[string][]*Stash{}
+
+	for name, stash := range dm.stashes {
+		if stash.Pinned || stash.Open || stash.Status == StashStarted {
+			continue
+		}
+
+		policy := dm.triggerRetention[stash.Trigger]
+
+		maxAge := policy.MaxAge
+		if maxAge <= 0 {
+			maxAge = dm.maxAge
+		}
+
+		if maxAge > 0 && now.Sub(stash.CreationTime) > maxAge {
+			log.Info("Removing expired stash", "stashName", name, "maxAge", maxAge)
+			dm.removeStash(name)
+			continue
+		}
+
+		group := ""
+		if policy.MaxStashes > 0 || stash.Scheduled {
+			group = stash.Trigger
+		}
+
+		groups[group] = append(groups[group], stash)
+	}
+
+	for group, stashes := range groups {
+		maxStashes := dm.maxStashes
+		if group != "" && dm.triggerRetention[group].MaxStashes > 0 {
+			maxStashes = dm.triggerRetention[group].MaxStashes
+		}
+
+		if maxStashes <= 0 || len(stashes) <= maxStashes {
+			continue
+		}
+
+		sort.Slice(stashes, func(i, j int) bool {
+			return olderThan(stashes[i], stashes[j])
+		})
+
+		for _, stash := range stashes[:len(stashes)-maxStashes] {
+			log.Info("Removing old stash", "stashName", stash.Name)
+			dm.removeStash(stash.Name)
+		}
+	}
+}
+
+// removeStash removes a stash and its metadata, it must be called with the
+// lock held
+func (dm *StashServer) removeStash(stashName string) {
+	os.Remove(dm.getStashLocation(stashName))
+	os.Remove(dm.getMetadataLocation(stashName))
+	delete(dm.stashes, stashName)
+}
+
+// DeleteStash deletes a stash which isn't pinned or still being written
+func (dm *StashServer) DeleteStash(stashName string) error {
+	dm.stashesMutex.Lock()
+	defer dm.stashesMutex.Unlock()
+
+	stash, exists := dm.stashes[stashName]
+
+	switch {
+	case !exists:
+		return fmt.Errorf("%w: %s", ErrStashNotFound, stashName)
+	case stash.Pinned:
+		return fmt.Errorf("%w: %s", ErrStashPinned, stashName)
+	case stash.Status == StashStarted:
+		return fmt.Errorf("%w: %s", ErrStashInProgress, stashName)
+	}
+
+	log.Info("Deleting stash", "stashName", stashName)
+	dm.removeStash(stashName)
+
+	return nil
+}
+
+// PinStash pins or unpins a stash, pinned stashes are exempt from purging
+func (dm *StashServer) PinStash(stashName string, pinned bool) (Stash, error) {
+	dm.stashesMutex.Lock()
+	defer dm.stashesMutex.Unlock()
+
+	stash, exists := dm.stashes[stashName]
+	if !exists {
+		return Stash{}, fmt.Errorf("%w: %s", ErrStashNotFound, stashName)
+	}
+
+	stash.Pinned = pinned
+
+	// Stashes being written have their metadata saved once written
+	if stash.Status != StashStarted {
+		dm.saveStashMetadata(stash)
+	}
+
+	log.Info("Stash pinned", "stashName", stashName, "pinned", pinned)
+
+	if !pinned {
+		dm.purgeStashes()
+	}
+
+	return *stash, nil
+}
@@ -1,29 +1,82 @@
 package stashserver
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
-	"slices"
+	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/couchbase/k8s-event-collector/internal/atomicfile"
+	"github.com/couchbase/k8s-event-collector/pkg/filters"
+	"github.com/couchbase/k8s-event-collector/pkg/stash"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 )
 
 // The Stasher interface provides stashes for StashServer to manage
 type Stasher interface {
-	Stash(io.Writer) error
+	// Stash writes the events within scope and returns a summary of them
+	Stash(io.Writer, stash.Scope) (stash.Summary, error)
+}
+
+// The Freezer interface can optionally be implemented by a Stasher to stop
+// buffered events being evicted while a stash is pending
+type Freezer interface {
+	Freeze()
+	Unfreeze()
+}
+
+// The EventGetter interface can optionally be implemented by a Stasher to
+// allow buffered events to be looked up by UID
+type EventGetter interface {
+	GetEvent(types.UID) *corev1.Event
+}
+
+// The Silencer interface can optionally be used to suppress triggered
+// stashes, such as during maintenance
+type Silencer interface {
+	// Silenced returns the ID of a silence matching the trigger and the
+	// event which triggered it, the event may be nil
+	Silenced(trigger string, in *corev1.Event) (string, bool)
+}
+
+// The Grouper interface can optionally be used to group triggered stashes,
+// such as into incidents, it returns the options to take the stash with
+type Grouper interface {
+	Group(opts StashOptions) StashOptions
 }
 
 var log = logf.Log.WithName("stash-server")
 
+var (
+	// ErrStashExists is returned when creating a stash with the name of an
+	// existing stash
+	ErrStashExists = errors.New("stash already exists")
+	// ErrInvalidStashName is returned when creating a stash with an invalid name
+	ErrInvalidStashName = errors.New("invalid stash name")
+
+	// errRewriteQueued is returned when replacing a stash which is still
+	// being written, it is rewritten once the write completes
+	errRewriteQueued = errors.New("stash rewrite queued")
+)
+
 var tsFormat = "20060102T150405"
 
+var stashNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
 // StashStatus represents the status of a buffer Stash
 type StashStatus string
 
@@ -36,13 +89,146 @@ const (
 	StashFailed StashStatus = "Failed"
 )
 
+// StashSource is what requested a stash
+type StashSource string
+
+const (
+	// StashSourceManual is a stash requested through the API
+	StashSourceManual StashSource = "Manual"
+	// StashSourceTrigger is a stash taken by a trigger rule or watcher
+	StashSourceTrigger StashSource = "Trigger"
+	// StashSourceAlert is a stash taken for an Alertmanager alert
+	StashSourceAlert StashSource = "Alert"
+	// StashSourceEventStash is a stash requested by an EventStash resource
+	StashSourceEventStash StashSource = "EventStash"
+	// StashSourceSchedule is a stash taken on a schedule
+	StashSourceSchedule StashSource = "Schedule"
+)
+
 // StashCompletionFunc takes a certain action based on the event that triggered it
 type StashCompletionFunc func(d *Stash)
 
-// Stash is a dump of the event buffer
+// Stash is a dump of the event buffer, its metadata is persisted alongside
+// it so it is the same after restarts
 type Stash struct {
-	Status StashStatus
-	Name   string
+	Status       StashStatus
+	Name         string
+	CreationTime time.Time
+	Source       StashSource
+	// Trigger is the name of the trigger rule which took the stash, it is
+	// empty for stashes requested through the API
+	Trigger      string
+	TriggerEvent *corev1.Event
+	Labels       map[string]string
+	Annotations  map[string]string
+	Description  string
+	EventCount   int
+	// FirstEventTime and LastEventTime are the time range the stash covers
+	FirstEventTime time.Time
+	LastEventTime  time.Time
+	// Size is the size of the stash file in bytes and Checksum its SHA-256,
+	// which is used to check the stash is intact when it is loaded
+	Size     int64
+	Checksum string
+	// Encoding is the compression the stash file is stored with, it is empty
+	// if it isn't compressed
+	Encoding string
+	// Legacy stashes were taken before the envelope format, their files are
+	// kept as they are and converted to an envelope when served
+	Legacy bool
+	// CollectorVersion, ConfigHash and Namespace are of the collector which
+	// took the stash
+	CollectorVersion string
+	ConfigHash       string
+	Namespace        string
+	// Scheduled stashes are taken periodically as a baseline rather than
+	// because of an incident
+	Scheduled bool
+	// Pinned stashes are never purged
+	Pinned bool
+	// Open stashes are still being rewritten so aren't purged by retention
+	Open bool
+	// CompletionTime is when the stash was written or failed, Error is why
+	// it failed
+	CompletionTime time.Time
+	Error          string
+
+	// written counts the bytes written so far
+	written *atomic.Int64
+}
+
+// progress returns a copy of the stash, if it is still being written its
+// size is how much has been written so far
+func (d *Stash) progress() *Stash {
+	stash := *d
+	if stash.Status == StashStarted && stash.written != nil {
+		stash.Size = stash.written.Load()
+	}
+
+	return &stash
+}
+
+// countingWriter counts the bytes written to a stash as they are written
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+
+	return n, err
+}
+
+// StashOptions are options for taking a stash
+type StashOptions struct {
+	// Name is optional, if it doesn't start with the stash prefix it will be
+	// added, if not set a name is generated from the current time
+	Name    string
+	Trigger string
+	// Source defaults to Schedule for scheduled stashes, Trigger if there
+	// is a trigger and Manual otherwise
+	Source StashSource
+	Labels map[string]string
+	// Annotations are descriptive metadata, such as those of the alert
+	// which triggered the stash
+	Annotations map[string]string
+	Description string
+	// TriggerEvent is the event which triggered the stash, if any
+	TriggerEvent *corev1.Event
+	Scope        stash.Scope
+
+	// Delay waits before writing the stash so events following the trigger
+	// are included
+	Delay time.Duration
+	// FreezeBuffer stops buffered events being evicted until the stash is
+	// written
+	FreezeBuffer bool
+	// Replace rewrites the stash if one with the same name already exists,
+	// rather than failing
+	Replace bool
+	// SkipCompletion doesn't run the servers completion callbacks, for
+	// rewrites of a stash they have already been run for
+	SkipCompletion bool
+	// Open stashes are still being rewritten, such as the stash of an open
+	// incident, so aren't purged by retention until rewritten without it
+	Open bool
+
+	// Scheduled stashes are retained separately from other stashes for
+	// each Trigger
+	Scheduled bool
+
+	// CompletionCallbacks are called when this stash is complete in addition
+	// to the servers completion callbacks
+	CompletionCallbacks []StashCompletionFunc
+}
+
+// FilterTestResult is the result of a dry run of an event against the
+// configured filters and triggers
+type FilterTestResult struct {
+	Event   *corev1.Event
+	Results []filters.FilterSetResult
 }
 
 // StashServer serves an API to trigger and fetch stashes
@@ -52,35 +238,75 @@ type StashServer struct {
 	stashes      map[string]*Stash
 	stashesMutex sync.RWMutex
 
+	// rewrites are the latest options to replace stashes with which were
+	// still being written, they are rewritten once the write completes
+	rewrites map[string]StashOptions
+
+	// These are the filters and triggers which can be dry run against events
+	filterSets []*filters.FilterSet
+
 	// These are callbacks used to trigger notifications when stashes are complete
 	stashCompleteCallbacks []StashCompletionFunc
 
+	silencer Silencer
+	grouper  Grouper
+
 	stashDir    string
 	stashPrefix string
 
-	maxStashes int
+	collectorVersion string
+	configHash       string
+	namespace        string
+
+	maxStashes       int
+	maxAge           time.Duration
+	triggerRetention map[string]RetentionPolicy
+
+	// quota is the total size of stashes in bytes, the last stashes size is
+	// used to estimate how much room the next will need
+	quota         int64
+	lastStashSize int64
+
+	// compression is how new stashes are stored
+	compression string
 }
 
-const stashDir = "/tmp/"
+// DefaultStashDir is the default directory stashes are stored in
+const DefaultStashDir = "/tmp/"
+
 const stashFileExtension = ".json"
 const stashPrefix = "event-log-"
 
-// NewStashServer creates a new StashServer
-func NewStashServer(stasher Stasher, maxStashes int) *StashServer {
+// NewStashServer creates a new StashServer storing stashes in the directory,
+// which is created if it doesn't exist, and loads existing stashes from it
+func NewStashServer(stasher Stasher, stashDir string, maxStashes int) *StashServer {
+	if stashDir == "" {
+		stashDir = DefaultStashDir
+	}
+
+	if err := os.MkdirAll(stashDir, 0755); err != nil {
+		log.Error(err, "Couldn't create stash directory", "dir", stashDir)
+	}
+
 	dm := StashServer{
 		mux:         http.NewServeMux(),
 		stasher:     stasher,
 		stashes:     make(map[string]*Stash),
+		rewrites:    make(map[string]StashOptions),
 		stashDir:    stashDir,
 		stashPrefix: stashPrefix,
 		maxStashes:  maxStashes,
+
+		triggerRetention: make(map[string]RetentionPolicy),
 	}
 
 	dm.loadExistingFileStashes()
 
 	dm.mux.HandleFunc("/stashes", dm.handleStashes)
-	dm.mux.HandleFunc("/stashes/", dm.handleGetStash)
+	dm.mux.HandleFunc("/stashes/", dm.handleStash)
 	dm.mux.HandleFunc("/buffer", dm.handleGetBuffer)
+	dm.mux.HandleFunc("/filters", dm.handleGetFilters)
+	dm.mux.HandleFunc("/filters/test", dm.handleTestFilters)
 	return &dm
 }
 
@@ -89,6 +315,39 @@ func (dm *StashServer) AddCompletionCallback(callback StashCompletionFunc) {
 	dm.stashCompleteCallbacks = append(dm.stashCompleteCallbacks, callback)
 }
 
+// AddHandler adds a handler for additional endpoints, such as webhook receivers
+func (dm *StashServer) AddHandler(pattern string, handler http.Handler) {
+	dm.mux.Handle(pattern, handler)
+}
+
+// SetSilencer sets the silencer checked before taking triggered stashes
+func (dm *StashServer) SetSilencer(silencer Silencer) {
+	dm.silencer = silencer
+}
+
+// SetGrouper sets the grouper used for triggered stashes which aren't silenced
+func (dm *StashServer) SetGrouper(grouper Grouper) {
+	dm.grouper = grouper
+}
+
+// SetCollectorInfo sets the collector version, a hash of its config and its
+// namespace recorded in the metadata of new stashes
+func (dm *StashServer) SetCollectorInfo(version, configHash, namespace string) {
+	dm.collectorVersion = version
+	dm.configHash = configHash
+	dm.namespace = namespace
+}
+
+// StashDir returns the directory stashes are stored in
+func (dm *StashServer) StashDir() string {
+	return dm.stashDir
+}
+
+// AddFilterSet adds a filter set to be reported on by the filters API
+func (dm *StashServer) AddFilterSet(set *filters.FilterSet) {
+	dm.filterSets = append(dm.filterSets, set)
+}
+
 func (dm *StashServer) loadExistingFileStashes() {
 	dm.stashesMutex.Lock()
 	defer dm.stashesMutex.Unlock()
@@ -98,11 +357,37 @@ func (dm *StashServer) loadExistingFileStashes() {
 		log.Error(err, "Couldn't read stash directory, no existing stashes loaded")
 	}
 
+	dm.removeTempFiles(dirs)
+
 	for _, d := range dirs {
-		if !d.IsDir() && strings.HasPrefix(d.Name(), dm.stashPrefix) {
-			stashName, _ := strings.CutSuffix(d.Name(), stashFileExtension)
-			dm.stashes[stashName] = &Stash{Status: StashComplete, Name: stashName}
+		if d.IsDir() || !strings.HasPrefix(d.Name(), dm.stashPrefix) {
+			continue
+		}
+
+		stashName, isStash := strings.CutSuffix(d.Name(), stashFileExtension)
+		if !isStash {
+			continue
+		}
+
+		stash := dm.loadStashMetadata(stashName, d)
+
+		// Whatever kept the stash open didn't survive the restart, so it
+		// won't be rewritten again
+		stash.Open = false
+
+		// Corrupt stashes are kept so they can be inspected, but can't be
+		// mistaken for complete stashes
+		if stash.Status == StashComplete {
+			if err := dm.validateStash(stash); err != nil {
+				log.Error(err, "Existing stash is invalid", "stash-name", stashName)
+				stash.Status = StashFailed
+				stash.Error = err.Error()
+			} else if err := dm.summarizeLegacyStash(stash); err != nil {
+				log.Error(err, "Couldn't summarize legacy stash", "stash-name", stashName)
+			}
 		}
+
+		dm.stashes[stashName] = stash
 	}
 }
 
@@ -117,127 +402,373 @@ func (dm *StashServer) handleStashes(rw http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleGetStashes lists the stashes, optionally only those with labels
+// matching the labelSelector query parameter
 func (dm *StashServer) handleGetStashes(rw http.ResponseWriter, r *http.Request) {
+	selector, err := labels.Parse(r.URL.Query().Get("labelSelector"))
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
 	dm.stashesMutex.RLock()
 	defer dm.stashesMutex.RUnlock()
-	json.NewEncoder(rw).Encode(dm.stashes)
+
+	stashes := make(map[string]*Stash, len(dm.stashes))
+	for name, stash := range dm.stashes {
+		if selector.Matches(labels.Set(stash.Labels)) {
+			stashes[name] = stash.progress()
+		}
+	}
+
+	json.NewEncoder(rw).Encode(stashes)
 }
 
+// handlePostStashes takes a stash, the request body is an optional
+// StashRequest
 func (dm *StashServer) handlePostStashes(rw http.ResponseWriter, r *http.Request) {
-	stashName := dm.stashPrefix + time.Now().Format(tsFormat)
+	req := StashRequest{}
+	if r.Body != nil {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	opts, err := req.options()
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(err.Error()))
+		return
+	}
 
-	dm.purgeOldStashes(dm.maxStashes - 1)
+	stash, err := dm.CreateStashAsync(opts)
 
-	if err := dm.createFileStash(stashName); err != nil {
+	switch {
+	case errors.Is(err, ErrInvalidStashName):
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(err.Error()))
+		return
+	case errors.Is(err, ErrStashExists):
+		rw.WriteHeader(http.StatusConflict)
+		rw.Write([]byte(err.Error()))
+		return
+	case err != nil:
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	rw.WriteHeader(http.StatusCreated)
 
-	rw.Write([]byte(stashName))
+	rw.Header().Set("Location", "/stashes/"+stash.Name+"/status")
+	rw.WriteHeader(http.StatusAccepted)
+
+	rw.Write([]byte(stash.Name))
 }
 
-func (dm *StashServer) purgeOldStashes(maxStashes int) {
-	dm.stashesMutex.Lock()
-	defer dm.stashesMutex.Unlock()
-	if len(dm.stashes) <= maxStashes {
-		return
+// handleStash serves a stash on /stashes/<name>, which it can also be
+// deleted from, its metadata on /stashes/<name>/status and pins or unpins it
+// on /stashes/<name>/pin and /stashes/<name>/unpin
+func (dm *StashServer) handleStash(rw http.ResponseWriter, r *http.Request) {
+	stashName, subresource, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/stashes/"), "/")
+
+	switch {
+	case subresource == "" && r.Method == http.MethodGet:
+		dm.handleGetStash(rw, r, stashName)
+	case subresource == "" && r.Method == http.MethodDelete:
+		dm.handleDeleteStash(rw, stashName)
+	case subresource == "status" && r.Method == http.MethodGet:
+		dm.handleGetStashStatus(rw, stashName)
+	case subresource == "events" && r.Method == http.MethodGet:
+		dm.handleGetStashEvents(rw, r, stashName)
+	case (subresource == "pin" || subresource == "unpin") && r.Method == http.MethodPost:
+		dm.handlePinStash(rw, stashName, subresource == "pin")
+	case subresource == "" || subresource == "status" || subresource == "events" || subresource == "pin" || subresource == "unpin":
+		rw.WriteHeader(http.StatusBadRequest)
+	default:
+		rw.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (dm *StashServer) handleGetStash(rw http.ResponseWriter, r *http.Request, stashName string) {
+	// The stash is copied so the lock isn't held while it is served, which
+	// would block stashes being written for as long as a slow client takes
+	dm.stashesMutex.RLock()
+	stash, exists := dm.stashes[stashName]
+	if exists {
+		stash = stash.progress()
 	}
+	dm.stashesMutex.RUnlock()
 
-	stashNames := make([]string, len(dm.stashes))
+	if !exists || stash.Status == StashFailed {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	} else if stash.Status == StashStarted {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	} else if stash.Status != StashComplete {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-	i := 0
-	for stash := range dm.stashes {
-		stashNames[i] = stash
-		i++
+	format, ok := requestFormat(rw, r)
+	if !ok {
+		return
 	}
 
-	slices.Sort(stashNames)
+	rw.Header().Set("Content-Type", format.ContentType)
 
-	stashesToDelete := len(dm.stashes) - maxStashes
+	// Stashes are stored as JSON so are served as they are, unless they
+	// need decompressing for the client or are in the legacy format
+	if format.Name == JSONFormat && !stash.Legacy && (stash.Encoding == CompressionNone || acceptsGzip(r)) {
+		rw.Header().Add("Vary", "Accept-Encoding")
+		if stash.Encoding != CompressionNone {
+			rw.Header().Set("Content-Encoding", stash.Encoding)
+		}
 
-	for i = 0; i < stashesToDelete; i++ {
-		stashName := stashNames[i]
-		log.Info("Removing old stash", "stashName", stashName)
-		stashLocation := dm.getStashLocation(stashName)
-		os.Remove(stashLocation)
-		delete(dm.stashes, stashName)
+		http.ServeFile(rw, r, dm.getStashLocation(stashName))
+		return
 	}
+
+	dm.serveStashAs(rw, r, stash, format)
 }
 
-func (dm *StashServer) handleGetStash(rw http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		rw.WriteHeader(http.StatusBadRequest)
+// serveStashAs serves a stash in another format or encoding than it is
+// stored in
+func (dm *StashServer) serveStashAs(rw http.ResponseWriter, r *http.Request, d *Stash, format Format) {
+	f, err := dm.openStash(d)
+	if errors.Is(err, os.ErrNotExist) {
+		// The stash was deleted since it was looked up
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Error(err, "Failed to open stash", "stash-name", d.Name)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	e, err := stash.Decode(f)
+	if err != nil {
+		log.Error(err, "Failed to decode stash", "stash-name", d.Name)
+		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	stashName := strings.TrimPrefix(r.URL.Path, "/stashes/")
+	upgradeLegacyEnvelope(d, e)
+
+	w := compressResponse(rw, r)
+	defer w.Close()
+
+	if err := format.Encode(w, e); err != nil {
+		log.Error(err, "Failed to encode stash", "stash-name", d.Name, "format", format.Name)
+	}
+}
 
+// handleGetStashStatus serves a stashes metadata, while it is being written
+// its size is how much has been written so far
+func (dm *StashServer) handleGetStashStatus(rw http.ResponseWriter, stashName string) {
 	dm.stashesMutex.RLock()
-	defer dm.stashesMutex.RUnlock()
-	if stash, exists := dm.stashes[stashName]; !exists || stash.Status == StashFailed {
+	stash, exists := dm.stashes[stashName]
+	if exists {
+		stash = stash.progress()
+	}
+	dm.stashesMutex.RUnlock()
+
+	if !exists {
 		rw.WriteHeader(http.StatusNotFound)
 		return
-	} else if stash.Status == StashStarted {
-		rw.WriteHeader(http.StatusMethodNotAllowed)
-		return
-	} else if stash.Status != StashComplete {
-		rw.WriteHeader(http.StatusInternalServerError)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(stash)
+}
+
+func (dm *StashServer) handleDeleteStash(rw http.ResponseWriter, stashName string) {
+	err := dm.DeleteStash(stashName)
+
+	switch {
+	case errors.Is(err, ErrStashNotFound):
+		rw.WriteHeader(http.StatusNotFound)
+	case err != nil:
+		rw.WriteHeader(http.StatusConflict)
+		rw.Write([]byte(err.Error()))
+	default:
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (dm *StashServer) handlePinStash(rw http.ResponseWriter, stashName string, pinned bool) {
+	stash, err := dm.PinStash(stashName, pinned)
+	if err != nil {
+		rw.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	filePath := dm.getStashLocation(stashName)
 	rw.Header().Set("Content-Type", "application/json")
-	http.ServeFile(rw, r, filePath)
+	json.NewEncoder(rw).Encode(stash)
 }
 
-func (dm *StashServer) createFileStash(stashName string) error {
+// startStash reserves the stashes name and adds it with the started status.
+// It fails if a stash with the same name exists and isn't to be replaced.
+// Replacing a stash which is still being written queues the rewrite, only the
+// latest queued options are kept. Replaced stashes keep their creation time
+// and pin. Generated names are made unique.
+func (dm *StashServer) startStash(opts StashOptions) (*Stash, error) {
+	stashName, err := dm.getStashName(opts)
+	if err != nil {
+		log.Error(err, "Stash creation failed")
+		return nil, err
+	}
+
 	dm.stashesMutex.Lock()
 	defer dm.stashesMutex.Unlock()
-	log.Info("Creating event stash", "stash-name", stashName)
 
-	d := &Stash{
-		Status: StashStarted,
-		Name:   stashName,
+	if opts.Name == "" {
+		stashName = dm.uniqueStashName(stashName)
 	}
 
-	if _, exists := dm.stashes[stashName]; exists {
-		err := fmt.Errorf("Stash %s already exists", stashName)
+	existing, exists := dm.stashes[stashName]
+	if exists && !opts.Replace {
+		err := fmt.Errorf("%w: %s", ErrStashExists, stashName)
 		log.Error(err, "Stash creation failed")
-		return err
+		return nil, err
+	}
+
+	if exists && existing.Status == StashStarted {
+		log.Info("Stash is being written, queueing rewrite", "stash-name", stashName)
+		dm.rewrites[stashName] = opts
+		return existing.progress(), errRewriteQueued
+	}
+
+	d := &Stash{
+		Status:           StashStarted,
+		Name:             stashName,
+		CreationTime:     time.Now(),
+		Source:           opts.source(),
+		Trigger:          opts.Trigger,
+		TriggerEvent:     opts.TriggerEvent,
+		Labels:           opts.Labels,
+		Annotations:      opts.Annotations,
+		Description:      opts.Description,
+		CollectorVersion: dm.collectorVersion,
+		ConfigHash:       dm.configHash,
+		Namespace:        dm.namespace,
+		Scheduled:        opts.Scheduled,
+		Open:             opts.Open,
+		Encoding:         dm.compression,
+		written:          &atomic.Int64{},
+	}
+
+	if exists {
+		d.CreationTime = existing.CreationTime
+		d.Pinned = existing.Pinned
 	}
 
 	dm.stashes[stashName] = d
 
-	stashStatus := StashFailed
+	return d, nil
+}
+
+// writeStash writes a started stash to file without holding the lock, so
+// the stashes can be read while it is written, then updates its status and
+// persists its metadata
+func (dm *StashServer) writeStash(d *Stash, opts StashOptions) (Stash, error) {
+	log.Info("Creating event stash", "stash-name", d.Name, "trigger", opts.Trigger)
+
+	dm.stashesMutex.Lock()
+	err := dm.makeRoom(d)
+	dm.stashesMutex.Unlock()
+
+	var summary stash.Summary
+	var checksum string
+	if err == nil {
+		scope := opts.Scope
+		metadata := envelopeMetadata(d, scope)
+		scope.Envelope = &metadata
+
+		summary, checksum, err = dm.writeFileStash(d, scope)
+	} else {
+		log.Error(err, "Stash creation failed", "stash-name", d.Name)
+	}
 
-	// After we're finished whether succesful or not, update the stash status
-	defer func() {
-		dm.stashes[stashName].Status = stashStatus
-	}()
+	dm.stashesMutex.Lock()
 
-	filePath := filepath.Join(dm.stashDir, stashName) + stashFileExtension
-	f, err := os.Create(filePath)
+	d.Status = StashComplete
+	d.CompletionTime = time.Now()
+	d.Size = d.written.Load()
 
 	if err != nil {
-		log.Error(err, "Failed to create stash file")
-		return err
+		// Partially written files are removed so don't use any space
+		d.Status = StashFailed
+		d.Error = err.Error()
+		d.Size = 0
+	} else {
+		d.Checksum = checksum
+		d.EventCount = summary.EventCount
+		d.FirstEventTime = summary.FirstEventTime
+		d.LastEventTime = summary.LastEventTime
+		dm.lastStashSize = d.Size
 	}
 
-	defer f.Close()
+	// The metadata is saved with the lock held so a purge can't remove the
+	// stash before it is saved, then the new stash is counted in retention.
+	// Failed stashes have no file, so their metadata isn't persisted.
+	stash := *d
+	if d.Status == StashComplete {
+		dm.saveStashMetadata(&stash)
+	}
+	dm.purgeStashes()
+	dm.enforceQuota(d)
+
+	rewrite, queued := dm.rewrites[d.Name]
+	delete(dm.rewrites, d.Name)
+
+	dm.stashesMutex.Unlock()
 
-	err = dm.stasher.Stash(f)
+	if queued {
+		go dm.CreateStash(rewrite)
+	}
 
 	if err != nil {
-		log.Error(err, "Error writing stash to file")
-		return err
+		return stash, err
 	}
 
-	stashStatus = StashComplete
+	log.Info("Executing Complete Functions", "stash-name", stash.Name)
+	go dm.execStashCompleteFuncs(&stash, opts)
+
+	return stash, nil
+}
+
+// writeFileStash writes the stash to file atomically, so the stash file is
+// either complete or doesn't exist, and returns its checksum
+func (dm *StashServer) writeFileStash(d *Stash, scope stash.Scope) (stash.Summary, string, error) {
+	var summary stash.Summary
+	h := sha256.New()
+
+	err := atomicfile.WriteFile(dm.getStashLocation(d.Name), func(w io.Writer) error {
+		cw := compressWriter(&countingWriter{w: io.MultiWriter(w, h), n: d.written}, d.Encoding)
+
+		var err error
+		summary, err = dm.stasher.Stash(cw, scope)
+		if closeErr := cw.Close(); err == nil {
+			err = closeErr
+		}
 
-	log.Info("Executing Complete Functions", "stash-name", stashName)
-	go dm.execStashCompleteFuncs(d)
-	return nil
+		return err
+	})
+
+	if err != nil {
+		log.Error(err, "Error writing stash to file")
+
+		if errors.Is(err, syscall.ENOSPC) {
+			return stash.Summary{}, "", fmt.Errorf("%w: %s", ErrInsufficientSpace, err.Error())
+		}
+
+		return stash.Summary{}, "", err
+	}
+
+	return summary, hex.EncodeToString(h.Sum(nil)), nil
 }
 
 func (dm *StashServer) handleGetBuffer(rw http.ResponseWriter, r *http.Request) {
@@ -246,23 +777,201 @@ func (dm *StashServer) handleGetBuffer(rw http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	rw.Header().Set("Content-Type", "application/json")
-	err := dm.stasher.Stash(rw)
+	format, ok := requestFormat(rw, r)
+	if !ok {
+		return
+	}
+
+	rw.Header().Set("Content-Type", format.ContentType)
+
+	w := compressResponse(rw, r)
+	defer w.Close()
+
+	_, err := dm.stasher.Stash(w, stash.Scope{Encode: format.Encode})
 
 	if err != nil {
 		rw.WriteHeader(http.StatusInternalServerError)
 	}
 }
 
+func (dm *StashServer) handleGetFilters(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	stats := make([]filters.FilterSetStats, len(dm.filterSets))
+	for i, set := range dm.filterSets {
+		stats[i] = set.Stats()
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(stats)
+}
+
+// handleTestFilters dry runs an event against the filters and triggers, the
+// event is either provided as the request body or referenced by the UID of a
+// buffered event using the uid query parameter
+func (dm *StashServer) handleTestFilters(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var event *corev1.Event
+
+	if uid := r.URL.Query().Get("uid"); uid != "" {
+		getter, ok := dm.stasher.(EventGetter)
+		if !ok {
+			rw.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+
+		if event = getter.GetEvent(types.UID(uid)); event == nil {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+	} else {
+		event = &corev1.Event{}
+		if err := json.NewDecoder(r.Body).Decode(event); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	result := FilterTestResult{
+		Event:   event,
+		Results: make([]filters.FilterSetResult, len(dm.filterSets)),
+	}
+
+	for i, set := range dm.filterSets {
+		result.Results[i] = set.Explain(event)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(result)
+}
+
 // CreateBufferStash creates a stash of the buffer
 func (dm *StashServer) CreateBufferStash() {
-	stashName := dm.stashPrefix + time.Now().Format(tsFormat)
+	dm.CreateTriggeredStash(StashOptions{})
+}
 
-	dm.createFileStash(stashName)
+// CreateTriggeredStash creates a stash of the buffer with the given options,
+// if the options have a delay the stash is written in the background. No
+// stash is taken if the trigger is silenced.
+func (dm *StashServer) CreateTriggeredStash(opts StashOptions) {
+	if dm.silencer != nil {
+		if id, silenced := dm.silencer.Silenced(opts.Trigger, opts.TriggerEvent); silenced {
+			log.Info("Stash silenced", "trigger", opts.Trigger, "silence", id)
+			return
+		}
+	}
+
+	if dm.grouper != nil {
+		opts = dm.grouper.Group(opts)
+	}
+
+	freezer, canFreeze := dm.stasher.(Freezer)
+	freeze := opts.FreezeBuffer && canFreeze
+
+	if freeze {
+		freezer.Freeze()
+	}
+
+	create := func() {
+		if freeze {
+			defer freezer.Unfreeze()
+		}
+
+		dm.CreateStash(opts)
+	}
+
+	if opts.Delay > 0 {
+		log.Info("Delaying stash", "trigger", opts.Trigger, "delay", opts.Delay)
+		time.AfterFunc(opts.Delay, create)
+		return
+	}
+
+	create()
 }
 
-func (dm *StashServer) execStashCompleteFuncs(d *Stash) {
-	for _, callback := range dm.stashCompleteCallbacks {
+// CreateStash creates a stash of the buffer with the given options and
+// returns it once it has been written, the options delay is ignored. If it
+// replaces a stash which is still being written the stash is returned
+// without waiting for the rewrite.
+func (dm *StashServer) CreateStash(opts StashOptions) (Stash, error) {
+	d, err := dm.startStash(opts)
+	if errors.Is(err, errRewriteQueued) {
+		return *d, nil
+	}
+
+	if err != nil {
+		return Stash{Status: StashFailed}, err
+	}
+
+	return dm.writeStash(d, opts)
+}
+
+// CreateStashAsync starts creating a stash of the buffer with the given
+// options and returns it once its name is reserved, it is written in the
+// background and its status can be polled. The options delay is ignored.
+func (dm *StashServer) CreateStashAsync(opts StashOptions) (Stash, error) {
+	d, err := dm.startStash(opts)
+	if errors.Is(err, errRewriteQueued) {
+		return *d, nil
+	}
+
+	if err != nil {
+		return Stash{Status: StashFailed}, err
+	}
+
+	stash := *d
+
+	go dm.writeStash(d, opts)
+
+	return stash, nil
+}
+
+// getStashName returns the name for a new stash, custom names are prefixed so
+// they are found when loading existing stashes
+func (dm *StashServer) getStashName(opts StashOptions) (string, error) {
+	if opts.Name == "" {
+		return dm.stashPrefix + time.Now().Format(tsFormat), nil
+	}
+
+	if !stashNameRegexp.MatchString(opts.Name) {
+		return "", fmt.Errorf("%w %q, names may only contain alphanumerics, '.', '_' and '-'", ErrInvalidStashName, opts.Name)
+	}
+
+	if strings.HasPrefix(opts.Name, dm.stashPrefix) {
+		return opts.Name, nil
+	}
+
+	return dm.stashPrefix + opts.Name, nil
+}
+
+// uniqueStashName returns the name with a numeric suffix if a stash with it
+// already exists, such as when stashes are taken in the same second. It must
+// be called with the lock held.
+func (dm *StashServer) uniqueStashName(name string) string {
+	unique := name
+	for i := 2; dm.stashes[unique] != nil; i++ {
+		unique = fmt.Sprintf("%s-%d", name, i)
+	}
+
+	return unique
+}
+
+func (dm *StashServer) execStashCompleteFuncs(d *Stash, opts StashOptions) {
+	if !opts.SkipCompletion {
+		for _, callback := range dm.stashCompleteCallbacks {
+			callback(d)
+		}
+	}
+
+	for _, callback := range opts.CompletionCallbacks {
 		callback(d)
 	}
 }
@@ -271,8 +980,23 @@ func (dm *StashServer) getStashLocation(stashName string) string {
 	return filepath.Join(dm.stashDir, stashName) + stashFileExtension
 }
 
+// source returns where the stash was requested from
+func (opts *StashOptions) source() StashSource {
+	switch {
+	case opts.Source != "":
+		return opts.Source
+	case opts.Scheduled:
+		return StashSourceSchedule
+	case opts.Trigger != "":
+		return StashSourceTrigger
+	default:
+		return StashSourceManual
+	}
+}
+
 // Run starts the server
 func (dm *StashServer) Run(port string) {
 	log.Info("Starting Stash Server", "port", port)
+	go dm.runRetention()
 	http.ListenAndServe(":"+port, dm.mux)
 }
@@ -2,18 +2,28 @@ package stashserver
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	"github.com/couchbase/k8s-event-collector/pkg/filters"
+	"github.com/couchbase/k8s-event-collector/pkg/stash"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 )
@@ -24,24 +34,94 @@ type testStasher struct {
 	stashData string
 }
 
-func (d *testStasher) Stash(w io.Writer) error {
+func (d *testStasher) Stash(w io.Writer, _ stash.Scope) (stash.Summary, error) {
 	w.Write([]byte(d.stashData))
+	return stash.Summary{EventCount: 1}, nil
+}
+
+type testEventStasher struct {
+	testStasher
+	events []*corev1.Event
+}
+
+func (d *testEventStasher) GetEvent(uid types.UID) *corev1.Event {
+	for _, e := range d.events {
+		if e.UID == uid {
+			return e
+		}
+	}
+
 	return nil
 }
 
+type testFreezeStasher struct {
+	testStasher
+	frozen atomic.Int32
+}
+
+func (d *testFreezeStasher) Freeze() {
+	d.frozen.Add(1)
+}
+
+func (d *testFreezeStasher) Unfreeze() {
+	d.frozen.Add(-1)
+}
+
+type testScopeStasher struct {
+	testStasher
+	scope stash.Scope
+}
+
+func (d *testScopeStasher) Stash(w io.Writer, scope stash.Scope) (stash.Summary, error) {
+	d.scope = scope
+	return d.testStasher.Stash(w, scope)
+}
+
+// testEncodeStasher writes its events with the scopes encoder
+type testEncodeStasher struct {
+	events []*corev1.Event
+}
+
+func (d *testEncodeStasher) Stash(w io.Writer, scope stash.Scope) (stash.Summary, error) {
+	e := stash.Envelope{Events: d.events}
+	if scope.Envelope != nil {
+		e = stash.NewEnvelope(*scope.Envelope, d.events, stash.Summary{EventCount: len(d.events)})
+	}
+
+	encode := scope.Encode
+	if encode == nil {
+		encode = stash.EncodeJSON
+	}
+
+	return stash.Summary{EventCount: len(d.events)}, encode(w, &e)
+}
+
 type testErrorStasher struct {
 }
 
-func (d *testErrorStasher) Stash(w io.Writer) error {
-	return fmt.Errorf("Very bad dangerous error")
+func (d *testErrorStasher) Stash(w io.Writer, _ stash.Scope) (stash.Summary, error) {
+	return stash.Summary{}, fmt.Errorf("Very bad dangerous error")
 }
 
 type testWaitStasher struct {
 }
 
-func (d *testWaitStasher) Stash(w io.Writer) error {
+// testReleaseStasher counts the stashes written, each blocks until released
+type testReleaseStasher struct {
+	testStasher
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (d *testReleaseStasher) Stash(w io.Writer, scope stash.Scope) (stash.Summary, error) {
+	d.calls.Add(1)
+	<-d.release
+	return d.testStasher.Stash(w, scope)
+}
+
+func (d *testWaitStasher) Stash(w io.Writer, _ stash.Scope) (stash.Summary, error) {
 	time.Sleep(3 * time.Second)
-	return nil
+	return stash.Summary{}, nil
 }
 
 func TestGetStashes(t *testing.T) {
@@ -217,21 +297,440 @@ func TestCreateBufferStash(t *testing.T) {
 	validateStashCreated(t, 1, testdir)
 }
 
+func TestCreateTriggeredStash(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+
+	serverCallbacks := make(chan *Stash, 2)
+	stashCallbacks := make(chan *Stash, 2)
+	ds.AddCompletionCallback(func(d *Stash) { serverCallbacks <- d })
+
+	ds.CreateTriggeredStash(StashOptions{
+		Trigger:             "oom",
+		Labels:              map[string]string{"severity": "high"},
+		CompletionCallbacks: []StashCompletionFunc{func(d *Stash) { stashCallbacks <- d }},
+	})
+
+	waitForCallbacks(t, serverCallbacks, 1)
+	waitForCallbacks(t, stashCallbacks, 1)
+
+	validateStashCreated(t, 1, testdir)
+	stashes := validateGetStashes(t, ds, 1)
+
+	for _, stash := range stashes {
+		if stash.Trigger != "oom" || stash.Labels["severity"] != "high" {
+			t.Errorf("Expected stash to record the trigger and labels: %+v", stash)
+		}
+	}
+
+	if len(serverCallbacks) != 0 || len(stashCallbacks) != 0 {
+		t.Errorf("Expected server and stash callbacks to be called once")
+	}
+}
+
+type testSilencer struct {
+	trigger string
+}
+
+func (s *testSilencer) Silenced(trigger string, in *corev1.Event) (string, bool) {
+	return "test", trigger == s.trigger && in != nil
+}
+
+func TestSilencedTriggeredStash(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+
+	ds.SetSilencer(&testSilencer{trigger: "warnings"})
+
+	ds.CreateTriggeredStash(StashOptions{Trigger: "warnings", TriggerEvent: &corev1.Event{}})
+	validateStashCreated(t, 0, testdir)
+
+	ds.CreateTriggeredStash(StashOptions{Trigger: "oom", TriggerEvent: &corev1.Event{}})
+	validateStashCreated(t, 1, testdir)
+
+	// Stashes requested directly aren't silenced
+	time.Sleep(time.Second)
+	mustCreateStash(t, ds)
+	validateStashCreated(t, 2, testdir)
+}
+
+func TestCreateDelayedStash(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+
+	stasher := &testFreezeStasher{testStasher: testStasher{"data"}}
+	ds.stasher = stasher
+
+	ds.CreateTriggeredStash(StashOptions{
+		Delay:        time.Second,
+		FreezeBuffer: true,
+	})
+
+	if stasher.frozen.Load() != 1 {
+		t.Errorf("Expected the buffer to be frozen while the stash is pending")
+	}
+
+	validateStashCreated(t, 0, testdir)
+	validateStashCreated(t, 1, testdir)
+
+	if stasher.frozen.Load() != 0 {
+		t.Errorf("Expected the buffer to be unfrozen once the stash is written")
+	}
+}
+
+func TestCreateNamedStash(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+
+	stash, err := ds.CreateStash(StashOptions{Name: "incident"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stash.Status != StashComplete || stash.Name != TestFilePrefix+"incident" || stash.EventCount != 1 || stash.Source != StashSourceManual {
+		t.Errorf("Unexpected stash %+v", stash)
+	}
+
+	if _, err := ds.CreateStash(StashOptions{Name: "incident"}); err == nil {
+		t.Errorf("Expected creating a stash with an existing name to fail")
+	}
+
+	if _, err := ds.CreateStash(StashOptions{Name: "../incident"}); err == nil {
+		t.Errorf("Expected creating a stash with an invalid name to fail")
+	}
+
+	validateStashCreated(t, 1, testdir)
+}
+
+func TestReplaceStash(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+
+	created, err := ds.CreateStash(StashOptions{Name: "incident"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ds.PinStash(TestFilePrefix+"incident", true); err != nil {
+		t.Fatal(err)
+	}
+
+	replaced, err := ds.CreateStash(StashOptions{Name: "incident", Trigger: "oom", Replace: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if replaced.Status != StashComplete || replaced.Trigger != "oom" || !replaced.Pinned || !replaced.CreationTime.Equal(created.CreationTime) {
+		t.Errorf("Expected the replaced stash to keep its creation time and pin: %+v", replaced)
+	}
+}
+
+func TestRewriteSkipsCompletion(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+
+	serverCallbacks := make(chan *Stash, 10)
+	ds.AddCompletionCallback(func(d *Stash) { serverCallbacks <- d })
+
+	stashCallbacks := make(chan *Stash, 10)
+	opts := StashOptions{
+		Name:                "incident",
+		Replace:             true,
+		CompletionCallbacks: []StashCompletionFunc{func(d *Stash) { stashCallbacks <- d }},
+	}
+
+	if _, err := ds.CreateStash(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForCallbacks(t, serverCallbacks, 1)
+	waitForCallbacks(t, stashCallbacks, 1)
+
+	// Rewrites only run their own callbacks
+	opts.SkipCompletion = true
+	if _, err := ds.CreateStash(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForCallbacks(t, stashCallbacks, 1)
+
+	select {
+	case <-serverCallbacks:
+		t.Error("Expected the servers callbacks to be skipped for the rewrite")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestOpenStashRetained(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+	ds.SetTriggerRetention("oom", RetentionPolicy{MaxStashes: 1})
+
+	if _, err := ds.CreateStash(StashOptions{Name: "incident", Trigger: "oom", Replace: true, Open: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Later stashes of the trigger don't purge the open stash
+	for i := 0; i < 2; i++ {
+		if _, err := ds.CreateStash(StashOptions{Name: fmt.Sprintf("later-%d", i), Trigger: "oom"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stashes := validateGetStashes(t, ds, 2)
+	if _, ok := stashes[TestFilePrefix+"incident"]; !ok {
+		t.Errorf("Expected the open stash to be retained, found: %v", stashes)
+	}
+
+	// Once rewritten closed it is purged as usual
+	if _, err := ds.CreateStash(StashOptions{Name: "incident", Trigger: "oom", Replace: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	stashes = validateGetStashes(t, ds, 1)
+	if _, ok := stashes[TestFilePrefix+"incident"]; ok {
+		t.Errorf("Expected the closed stash to be purged, found: %v", stashes)
+	}
+}
+
+func TestReplaceStashBeingWritten(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+
+	stasher := &testReleaseStasher{testStasher: testStasher{"data"}, release: make(chan struct{})}
+	ds.stasher = stasher
+
+	if _, err := ds.CreateStashAsync(StashOptions{Name: "incident"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewrites requested while the stash is written are coalesced
+	for i := 0; i < 3; i++ {
+		stash, err := ds.CreateStash(StashOptions{Name: "incident", Replace: true})
+		if err != nil || stash.Status != StashStarted {
+			t.Fatalf("Expected the rewrite to be queued: %+v, %v", stash, err)
+		}
+	}
+
+	close(stasher.release)
+
+	for i := 0; i < 100 && stasher.calls.Load() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if stash := waitForStash(t, ds, TestFilePrefix+"incident"); stash.Status != StashComplete {
+		t.Errorf("Expected the rewritten stash to complete: %+v", stash)
+	}
+
+	if calls := stasher.calls.Load(); calls != 2 {
+		t.Errorf("Expected the stash to be written then rewritten once, got %d writes", calls)
+	}
+}
+
+func TestCreateStashRequest(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+
+	stasher := &testScopeStasher{testStasher: testStasher{"data"}}
+	ds.stasher = stasher
+
+	rr := mustPostStash(t, ds, `{
+		"name": "rebalance",
+		"labels": {"cluster": "cb-example"},
+		"description": "Rebalance stuck at 50%",
+		"filter": {
+			"types": ["Warning"],
+			"kinds": ["CouchbaseCluster"],
+			"objects": [{"kind": "Pod", "name": "cb-example-0000"}],
+			"window": "30m"
+		}
+	}`, http.StatusAccepted)
+
+	if name := rr.Body.String(); name != TestFilePrefix+"rebalance" {
+		t.Errorf("Unexpected stash name %s", name)
+	}
+
+	stash := waitForStash(t, ds, TestFilePrefix+"rebalance")
+	if stash.Labels["cluster"] != "cb-example" || stash.Description != "Rebalance stuck at 50%" || stash.Source != StashSourceManual {
+		t.Errorf("Expected the stash to record the request: %+v", stash)
+	}
+
+	scope := stasher.scope
+	if !reflect.DeepEqual(scope.Types, []string{corev1.EventTypeWarning}) || time.Since(scope.Since) < 29*time.Minute || scope.Filter == nil {
+		t.Fatalf("Unexpected stash scope %+v", scope)
+	}
+
+	for kind, expected := range map[string]bool{"CouchbaseCluster": true, "Pod": true, "Service": false} {
+		e := &corev1.Event{InvolvedObject: corev1.ObjectReference{Kind: kind, Name: "cb-example-0000"}}
+		if scope.Filter.Accepts(e) != expected {
+			t.Errorf("Expected %s event to be accepted: %v", kind, expected)
+		}
+	}
+
+	mustPostStash(t, ds, `{"name": "rebalance"}`, http.StatusConflict)
+	mustPostStash(t, ds, `{"name": "../rebalance"}`, http.StatusBadRequest)
+	mustPostStash(t, ds, `{"filter": {"window": "yesterday"}}`, http.StatusBadRequest)
+	mustPostStash(t, ds, `{"filter": {"objects": [{"kind": "Pod"}]}}`, http.StatusBadRequest)
+	mustPostStash(t, ds, `not json`, http.StatusBadRequest)
+}
+
+func TestGeneratedStashNamesUnique(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+
+	names := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		stash, err := ds.CreateStash(StashOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names[stash.Name] = true
+	}
+
+	if len(names) != 3 {
+		t.Errorf("Expected stashes taken in the same second to have unique names: %v", names)
+	}
+}
+
+func TestGetStashesLabelSelector(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+
+	for i, severity := range []string{"high", "low", "high"} {
+		if _, err := ds.CreateStash(StashOptions{
+			Name:   fmt.Sprintf("stash-%d", i),
+			Labels: map[string]string{"severity": severity},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for selector, expected := range map[string]int{"severity=high": 2, "severity!=high": 1, "severity in (high,low)": 3, "team": 0} {
+		rr := httptest.NewRecorder()
+		ds.mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stashes?labelSelector="+url.QueryEscape(selector), nil))
+
+		stashes := map[string]*Stash{}
+		json.NewDecoder(rr.Body).Decode(&stashes)
+
+		if len(stashes) != expected {
+			t.Errorf("Expected %d stashes matching %q, got %d", expected, selector, len(stashes))
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	ds.mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stashes?labelSelector="+url.QueryEscape("severity in high"), nil))
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid selector to fail, got %d", rr.Code)
+	}
+}
+
+func TestAsyncStashStatus(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+
+	ds.stasher = &testWaitStasher{}
+
+	rr := mustPostStash(t, ds, `{"name": "slow"}`, http.StatusAccepted)
+
+	location := rr.Header().Get("Location")
+	if location != "/stashes/"+TestFilePrefix+"slow/status" {
+		t.Fatalf("Unexpected location %q", location)
+	}
+
+	// Reads aren't blocked while the stash is written
+	start := time.Now()
+	stashes := validateGetStashes(t, ds, 1)
+
+	if time.Since(start) > time.Second || stashes[TestFilePrefix+"slow"].Status != StashStarted {
+		t.Errorf("Expected the stash to be listed as started without waiting for it")
+	}
+
+	rr = httptest.NewRecorder()
+	ds.mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stashes/"+TestFilePrefix+"slow", nil))
+
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected a started stash not to be served, got %d", rr.Code)
+	}
+
+	stash := waitForStash(t, ds, TestFilePrefix+"slow")
+	if stash.Status != StashComplete || stash.CompletionTime.Before(stash.CreationTime) {
+		t.Errorf("Expected the stash to complete: %+v", stash)
+	}
+
+	rr = httptest.NewRecorder()
+	ds.mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stashes/missing/status", nil))
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected %d for a missing stash, got %d", http.StatusNotFound, rr.Code)
+	}
+
+	ds.stasher = &testErrorStasher{}
+	mustPostStash(t, ds, `{"name": "failed"}`, http.StatusAccepted)
+
+	if stash := waitForStash(t, ds, TestFilePrefix+"failed"); stash.Status != StashFailed || stash.Error != "Very bad dangerous error" {
+		t.Errorf("Expected the stash to record why it failed: %+v", stash)
+	}
+}
+
+// waitForStash polls the stashes status until it has been written
+func waitForStash(t *testing.T, ds *StashServer, name string) *Stash {
+	for i := 0; i < 100; i++ {
+		rr := httptest.NewRecorder()
+		ds.mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stashes/"+name+"/status", nil))
+
+		stash := &Stash{}
+		if err := json.NewDecoder(rr.Body).Decode(stash); err != nil {
+			t.Fatalf("Failed to get stash status: %v", err)
+		}
+
+		if stash.Status != StashStarted {
+			return stash
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Fatalf("Timed out waiting for stash %s", name)
+
+	return nil
+}
+
+func mustPostStash(t *testing.T, ds *StashServer, body string, expectedStatus int) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	ds.mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/stashes", strings.NewReader(body)))
+
+	if rr.Code != expectedStatus {
+		t.Errorf("handler returned wrong status code: got %v want %v: %s", rr.Code, expectedStatus, rr.Body.String())
+	}
+
+	return rr
+}
+
 func TestStashCompletionFunc(t *testing.T) {
 	ds, _, testdir := initTestEnv(t)
 	defer os.RemoveAll(testdir)
 
-	count := 0
-	ds.AddCompletionCallback(func(d *Stash) { count++ })
+	callbacks := make(chan *Stash, 2)
+	ds.AddCompletionCallback(func(d *Stash) { callbacks <- d })
 
 	mustCreateStash(t, ds)
 	time.Sleep(time.Second)
 	mustCreateStash(t, ds)
 
-	// Wait for file IO
+	waitForCallbacks(t, callbacks, 2)
+}
 
-	if count != 2 {
-		t.Errorf("Expected the callback to be called twice")
+// waitForCallbacks waits for completion callbacks, which are called in the
+// background once a stash is written, to send their stashes
+func waitForCallbacks(t *testing.T, callbacks <-chan *Stash, expected int) {
+	for i := 0; i < expected; i++ {
+		select {
+		case <-callbacks:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the callback to be called %d times, got %d", expected, i)
+		}
 	}
 }
 
@@ -268,18 +767,498 @@ func TestLoadingExistingStashes(t *testing.T) {
 	}
 }
 
-func TestMaxStashes(t *testing.T) {
+func TestStashMetadataPersisted(t *testing.T) {
 	ds, _, testdir := initTestEnv(t)
 	defer os.RemoveAll(testdir)
 
-	if numStashes := len(ds.stashes); numStashes != 0 {
-		t.Errorf("expected ds to start with 0 stashes but found: %v", numStashes)
+	ds.SetCollectorInfo("1.0.0", "abc123", "default")
+
+	e := &corev1.Event{Reason: "BackOff", Type: corev1.EventTypeWarning}
+	e.Name = "cb-example.1"
+
+	if _, err := ds.CreateStash(StashOptions{
+		Trigger:      "warnings",
+		Labels:       map[string]string{"severity": "high"},
+		TriggerEvent: e,
+	}); err != nil {
+		t.Fatal(err)
 	}
-	ds.maxStashes = 2
 
-	stashesToTake := 5
+	before := validateGetStashes(t, ds, 1)
 
-	stashNames := make([]string, stashesToTake)
+	for _, stash := range before {
+		if stash.Source != StashSourceTrigger || stash.TriggerEvent == nil || stash.TriggerEvent.Reason != "BackOff" ||
+			stash.CreationTime.IsZero() || stash.Size != int64(len("data")) || stash.CollectorVersion != "1.0.0" || stash.Namespace != "default" {
+			t.Errorf("Expected stash metadata to be recorded: %+v", stash)
+		}
+	}
+
+	// A restarted server loads the same metadata
+	restarted := NewStashServer(&testStasher{"data"}, testdir, 10)
+	restarted.stashPrefix = TestFilePrefix
+	restarted.loadExistingFileStashes()
+
+	after := validateGetStashes(t, restarted, 1)
+	if !reflect.DeepEqual(before, after) {
+		t.Errorf("Expected the same metadata after restarting, before: %+v after: %+v", before, after)
+	}
+}
+
+func TestLoadingLegacyStash(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+
+	legacy := `[{"metadata":{"name":"pod.1"},"reason":"BackOff","lastTimestamp":"2023-01-01T10:00:00Z"}]`
+	if err := os.WriteFile(filepath.Join(testdir, TestFilePrefix+"-legacy.json"), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ds.loadExistingFileStashes()
+
+	loaded, ok := ds.stashes[TestFilePrefix+"-legacy"]
+	if !ok || loaded.Status != StashComplete || loaded.CreationTime.IsZero() {
+		t.Errorf("Expected a stash without metadata to be loaded from its file: %+v", loaded)
+	}
+
+	// Legacy stash files are left as they are
+	if b, err := os.ReadFile(filepath.Join(testdir, TestFilePrefix+"-legacy.json")); err != nil || string(b) != legacy {
+		t.Errorf("Expected the legacy stash file to be unchanged: %s %v", b, err)
+	}
+
+	if !loaded.Legacy || loaded.Size != int64(len(legacy)) {
+		t.Errorf("Expected the legacy stash to be recorded as it is stored: %+v", loaded)
+	}
+
+	if loaded.EventCount != 1 || !loaded.FirstEventTime.Equal(time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)) ||
+		!loaded.LastEventTime.Equal(loaded.FirstEventTime) {
+		t.Errorf("Expected the converted stashes events to be summarised: %+v", loaded)
+	}
+
+	// They are converted to the envelope format when served
+	rr := mustRequest(t, ds, http.MethodGet, "/stashes/"+TestFilePrefix+"-legacy", http.StatusOK)
+
+	envelope, err := stash.Decode(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if envelope.IsLegacy() || envelope.Metadata.Name != loaded.Name || envelope.Metadata.EventCount != 1 ||
+		!envelope.Metadata.LastEventTime.Equal(time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)) || len(envelope.Events) != 1 {
+		t.Errorf("Expected the stash to be converted to an envelope: %+v", envelope)
+	}
+
+	// The legacy format is still available
+	rr = mustRequest(t, ds, http.MethodGet, "/stashes/"+TestFilePrefix+"-legacy?format=legacy", http.StatusOK)
+
+	var events []*corev1.Event
+	if err := json.NewDecoder(rr.Body).Decode(&events); err != nil || len(events) != 1 || events[0].Reason != "BackOff" {
+		t.Errorf("Expected the legacy format to be the events, got: %v %v", events, err)
+	}
+
+	// The legacy stash is valid when loaded again
+	restarted := NewStashServer(&testStasher{"data"}, testdir, 10)
+	restarted.stashPrefix = TestFilePrefix
+	restarted.loadExistingFileStashes()
+
+	if restarted := restarted.stashes[loaded.Name]; restarted.Status != StashComplete || !restarted.Legacy ||
+		restarted.EventCount != 1 || !restarted.LastEventTime.Equal(loaded.LastEventTime) {
+		t.Errorf("Expected the legacy stash to be unchanged after restarting: %+v", restarted)
+	}
+}
+
+func TestGetStashFormats(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+	ds.stasher = &testEncodeStasher{events: []*corev1.Event{{Reason: "BackOff"}, {Reason: "Pulled"}}}
+
+	if _, err := ds.CreateStash(StashOptions{Name: "formats"}); err != nil {
+		t.Fatal(err)
+	}
+
+	url := "/stashes/" + TestFilePrefix + "formats"
+
+	rr := mustRequest(t, ds, http.MethodGet, url+"?format=ndjson", http.StatusOK)
+	if rr.Header().Get("Content-Type") != "application/x-ndjson" || strings.Count(rr.Body.String(), "\n") != 2 {
+		t.Errorf("Expected the stash as NDJSON, got %s: %s", rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, url, nil)
+	request.Header.Set("Accept", "text/csv")
+	ds.mux.ServeHTTP(rr, request)
+
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "text/csv" || !strings.HasPrefix(rr.Body.String(), "LastSeen,") {
+		t.Errorf("Expected the stash as CSV, got %d %s: %s", rr.Code, rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	request = httptest.NewRequest(http.MethodGet, url, nil)
+	request.Header.Set("Accept", "image/png")
+	ds.mux.ServeHTTP(rr, request)
+
+	if rr.Code != http.StatusNotAcceptable {
+		t.Errorf("Expected no acceptable format, got %d", rr.Code)
+	}
+
+	mustRequest(t, ds, http.MethodGet, url+"?format=xml", http.StatusBadRequest)
+}
+
+func TestGetBufferFormats(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+	ds.stasher = &testEncodeStasher{events: []*corev1.Event{{Reason: "BackOff"}}}
+
+	rr := mustRequest(t, ds, http.MethodGet, "/buffer", http.StatusOK)
+
+	var events []*corev1.Event
+	if err := json.NewDecoder(rr.Body).Decode(&events); err != nil || len(events) != 1 {
+		t.Errorf("Expected the buffer to be an array of events by default, got: %v %v", events, err)
+	}
+
+	rr = mustRequest(t, ds, http.MethodGet, "/buffer?format=eventlist", http.StatusOK)
+
+	list := &corev1.EventList{}
+	if err := json.NewDecoder(rr.Body).Decode(list); err != nil || list.Kind != "EventList" || len(list.Items) != 1 {
+		t.Errorf("Expected the buffer as an EventList, got: %+v %v", list, err)
+	}
+}
+
+func TestCompressedStash(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+	ds.stasher = &testEncodeStasher{events: []*corev1.Event{{Reason: "BackOff"}, {Reason: "Pulled"}}}
+
+	if err := ds.SetCompression("zstd"); err == nil {
+		t.Errorf("Expected zstd compression to be unsupported")
+	}
+
+	if err := ds.SetCompression(CompressionGzip); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := ds.CreateStash(StashOptions{Name: "compressed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := os.ReadFile(ds.getStashLocation(stored.Name)); err != nil || !bytes.HasPrefix(b, gzipMagic) || stored.Encoding != CompressionGzip {
+		t.Errorf("Expected the stash to be stored compressed: %+v %v", stored, err)
+	}
+
+	get := func(url, acceptEncoding string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, url, nil)
+		request.Header.Set("Accept-Encoding", acceptEncoding)
+		ds.mux.ServeHTTP(rr, request)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("GET %s returned %d", url, rr.Code)
+		}
+
+		return rr
+	}
+
+	decode := func(rr *httptest.ResponseRecorder) *stash.Envelope {
+		var r io.Reader = rr.Body
+		if rr.Header().Get("Content-Encoding") == CompressionGzip {
+			zr, err := gzip.NewReader(rr.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r = zr
+		}
+
+		e, err := stash.Decode(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return e
+	}
+
+	url := "/stashes/" + stored.Name
+
+	// Clients which accept gzip get the stash as it is stored
+	rr := get(url, "gzip, deflate")
+	if rr.Header().Get("Content-Encoding") != CompressionGzip || rr.Body.Len() != int(stored.Size) || len(decode(rr).Events) != 2 {
+		t.Errorf("Expected the compressed stash, got %v", rr.Header())
+	}
+
+	// Other clients get it decompressed
+	rr = get(url, "")
+	if rr.Header().Get("Content-Encoding") != "" || len(decode(rr).Events) != 2 {
+		t.Errorf("Expected the decompressed stash, got %v", rr.Header())
+	}
+
+	rr = get(url+"?format=legacy", "gzip;q=0")
+	if rr.Header().Get("Content-Encoding") != "" || len(decode(rr).Events) != 2 {
+		t.Errorf("Expected the decompressed stash in the legacy format, got %v", rr.Header())
+	}
+
+	rr = get(url+"?format=legacy", "*")
+	if rr.Header().Get("Content-Encoding") != CompressionGzip || len(decode(rr).Events) != 2 {
+		t.Errorf("Expected the compressed stash in the legacy format, got %v", rr.Header())
+	}
+
+	rr = get("/buffer", "gzip")
+	if rr.Header().Get("Content-Encoding") != CompressionGzip || len(decode(rr).Events) != 2 {
+		t.Errorf("Expected the compressed buffer, got %v", rr.Header())
+	}
+
+	// Compressed stashes are validated when loaded
+	restarted := NewStashServer(&testStasher{"data"}, testdir, 10)
+	restarted.stashPrefix = TestFilePrefix
+	restarted.loadExistingFileStashes()
+
+	if loaded := restarted.stashes[stored.Name]; loaded.Status != StashComplete || loaded.Encoding != CompressionGzip {
+		t.Errorf("Expected the compressed stash to be loaded: %+v", loaded)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := map[string]bool{
+		"":                   false,
+		"gzip":               true,
+		"GZIP":               true,
+		"deflate, gzip":      true,
+		"gzip;q=0":           false,
+		"gzip; q=0.000":      false,
+		"gzip;q=0.5":         true,
+		"gzip;q=invalid":     false,
+		"*":                  true,
+		"*;q=0":              false,
+		"*, gzip;q=0":        false,
+		"gzip;q=0, *":        false,
+		"*;q=0, gzip;q=0.1":  true,
+		"identity, deflate":  false,
+		"br;q=1, gzip;q=0.2": true,
+	}
+
+	for acceptEncoding, expected := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/buffer", nil)
+		request.Header.Set("Accept-Encoding", acceptEncoding)
+
+		if acceptsGzip(request) != expected {
+			t.Errorf("Expected %q to accept gzip: %v", acceptEncoding, expected)
+		}
+	}
+}
+
+func TestGetStashEvents(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+	ds.stasher = &testEncodeStasher{events: queryEvents()}
+
+	if err := ds.SetCompression(CompressionGzip); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ds.CreateStash(StashOptions{Name: "query"}); err != nil {
+		t.Fatal(err)
+	}
+
+	url := "/stashes/" + TestFilePrefix + "query/events"
+
+	rr := mustRequest(t, ds, http.MethodGet, url+"?type=Warning&sort=-time&limit=2&fields=reason,involvedObject.name", http.StatusOK)
+
+	page := &EventsPage{}
+	if err := json.NewDecoder(rr.Body).Decode(page); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []interface{}{
+		map[string]interface{}{"reason": "BackOff", "involvedObject": map[string]interface{}{"name": "app-1"}},
+		map[string]interface{}{"reason": "FailedMount", "involvedObject": map[string]interface{}{"name": "app-1"}},
+	}
+
+	if page.Total != 3 || page.Continue != "2" || !reflect.DeepEqual(page.Events, expected) {
+		t.Errorf("Unexpected page of events: %+v", page)
+	}
+
+	mustRequest(t, ds, http.MethodGet, url+"?sort=colour", http.StatusBadRequest)
+	mustRequest(t, ds, http.MethodPost, url, http.StatusBadRequest)
+	mustRequest(t, ds, http.MethodGet, "/stashes/"+TestFilePrefix+"missing/events", http.StatusNotFound)
+}
+
+// blockingResponseWriter is a slow client, writes block until it is released
+type blockingResponseWriter struct {
+	*httptest.ResponseRecorder
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingResponseWriter) Write(b []byte) (int, error) {
+	select {
+	case w.writing <- struct{}{}:
+	default:
+	}
+
+	<-w.release
+
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestSlowClientDoesNotBlockStashes(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+	ds.stasher = &testEncodeStasher{events: []*corev1.Event{{Reason: "BackOff"}}}
+
+	if _, err := ds.CreateStash(StashOptions{Name: "served"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{"", "?format=csv"} {
+		rw := &blockingResponseWriter{httptest.NewRecorder(), make(chan struct{}, 1), make(chan struct{})}
+		served := make(chan struct{})
+
+		go func() {
+			ds.mux.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/stashes/"+TestFilePrefix+"served"+format, nil))
+			close(served)
+		}()
+
+		<-rw.writing
+
+		created := make(chan error)
+		go func() {
+			_, err := ds.CreateStash(StashOptions{})
+			created <- err
+		}()
+
+		select {
+		case err := <-created:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(5 * time.Second):
+			close(rw.release)
+			t.Fatalf("Expected a stash to be written while a stash%s is served to a slow client", format)
+		}
+
+		mustRequest(t, ds, http.MethodGet, "/stashes", http.StatusOK)
+
+		close(rw.release)
+		<-served
+	}
+}
+
+func TestStashEnvelope(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+	ds.SetCollectorInfo("1.0.0", "abc123", "default")
+
+	stasher := &testScopeStasher{}
+	ds.stasher = stasher
+
+	since := time.Now().Add(-time.Hour)
+	filter := filters.NewFilterSet("stashRequest", "", []config.KubernetesResourceFilter{{Resource: "Pod", Name: "pod"}}, nil)
+
+	if _, err := ds.CreateStash(StashOptions{Name: "enveloped", Trigger: "oom", Scope: stash.Scope{Since: since, Filter: filter}}); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := stasher.scope.Envelope
+	if metadata == nil {
+		t.Fatal("Expected the stash to be written in an envelope")
+	}
+
+	expected := &stash.EnvelopeFilter{Since: &since, Resources: []stash.EnvelopeResourceFilter{{Resource: "Pod", Name: "pod"}}}
+	if metadata.Name != TestFilePrefix+"enveloped" || metadata.CollectorVersion != "1.0.0" || metadata.ConfigHash != "abc123" ||
+		metadata.Namespace != "default" || metadata.Trigger != "oom" || !reflect.DeepEqual(metadata.Filter, expected) {
+		t.Errorf("Expected the envelope metadata to describe the stash: %+v", metadata)
+	}
+}
+
+func TestCorruptStashesFailed(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+
+	for _, name := range []string{"intact", "truncated"} {
+		if _, err := ds.CreateStash(StashOptions{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.WriteFile(ds.getStashLocation(TestFilePrefix+"truncated"), []byte("da"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stashes without a checksum are validated by parsing them
+	if err := os.WriteFile(filepath.Join(testdir, TestFilePrefix+"-legacy.json"), []byte(`[{"metadata":`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := NewStashServer(&testStasher{"data"}, testdir, 10)
+	restarted.stashPrefix = TestFilePrefix
+	restarted.loadExistingFileStashes()
+
+	stashes := validateGetStashes(t, restarted, 3)
+	if stash := stashes[TestFilePrefix+"intact"]; stash.Status != StashComplete {
+		t.Errorf("Expected the intact stash to be complete: %+v", stash)
+	}
+
+	for _, name := range []string{"truncated", "-legacy"} {
+		if stash := stashes[TestFilePrefix+name]; stash.Status != StashFailed || !strings.Contains(stash.Error, ErrStashCorrupt.Error()) {
+			t.Errorf("Expected the corrupt stash to be failed: %+v", stash)
+		}
+
+		mustRequest(t, restarted, http.MethodGet, "/stashes/"+TestFilePrefix+name, http.StatusNotFound)
+	}
+}
+
+func TestPartialStashesRemoved(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+	ds.stasher = &testErrorStasher{}
+
+	if _, err := ds.CreateStash(StashOptions{Name: "failed"}); err == nil {
+		t.Errorf("Expected the stash to fail")
+	}
+
+	if _, err := os.Stat(ds.getMetadataLocation(TestFilePrefix + "failed")); !os.IsNotExist(err) {
+		t.Errorf("Expected no metadata to be saved for the failed stash")
+	}
+
+	// A stash left partially written by a crash is removed at startup
+	partial := filepath.Join(testdir, TestFilePrefix+"crashed"+stashFileExtension+tempFileExtension)
+	if err := os.WriteFile(partial, []byte("da"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// As is metadata left without its stash
+	if err := os.WriteFile(ds.getMetadataLocation(TestFilePrefix+"orphaned"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := NewStashServer(&testStasher{"data"}, testdir, 10)
+	restarted.stashPrefix = TestFilePrefix
+	restarted.loadExistingFileStashes()
+
+	entries, err := os.ReadDir(testdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), stashFileExtension) || strings.HasSuffix(entry.Name(), tempFileExtension) ||
+			strings.HasSuffix(entry.Name(), metadataFileExtension) {
+			t.Errorf("Expected no partial stash files, found %s", entry.Name())
+		}
+	}
+}
+
+func TestMaxStashes(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+
+	if numStashes := len(ds.stashes); numStashes != 0 {
+		t.Errorf("expected ds to start with 0 stashes but found: %v", numStashes)
+	}
+	ds.maxStashes = 2
+
+	stashesToTake := 5
+
+	stashNames := make([]string, stashesToTake)
 	for i := 0; i < stashesToTake; i++ {
 		time.Sleep(time.Second)
 		rr := mustCreateStash(t, ds)
@@ -293,17 +1272,359 @@ func TestMaxStashes(t *testing.T) {
 
 }
 
+func TestFilterDryRun(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+
+	ds.AddFilterSet(filters.NewFilterSet("warnings", corev1.EventTypeWarning, nil, nil))
+
+	body, _ := json.Marshal(corev1.Event{Type: corev1.EventTypeWarning})
+	result := mustTestFilters(t, ds, "/filters/test", bytes.NewReader(body), http.StatusOK)
+
+	if len(result.Results) != 1 || !result.Results[0].Matched {
+		t.Errorf("Expected warning event to match: %+v", result.Results)
+	}
+
+	var stats []filters.FilterSetStats
+	rr := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "/filters", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds.mux.ServeHTTP(rr, request)
+	json.NewDecoder(rr.Result().Body).Decode(&stats)
+
+	if len(stats) != 1 || stats[0].Counters.Accepted != 0 {
+		t.Errorf("Expected dry run not to affect counters: %+v", stats)
+	}
+}
+
+func TestFilterDryRunBufferedEvent(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+
+	e := &corev1.Event{Type: corev1.EventTypeNormal}
+	e.UID = "abc"
+	ds.stasher = &testEventStasher{events: []*corev1.Event{e}}
+	ds.AddFilterSet(filters.NewFilterSet("warnings", corev1.EventTypeWarning, nil, nil))
+
+	result := mustTestFilters(t, ds, "/filters/test?uid=abc", nil, http.StatusOK)
+
+	if len(result.Results) != 1 || result.Results[0].Matched {
+		t.Errorf("Expected normal event not to match: %+v", result.Results)
+	}
+
+	mustTestFilters(t, ds, "/filters/test?uid=missing", nil, http.StatusNotFound)
+}
+
+func mustTestFilters(t *testing.T, ds *StashServer, url string, body io.Reader, expectedStatus int) FilterTestResult {
+	rr := httptest.NewRecorder()
+	request, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds.mux.ServeHTTP(rr, request)
+
+	if status := rr.Code; status != expectedStatus {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, expectedStatus)
+	}
+
+	var result FilterTestResult
+	json.NewDecoder(rr.Result().Body).Decode(&result)
+	return result
+}
+
+func TestScheduledStashRetention(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+	ds.maxStashes = 2
+	ds.SetTriggerRetention("schedule/baseline", RetentionPolicy{MaxStashes: 1})
+
+	for i := 0; i < 3; i++ {
+		if _, err := ds.CreateStash(StashOptions{Name: fmt.Sprintf("incident-%v", i)}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := ds.CreateStash(StashOptions{
+			Name:      fmt.Sprintf("scheduled-%v", i),
+			Trigger:   "schedule/baseline",
+			Scheduled: true,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stashes := validateGetStashes(t, ds, 3)
+
+	for _, name := range []string{"incident-1", "incident-2", "scheduled-2"} {
+		if _, ok := stashes[TestFilePrefix+name]; !ok {
+			t.Errorf("Expected stash %s to be retained, found: %v", name, stashes)
+		}
+	}
+
+	if !stashes[TestFilePrefix+"scheduled-2"].Scheduled {
+		t.Errorf("Expected scheduled stash to be tagged as scheduled")
+	}
+}
+
+func TestRetentionByCreationTime(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+	ds.maxStashes = 1
+
+	for _, name := range []string{"b", "a"} {
+		if _, err := ds.CreateStash(StashOptions{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The newest stash is kept even though it sorts first by name
+	stashes := validateGetStashes(t, ds, 1)
+	if _, ok := stashes[TestFilePrefix+"a"]; !ok {
+		t.Errorf("Expected the newest stash to be retained, found: %v", stashes)
+	}
+}
+
+func TestTriggerRetention(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+	ds.maxStashes = 2
+	ds.SetMaxStashAge(time.Hour)
+	ds.SetTriggerRetention("oom", RetentionPolicy{MaxStashes: 1})
+	ds.SetTriggerRetention("warnings", RetentionPolicy{MaxAge: time.Minute})
+
+	for i := 0; i < 2; i++ {
+		for _, trigger := range []string{"oom", "warnings", ""} {
+			if _, err := ds.CreateStash(StashOptions{Name: fmt.Sprintf("stash-%s-%d", trigger, i), Trigger: trigger}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// The oom stashes are retained separately, the others share maxStashes
+	stashes := validateGetStashes(t, ds, 3)
+	for _, name := range []string{"stash-oom-1", "stash-warnings-1", "stash--1"} {
+		if _, ok := stashes[TestFilePrefix+name]; !ok {
+			t.Errorf("Expected stash %s to be retained, found: %v", name, stashes)
+		}
+	}
+
+	ds.stashesMutex.Lock()
+	ds.stashes[TestFilePrefix+"stash-warnings-1"].CreationTime = time.Now().Add(-2 * time.Minute)
+	ds.stashes[TestFilePrefix+"stash--1"].CreationTime = time.Now().Add(-2 * time.Minute)
+	ds.purgeStashes()
+	ds.stashesMutex.Unlock()
+
+	// Only the warnings stash is older than its maximum age
+	stashes = validateGetStashes(t, ds, 2)
+	if _, ok := stashes[TestFilePrefix+"stash-warnings-1"]; ok {
+		t.Errorf("Expected the expired stash to be removed, found: %v", stashes)
+	}
+
+	ds.stashesMutex.Lock()
+	ds.stashes[TestFilePrefix+"stash--1"].CreationTime = time.Now().Add(-2 * time.Hour)
+	ds.purgeStashes()
+	ds.stashesMutex.Unlock()
+
+	validateGetStashes(t, ds, 1)
+}
+
+func TestDeleteStash(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+
+	if _, err := ds.CreateStash(StashOptions{Name: "investigating"}); err != nil {
+		t.Fatal(err)
+	}
+
+	name := TestFilePrefix + "investigating"
+
+	if rr := mustRequest(t, ds, http.MethodPost, "/stashes/"+name+"/pin", http.StatusOK); !strings.Contains(rr.Body.String(), `"Pinned":true`) {
+		t.Errorf("Expected the pinned stash to be returned: %s", rr.Body.String())
+	}
+
+	mustRequest(t, ds, http.MethodDelete, "/stashes/"+name, http.StatusConflict)
+	mustRequest(t, ds, http.MethodPost, "/stashes/"+name+"/unpin", http.StatusOK)
+	mustRequest(t, ds, http.MethodDelete, "/stashes/"+name, http.StatusNoContent)
+	mustRequest(t, ds, http.MethodDelete, "/stashes/"+name, http.StatusNotFound)
+	mustRequest(t, ds, http.MethodPost, "/stashes/"+name+"/pin", http.StatusNotFound)
+
+	validateStashCreated(t, 0, testdir)
+
+	if _, err := os.Stat(ds.getMetadataLocation(name)); !os.IsNotExist(err) {
+		t.Errorf("Expected the stash metadata to be deleted")
+	}
+}
+
+func TestPinnedStashRetained(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+	ds.maxStashes = 1
+
+	if _, err := ds.CreateStash(StashOptions{Name: "investigating"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ds.PinStash(TestFilePrefix+"investigating", true); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := ds.CreateStash(StashOptions{Name: fmt.Sprintf("later-%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stashes := validateGetStashes(t, ds, 2)
+	if !stashes[TestFilePrefix+"investigating"].Pinned {
+		t.Errorf("Expected the pinned stash to be retained, found: %v", stashes)
+	}
+
+	// Pins are persisted in the stashes metadata
+	restarted := NewStashServer(&testStasher{"data"}, testdir, 1)
+	restarted.stashPrefix = TestFilePrefix
+	restarted.loadExistingFileStashes()
+
+	if !restarted.stashes[TestFilePrefix+"investigating"].Pinned {
+		t.Errorf("Expected the stash to still be pinned after restarting")
+	}
+
+	// Unpinning applies retention to the stash again
+	if _, err := ds.PinStash(TestFilePrefix+"investigating", false); err != nil {
+		t.Fatal(err)
+	}
+
+	validateGetStashes(t, ds, 1)
+}
+
+func TestStashQuota(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+	ds.SetStashQuota(10)
+
+	for i := 0; i < 3; i++ {
+		if _, err := ds.CreateStash(StashOptions{Name: fmt.Sprintf("stash-%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each stash is 4 bytes so the oldest is evicted to make room
+	stashes := validateGetStashes(t, ds, 2)
+	if _, ok := stashes[TestFilePrefix+"stash-0"]; ok {
+		t.Errorf("Expected the oldest stash to be evicted, found: %v", stashes)
+	}
+
+	validateStashCreated(t, 2, testdir)
+}
+
+func TestPinnedStashesExceedQuota(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+	ds.SetStashQuota(6)
+
+	if _, err := ds.CreateStash(StashOptions{Name: "investigating"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ds.PinStash(TestFilePrefix+"investigating", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pinned stash can't be evicted so there is no room for another
+	stash, err := ds.CreateStash(StashOptions{Name: "later"})
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected the stash to exceed the quota, got: %v", err)
+	}
+
+	failed := waitForStash(t, ds, TestFilePrefix+"later")
+	if stash.Status != StashFailed || failed.Status != StashFailed || !strings.Contains(failed.Error, ErrQuotaExceeded.Error()) {
+		t.Errorf("Expected the failure reason to be recorded: %+v", failed)
+	}
+
+	validateStashCreated(t, 1, testdir)
+}
+
+func TestStashesKeptWhenEvictingCantMakeRoom(t *testing.T) {
+	ds, _, testdir := initTestEnv(t)
+	defer os.RemoveAll(testdir)
+	ds.SetStashQuota(12)
+
+	for _, name := range []string{"investigating", "older", "newer"} {
+		if _, err := ds.CreateStash(StashOptions{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := ds.PinStash(TestFilePrefix+"investigating", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Even evicting both unpinned stashes leaves no room within the quota
+	ds.stashesMutex.Lock()
+	ds.lastStashSize = 9
+	ds.stashesMutex.Unlock()
+
+	if _, err := ds.CreateStash(StashOptions{Name: "quota"}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected the stash to exceed the quota, got: %v", err)
+	}
+
+	validateStashCreated(t, 3, testdir)
+
+	// Nor in the stash directory
+	ds.SetStashQuota(0)
+	ds.stashesMutex.Lock()
+	ds.lastStashSize = math.MaxInt64
+	ds.stashesMutex.Unlock()
+
+	if _, err := ds.CreateStash(StashOptions{Name: "space"}); !errors.Is(err, ErrInsufficientSpace) {
+		t.Errorf("Expected the stash to have insufficient space, got: %v", err)
+	}
+
+	validateStashCreated(t, 3, testdir)
+}
+
+func TestStashDirCreated(t *testing.T) {
+	dir, err := os.MkdirTemp("", "testtmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stashDir := filepath.Join(dir, "stashes")
+	ds := NewStashServer(&testStasher{"data"}, stashDir, 10)
+	ds.stashPrefix = TestFilePrefix
+
+	if _, err := ds.CreateStash(StashOptions{Name: "configured"}); err != nil {
+		t.Fatal(err)
+	}
+
+	validateStashCreated(t, 1, stashDir)
+}
+
+func mustRequest(t *testing.T, ds *StashServer, method, url string, expectedStatus int) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	ds.mux.ServeHTTP(rr, httptest.NewRequest(method, url, nil))
+
+	if rr.Code != expectedStatus {
+		t.Errorf("%s %s returned wrong status code: got %v want %v", method, url, rr.Code, expectedStatus)
+	}
+
+	return rr
+}
+
 func initTestEnv(t *testing.T) (*StashServer, *testStasher, string) {
 	logf.SetLogger(zap.New(zap.UseDevMode(true)))
 
 	testStasher := &testStasher{"data"}
-	ds := NewStashServer(testStasher, 10)
 	dir, err := os.MkdirTemp("", "testtmp")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	ds.stashDir = dir
+	ds := NewStashServer(testStasher, dir, 10)
 	ds.stashPrefix = TestFilePrefix
 	return ds, testStasher, dir
 }
@@ -330,7 +1651,7 @@ func validateStashCreated(t *testing.T, expectedNumStashes int, dir string) {
 
 	filesFound := 0
 	for _, entry := range entries {
-		if !entry.IsDir() && strings.HasPrefix(entry.Name(), TestFilePrefix) {
+		if !entry.IsDir() && strings.HasPrefix(entry.Name(), TestFilePrefix) && strings.HasSuffix(entry.Name(), stashFileExtension) {
 			filesFound++
 		}
 	}
@@ -0,0 +1,345 @@
+package triggers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ReasonAlertFiring is the reason of synthetic events for firing alerts
+const ReasonAlertFiring = "AlertFiring"
+
+// SignatureHeader is the header of HMAC-SHA256 signed notifications, the
+// value is "sha256=" followed by the hex encoded signature of the body
+const SignatureHeader = "X-Signature-256"
+
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+const defaultDedupeWindow = 24 * time.Hour
+
+// maxNotificationSize limits the size of notification bodies, which are read
+// before they're verified
+const maxNotificationSize = 4 << 20
+
+// Alert is an alert in an Alertmanager webhook notification
+type Alert struct {
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint"`
+}
+
+// AlertNotification is an Alertmanager webhook notification
+type AlertNotification struct {
+	Version           string            `json:"version"`
+	GroupKey          string            `json:"groupKey"`
+	Status            string            `json:"status"`
+	Receiver          string            `json:"receiver"`
+	GroupLabels       map[string]string `json:"groupLabels"`
+	CommonLabels      map[string]string `json:"commonLabels"`
+	CommonAnnotations map[string]string `json:"commonAnnotations"`
+	ExternalURL       string            `json:"externalURL"`
+	Alerts            []Alert           `json:"alerts"`
+}
+
+// AlertFireFunc is called for each alert which triggers a stash with the
+// synthetic event recorded for it
+type AlertFireFunc func(alert Alert, in *corev1.Event)
+
+// LabelMatcher is an Alertmanager style label matcher
+type LabelMatcher struct {
+	Name  string
+	Value string
+	Equal bool
+	regex *regexp.Regexp
+}
+
+var matcherRegexp = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*(=~|!~|!=|=)\s*(.*?)\s*$`)
+
+// ParseLabelMatcher parses a matcher such as severity="critical", the
+// operators =, !=, =~ and !~ are supported and regexes are fully anchored
+func ParseLabelMatcher(s string) (*LabelMatcher, error) {
+	parts := matcherRegexp.FindStringSubmatch(s)
+	if parts == nil {
+		return nil, fmt.Errorf("invalid label matcher %q", s)
+	}
+
+	m := &LabelMatcher{
+		Name:  parts[1],
+		Value: parts[3],
+		Equal: parts[2] == "=" || parts[2] == "=~",
+	}
+
+	if len(m.Value) >= 2 && strings.HasPrefix(m.Value, `"`) && strings.HasSuffix(m.Value, `"`) {
+		m.Value = m.Value[1 : len(m.Value)-1]
+	}
+
+	if strings.HasSuffix(parts[2], "~") {
+		regex, err := regexp.Compile("^(?:" + m.Value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex in label matcher %q: %w", s, err)
+		}
+
+		m.regex = regex
+	}
+
+	return m, nil
+}
+
+// Matches returns whether the labels match, missing labels match as empty
+func (m *LabelMatcher) Matches(labels map[string]string) bool {
+	value := labels[m.Name]
+
+	if m.regex != nil {
+		return m.regex.MatchString(value) == m.Equal
+	}
+
+	return (value == m.Value) == m.Equal
+}
+
+// AlertReceiver is an Alertmanager webhook receiver which triggers for firing
+// alerts matching all its label matchers. Alerts are deduplicated by their
+// fingerprint so repeated notifications for the same alert only trigger once.
+// A synthetic event describing the alert is recorded in the buffer before
+// triggering.
+type AlertReceiver struct {
+	Name string
+
+	matchers     []*LabelMatcher
+	secret       []byte
+	dedupeWindow time.Duration
+	recorder     EventRecorder
+	fire         AlertFireFunc
+
+	mx   sync.Mutex
+	seen map[string]time.Time
+}
+
+// NewAlertReceiver creates a new AlertReceiver
+func NewAlertReceiver(cfg config.AlertmanagerConfiguration, recorder EventRecorder, fire AlertFireFunc) (*AlertReceiver, error) {
+	if cfg.Name == "" {
+		cfg.Name = "alertmanager"
+	}
+
+	if cfg.DedupeWindow <= 0 {
+		cfg.DedupeWindow = defaultDedupeWindow
+	}
+
+	r := &AlertReceiver{
+		Name:         cfg.Name,
+		secret:       []byte(cfg.Secret),
+		dedupeWindow: cfg.DedupeWindow,
+		recorder:     recorder,
+		fire:         fire,
+		seen:         make(map[string]time.Time),
+	}
+
+	if cfg.SecretFile != "" {
+		secret, err := os.ReadFile(cfg.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read alertmanager secret: %w", err)
+		}
+
+		r.secret = []byte(strings.TrimSpace(string(secret)))
+	}
+
+	for _, s := range cfg.Matchers {
+		m, err := ParseLabelMatcher(s)
+		if err != nil {
+			return nil, err
+		}
+
+		r.matchers = append(r.matchers, m)
+	}
+
+	return r, nil
+}
+
+// ServeHTTP handles webhook notifications
+func (r *AlertReceiver) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(rw, req.Body, maxNotificationSize))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			rw.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !r.verify(req, body) {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	notification := AlertNotification{}
+	if err := json.Unmarshal(body, &notification); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	r.Handle(notification)
+
+	rw.WriteHeader(http.StatusOK)
+}
+
+// verify checks the notification has the secret as a bearer token or is
+// signed with it, any notification is accepted if there is no secret
+func (r *AlertReceiver) verify(req *http.Request, body []byte) bool {
+	if len(r.secret) == 0 {
+		return true
+	}
+
+	if token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok {
+		return subtle.ConstantTimeCompare([]byte(token), r.secret) == 1
+	}
+
+	if signature, ok := strings.CutPrefix(req.Header.Get(SignatureHeader), "sha256="); ok {
+		expected := hmac.New(sha256.New, r.secret)
+		expected.Write(body)
+
+		actual, err := hex.DecodeString(signature)
+		if err != nil {
+			return false
+		}
+
+		return hmac.Equal(actual, expected.Sum(nil))
+	}
+
+	return false
+}
+
+// Handle triggers for each new firing alert in the notification which
+// matches, resolved alerts are forgotten so they trigger again if they refire.
+// Stashes are fired asynchronously so the notification isn't held up while
+// they're written.
+func (r *AlertReceiver) Handle(notification AlertNotification) {
+	for _, alert := range notification.Alerts {
+		if alert.Fingerprint == "" {
+			alert.Fingerprint = fingerprint(alert.Labels)
+		}
+
+		if alert.Status == alertResolved {
+			r.forget(alert.Fingerprint)
+			continue
+		}
+
+		if alert.Status != alertFiring || !r.matches(alert) || !r.firstSeen(alert.Fingerprint) {
+			continue
+		}
+
+		e := newAlertEvent(alert)
+
+		log.Info("Firing alert received", "trigger", r.Name, "alert", alert.Labels["alertname"], "fingerprint", alert.Fingerprint)
+
+		if r.recorder != nil {
+			r.recorder.RecordEvent(e)
+		}
+
+		go r.fire(alert, e)
+	}
+}
+
+func (r *AlertReceiver) matches(alert Alert) bool {
+	for _, m := range r.matchers {
+		if !m.Matches(alert.Labels) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// firstSeen records the alert as seen, returning whether it wasn't already
+// seen within the dedupe window
+func (r *AlertReceiver) firstSeen(fingerprint string) bool {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	now := time.Now()
+	for fp, seen := range r.seen {
+		if now.Sub(seen) >= r.dedupeWindow {
+			delete(r.seen, fp)
+		}
+	}
+
+	if _, seen := r.seen[fingerprint]; seen {
+		return false
+	}
+
+	r.seen[fingerprint] = now
+
+	return true
+}
+
+func (r *AlertReceiver) forget(fingerprint string) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	delete(r.seen, fingerprint)
+}
+
+// fingerprint identifies an alert by its labels, for notifications from
+// Alertmanager versions which don't include the fingerprint
+func fingerprint(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s\xff%s\xff", name, labels[name])
+	}
+
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+func newAlertEvent(alert Alert) *corev1.Event {
+	ref := corev1.ObjectReference{
+		Kind:      "Alert",
+		Name:      alert.Labels["alertname"],
+		Namespace: alert.Labels["namespace"],
+	}
+
+	msg := fmt.Sprintf("Alert %s is firing", alert.Labels["alertname"])
+
+	if summary := alert.Annotations["summary"]; summary != "" {
+		msg += ": " + summary
+	} else if description := alert.Annotations["description"]; description != "" {
+		msg += ": " + description
+	}
+
+	return NewSyntheticEvent(ref, corev1.EventTypeWarning, ReasonAlertFiring, msg)
+}
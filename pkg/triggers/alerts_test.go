@@ -0,0 +1,247 @@
+package triggers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func createAlert(status, fingerprint, severity string) Alert {
+	return Alert{
+		Status: status,
+		Labels: map[string]string{
+			"alertname": "CouchbaseNodeDown",
+			"namespace": "default",
+			"severity":  severity,
+		},
+		Annotations: map[string]string{
+			"summary": "A Couchbase node is down",
+		},
+		Fingerprint: fingerprint,
+	}
+}
+
+func initTestAlertReceiver(t *testing.T, cfg config.AlertmanagerConfiguration) (*AlertReceiver, *testRecorder, chan Alert) {
+	recorder := &testRecorder{}
+	fired := make(chan Alert, 10)
+
+	r, err := NewAlertReceiver(cfg, recorder, func(alert Alert, _ *corev1.Event) {
+		fired <- alert
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r, recorder, fired
+}
+
+// waitForAlerts waits for n alerts to be fired, failing if any more are
+func waitForAlerts(t *testing.T, fired chan Alert, n int) []Alert {
+	var alerts []Alert
+	for len(alerts) < n {
+		select {
+		case alert := <-fired:
+			alerts = append(alerts, alert)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %d triggers, got %d", n, len(alerts))
+		}
+	}
+
+	select {
+	case alert := <-fired:
+		t.Fatalf("expected %d triggers, got another for %v", n, alert.Fingerprint)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	return alerts
+}
+
+func postNotification(r http.Handler, notification AlertNotification, headers map[string]string) int {
+	body, _ := json.Marshal(notification)
+
+	req := httptest.NewRequest(http.MethodPost, "/alertmanager", bytes.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, req)
+
+	return rw.Code
+}
+
+func TestLabelMatchers(t *testing.T) {
+	labels := map[string]string{"severity": "critical", "namespace": "default"}
+
+	tests := map[string]bool{
+		`severity="critical"`:         true,
+		`severity=warning`:            false,
+		`severity!=warning`:           true,
+		`severity=~"critical|page"`:   true,
+		`severity=~crit`:              false,
+		`namespace!~"kube-.*"`:        true,
+		`cluster=""`:                  true,
+		` severity = "critical" `:     true,
+		`namespace=~"default|other"`:  true,
+		`namespace!~"default|other"`:  false,
+		`severity!="critical"`:        false,
+		`missing!~".+"`:               true,
+		`severity=~"(critical|page)"`: true,
+	}
+
+	for s, expected := range tests {
+		m, err := ParseLabelMatcher(s)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", s, err)
+		}
+
+		if m.Matches(labels) != expected {
+			t.Errorf("expected %q to match %v", s, expected)
+		}
+	}
+
+	if _, err := ParseLabelMatcher("severity"); err == nil {
+		t.Fatal("expected an invalid matcher to fail to parse")
+	}
+}
+
+func TestAlertReceiverMatchers(t *testing.T) {
+	r, recorder, fired := initTestAlertReceiver(t, config.AlertmanagerConfiguration{
+		Matchers: []string{`severity="critical"`},
+	})
+
+	code := postNotification(r, AlertNotification{
+		Alerts: []Alert{
+			createAlert(alertFiring, "a", "critical"),
+			createAlert(alertFiring, "b", "warning"),
+			createAlert(alertResolved, "c", "critical"),
+		},
+	}, nil)
+
+	if code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, code)
+	}
+
+	if alerts := waitForAlerts(t, fired, 1); alerts[0].Fingerprint != "a" {
+		t.Fatalf("expected only the matching firing alert to trigger, got %v", alerts)
+	}
+
+	if len(recorder.events) != 1 || recorder.events[0].Reason != ReasonAlertFiring {
+		t.Fatalf("expected a synthetic alert event, got %v", recorder.events)
+	}
+}
+
+func TestAlertReceiverDedupe(t *testing.T) {
+	r, _, fired := initTestAlertReceiver(t, config.AlertmanagerConfiguration{})
+
+	firing := AlertNotification{Alerts: []Alert{createAlert(alertFiring, "a", "critical")}}
+
+	r.Handle(firing)
+	r.Handle(firing)
+
+	// Repeated notifications trigger once
+	waitForAlerts(t, fired, 1)
+
+	// Once resolved the alert triggers again if it refires
+	r.Handle(AlertNotification{Alerts: []Alert{createAlert(alertResolved, "a", "critical")}})
+	r.Handle(firing)
+
+	waitForAlerts(t, fired, 1)
+
+	// Alerts without fingerprints are deduplicated by their labels
+	unfingerprinted := AlertNotification{Alerts: []Alert{createAlert(alertFiring, "", "warning")}}
+
+	r.Handle(unfingerprinted)
+	r.Handle(unfingerprinted)
+
+	waitForAlerts(t, fired, 1)
+}
+
+func TestAlertReceiverSecret(t *testing.T) {
+	r, _, fired := initTestAlertReceiver(t, config.AlertmanagerConfiguration{
+		Secret: "s3cret",
+	})
+
+	notification := AlertNotification{Alerts: []Alert{createAlert(alertFiring, "a", "critical")}}
+
+	if code := postNotification(r, notification, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected %d without credentials, got %d", http.StatusUnauthorized, code)
+	}
+
+	if code := postNotification(r, notification, map[string]string{"Authorization": "Bearer wrong"}); code != http.StatusUnauthorized {
+		t.Fatalf("expected %d with the wrong token, got %d", http.StatusUnauthorized, code)
+	}
+
+	if code := postNotification(r, notification, map[string]string{"Authorization": "Bearer s3cret"}); code != http.StatusOK {
+		t.Fatalf("expected %d with the token, got %d", http.StatusOK, code)
+	}
+
+	body, _ := json.Marshal(notification)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+
+	notification.Alerts[0].Fingerprint = "b"
+	if code := postNotification(r, notification, map[string]string{SignatureHeader: "sha256=" + hex.EncodeToString(mac.Sum(nil))}); code != http.StatusUnauthorized {
+		t.Fatalf("expected %d with a signature of a different body, got %d", http.StatusUnauthorized, code)
+	}
+
+	body, _ = json.Marshal(notification)
+	mac.Reset()
+	mac.Write(body)
+
+	if code := postNotification(r, notification, map[string]string{SignatureHeader: "sha256=" + hex.EncodeToString(mac.Sum(nil))}); code != http.StatusOK {
+		t.Fatalf("expected %d with a valid signature, got %d", http.StatusOK, code)
+	}
+
+	waitForAlerts(t, fired, 2)
+}
+
+func TestAlertReceiverBodyLimit(t *testing.T) {
+	r, _, fired := initTestAlertReceiver(t, config.AlertmanagerConfiguration{})
+
+	req := httptest.NewRequest(http.MethodPost, "/alertmanager", bytes.NewReader(make([]byte, maxNotificationSize+1)))
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected %d, got %d", http.StatusRequestEntityTooLarge, rw.Code)
+	}
+
+	waitForAlerts(t, fired, 0)
+}
+
+func TestAlertReceiverFiresAsync(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	r, err := NewAlertReceiver(config.AlertmanagerConfiguration{}, nil, func(Alert, *corev1.Event) {
+		<-release
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan int)
+	go func() {
+		done <- postNotification(r, AlertNotification{Alerts: []Alert{createAlert(alertFiring, "a", "critical")}}, nil)
+	}()
+
+	select {
+	case code := <-done:
+		if code != http.StatusOK {
+			t.Fatalf("expected %d, got %d", http.StatusOK, code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the notification to be handled without waiting for the stash")
+	}
+}
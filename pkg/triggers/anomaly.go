@@ -0,0 +1,318 @@
+package triggers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	"github.com/couchbase/k8s-event-collector/pkg/filters"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ReasonEventRateAnomaly is the reason of synthetic events for event rates
+// which deviate from their baseline
+const ReasonEventRateAnomaly = "EventRateAnomaly"
+
+const (
+	defaultAnomalyInterval   = time.Minute
+	defaultAnomalyWindow     = time.Hour
+	defaultAnomalyThreshold  = 3
+	defaultAnomalyMinSamples = 10
+	defaultAnomalyMinEvents  = 5
+	defaultAnomalyMaxGroups  = 1000
+)
+
+// minStdDev stops groups with a perfectly steady rate having an infinite
+// z-score for any change
+const minStdDev = 1
+
+// RateBaseline is the learnt event rate of a group
+type RateBaseline struct {
+	Key string
+	// Mean and StdDev are the exponentially weighted moving average and
+	// standard deviation of events per interval
+	Mean   float64
+	StdDev float64
+	// Samples is the number of intervals the baseline has been learnt over
+	Samples int
+	// Current is the number of events so far in the current interval
+	Current int
+	// LastRate and LastScore are the rate and z-score of the last interval
+	LastRate  int
+	LastScore float64
+	Anomalous bool
+}
+
+// AnomalyDetectorState is the state of an anomaly detector
+type AnomalyDetectorState struct {
+	Name       string
+	GroupBy    string
+	Interval   string
+	Threshold  float64
+	MinSamples int
+	MinEvents  int
+	Groups     []RateBaseline
+}
+
+type rateGroup struct {
+	baseline RateBaseline
+	variance float64
+	last     corev1.ObjectReference
+	// active is the interval the group last had events in
+	active int
+}
+
+// AnomalyDetector learns a baseline rate of matching events for each group
+// using an exponentially weighted moving average, and triggers when the rate
+// in an interval has a z-score above the threshold. A synthetic event
+// describing the anomaly is recorded in the buffer before triggering.
+type AnomalyDetector struct {
+	Name   string
+	Filter *filters.FilterSet
+
+	cfg      config.AnomalyDetectionConfiguration
+	alpha    float64
+	recorder EventRecorder
+	limiter  *Limiter
+
+	mx sync.Mutex
+	// intervals is the number of intervals measured, groups without a
+	// baseline have had no events over them
+	intervals int
+	groups    map[string]*rateGroup
+	seen      map[types.UID]occurrence
+}
+
+// NewAnomalyDetector creates a new AnomalyDetector
+func NewAnomalyDetector(cfg config.AnomalyDetectionConfiguration, defaultLimits *config.TriggerLimitsConfiguration, kubeClient kubernetes.Interface, recorder EventRecorder, fire FireFunc) *AnomalyDetector {
+	if cfg.Name == "" {
+		cfg.Name = "anomalyDetection"
+	}
+
+	if cfg.GroupBy == "" {
+		cfg.GroupBy = GroupByReason
+	}
+
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultAnomalyInterval
+	}
+
+	if cfg.Window < cfg.Interval {
+		cfg.Window = defaultAnomalyWindow
+	}
+
+	if cfg.Threshold <= 0 {
+		cfg.Threshold = defaultAnomalyThreshold
+	}
+
+	if cfg.MinSamples <= 0 {
+		cfg.MinSamples = defaultAnomalyMinSamples
+	}
+
+	if cfg.MinEvents <= 0 {
+		cfg.MinEvents = defaultAnomalyMinEvents
+	}
+
+	if cfg.MaxGroups <= 0 {
+		cfg.MaxGroups = defaultAnomalyMaxGroups
+	}
+
+	limits := cfg.Limits
+	if limits == nil {
+		limits = defaultLimits
+	}
+
+	// The smoothing factor of an EWMA with a similar centre of mass to a
+	// simple moving average over the window
+	samples := float64(cfg.Window / cfg.Interval)
+
+	return &AnomalyDetector{
+		Name:     cfg.Name,
+		Filter:   filters.NewFilterSet(cfg.Name, cfg.EventType, cfg.EventFilters, kubeClient),
+		cfg:      cfg,
+		alpha:    2 / (samples + 1),
+		recorder: recorder,
+		limiter:  NewLimiter(cfg.Name, limits, fire),
+		groups:   make(map[string]*rateGroup),
+		seen:     make(map[types.UID]occurrence),
+	}
+}
+
+// Run measures the rate of events each interval until the context is done
+func (d *AnomalyDetector) Run(ctx context.Context) {
+	log.Info("Detecting event rate anomalies", "trigger", d.Name, "groupBy", d.cfg.GroupBy, "interval", d.cfg.Interval)
+
+	ticker := time.NewTicker(d.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.Tick()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Handle counts the event if it matches, events are delivered again when
+// updated so only increases in their count are counted
+func (d *AnomalyDetector) Handle(in *corev1.Event) {
+	if !d.Filter.Match(in) {
+		return
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	count := eventCount(in)
+	prev, exists := d.seen[in.UID]
+	d.seen[in.UID] = occurrence{time: time.Now(), count: count}
+
+	n := 1
+	if exists {
+		n = count - prev.count
+	}
+
+	if n <= 0 {
+		return
+	}
+
+	key := groupKey(d.cfg.GroupBy, in)
+
+	group, exists := d.groups[key]
+	if !exists {
+		group = d.newGroupLocked(key)
+	}
+
+	group.baseline.Current += n
+	group.last = in.InvolvedObject
+	group.active = d.intervals
+}
+
+// newGroupLocked adds a group seen for the first time, or again after being
+// evicted. It had no events in any interval so far, so its baseline is zero
+// and a first burst of events can be anomalous. The least recently active
+// group is evicted once there are too many, it is also zero if seen again.
+func (d *AnomalyDetector) newGroupLocked(key string) *rateGroup {
+	if len(d.groups) >= d.cfg.MaxGroups {
+		var oldest string
+		for k, g := range d.groups {
+			if oldest == "" || g.active < d.groups[oldest].active {
+				oldest = k
+			}
+		}
+
+		delete(d.groups, oldest)
+	}
+
+	group := &rateGroup{baseline: RateBaseline{Key: key, Samples: d.intervals}}
+	d.groups[key] = group
+
+	return group
+}
+
+// Tick ends the current interval, checking each groups rate against its
+// baseline before learning from it
+func (d *AnomalyDetector) Tick() {
+	d.mx.Lock()
+
+	var anomalies []*corev1.Event
+
+	for _, group := range d.groups {
+		b := &group.baseline
+		rate := float64(b.Current)
+
+		b.LastRate = b.Current
+		b.LastScore = (rate - b.Mean) / math.Max(b.StdDev, minStdDev)
+		b.Anomalous = b.Samples >= d.cfg.MinSamples && b.Current >= d.cfg.MinEvents && b.LastScore >= d.cfg.Threshold
+
+		if b.Anomalous {
+			anomalies = append(anomalies, d.newAnomalyEvent(group))
+		}
+
+		// Incrementally update the exponentially weighted mean and variance
+		diff := rate - b.Mean
+		incr := d.alpha * diff
+		b.Mean += incr
+		group.variance = (1 - d.alpha) * (group.variance + diff*incr)
+		b.StdDev = math.Sqrt(group.variance)
+		b.Samples++
+		b.Current = 0
+	}
+
+	d.intervals++
+
+	now := time.Now()
+	for uid, s := range d.seen {
+		if now.Sub(s.time) >= d.cfg.Window {
+			delete(d.seen, uid)
+		}
+	}
+
+	d.mx.Unlock()
+
+	for _, e := range anomalies {
+		log.Info("Event rate anomaly detected", "trigger", d.Name, "msg", e.Message)
+
+		if d.recorder != nil {
+			d.recorder.RecordEvent(e)
+		}
+
+		d.limiter.Trigger(e)
+	}
+}
+
+func (d *AnomalyDetector) newAnomalyEvent(group *rateGroup) *corev1.Event {
+	b := group.baseline
+
+	msg := fmt.Sprintf("Rate of events is %d per %s for %s %q, baseline is %.1f±%.1f (z-score %.1f)",
+		b.LastRate, d.cfg.Interval, d.cfg.GroupBy, b.Key, b.Mean, b.StdDev, b.LastScore)
+
+	return NewSyntheticEvent(group.last, corev1.EventTypeWarning, ReasonEventRateAnomaly, msg)
+}
+
+// State returns the detectors configuration and learnt baselines
+func (d *AnomalyDetector) State() AnomalyDetectorState {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	state := AnomalyDetectorState{
+		Name:       d.Name,
+		GroupBy:    d.cfg.GroupBy,
+		Interval:   d.cfg.Interval.String(),
+		Threshold:  d.cfg.Threshold,
+		MinSamples: d.cfg.MinSamples,
+		MinEvents:  d.cfg.MinEvents,
+		Groups:     make([]RateBaseline, 0, len(d.groups)),
+	}
+
+	for _, group := range d.groups {
+		state.Groups = append(state.Groups, group.baseline)
+	}
+
+	sort.Slice(state.Groups, func(i, j int) bool {
+		return state.Groups[i].Key < state.Groups[j].Key
+	})
+
+	return state
+}
+
+// ServeHTTP serves the detectors state
+func (d *AnomalyDetector) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(d.State())
+}
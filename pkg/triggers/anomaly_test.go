@@ -0,0 +1,178 @@
+package triggers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func initTestAnomalyDetector(cfg config.AnomalyDetectionConfiguration) (*AnomalyDetector, *testRecorder, *[]*corev1.Event) {
+	recorder := &testRecorder{}
+	fired := &[]*corev1.Event{}
+
+	d := NewAnomalyDetector(cfg, nil, nil, recorder, func(in *corev1.Event) {
+		*fired = append(*fired, in)
+	})
+
+	return d, recorder, fired
+}
+
+// observeInterval handles count new events with the reason then ends the interval
+func observeInterval(d *AnomalyDetector, interval int, reason string, count int) {
+	for i := 0; i < count; i++ {
+		e := createEvent(fmt.Sprintf("%s-%d-%d", reason, interval, i), "pod")
+		e.UID = types.UID(e.Name)
+		e.Reason = reason
+		d.Handle(e)
+	}
+
+	d.Tick()
+}
+
+func TestAnomalyDetectorSpike(t *testing.T) {
+	d, recorder, fired := initTestAnomalyDetector(config.AnomalyDetectionConfiguration{
+		MinSamples: 5,
+	})
+
+	// Learn a baseline of 2-4 events per interval
+	for i := 0; i < 20; i++ {
+		observeInterval(d, i, "BackOff", 2+i%3)
+	}
+
+	if len(*fired) != 0 {
+		t.Fatalf("expected no anomalies while learning a steady rate, got %d", len(*fired))
+	}
+
+	observeInterval(d, 20, "BackOff", 30)
+
+	if len(*fired) != 1 {
+		t.Fatalf("expected a spike to trigger, got %d", len(*fired))
+	}
+
+	if len(recorder.events) != 1 || recorder.events[0].Reason != ReasonEventRateAnomaly {
+		t.Fatalf("expected a synthetic anomaly event, got %v", recorder.events)
+	}
+
+	state := d.State()
+	if len(state.Groups) != 1 || !state.Groups[0].Anomalous || state.Groups[0].LastRate != 30 {
+		t.Fatalf("unexpected detector state %+v", state)
+	}
+}
+
+func TestAnomalyDetectorWarmUp(t *testing.T) {
+	d, _, fired := initTestAnomalyDetector(config.AnomalyDetectionConfiguration{
+		MinSamples: 5,
+	})
+
+	observeInterval(d, 0, "BackOff", 1)
+	observeInterval(d, 1, "BackOff", 30)
+
+	if len(*fired) != 0 {
+		t.Fatalf("expected no anomalies before the baseline is learnt, got %d", len(*fired))
+	}
+}
+
+func TestAnomalyDetectorNewGroup(t *testing.T) {
+	d, _, fired := initTestAnomalyDetector(config.AnomalyDetectionConfiguration{
+		MinSamples: 5,
+	})
+
+	for i := 0; i < 20; i++ {
+		observeInterval(d, i, "BackOff", 2+i%3)
+	}
+
+	// A reason never seen before has a baseline of zero
+	observeInterval(d, 20, "FailedMount", 10)
+
+	if len(*fired) != 1 || !strings.Contains((*fired)[0].Message, "FailedMount") {
+		t.Fatalf("expected the first burst of a new reason to trigger, got %v", *fired)
+	}
+}
+
+func TestAnomalyDetectorMaxGroups(t *testing.T) {
+	d, _, _ := initTestAnomalyDetector(config.AnomalyDetectionConfiguration{
+		MaxGroups: 2,
+	})
+
+	observeInterval(d, 0, "BackOff", 1)
+	observeInterval(d, 1, "Pulled", 1)
+	observeInterval(d, 2, "BackOff", 1)
+
+	// The least recently active group is forgotten
+	observeInterval(d, 3, "FailedMount", 1)
+
+	state := d.State()
+	if len(state.Groups) != 2 || state.Groups[0].Key != "BackOff" || state.Groups[1].Key != "FailedMount" {
+		t.Fatalf("unexpected detector state %+v", state)
+	}
+}
+
+func TestAnomalyDetectorMinEvents(t *testing.T) {
+	d, _, fired := initTestAnomalyDetector(config.AnomalyDetectionConfiguration{
+		MinSamples: 5,
+		MinEvents:  5,
+	})
+
+	for i := 0; i < 20; i++ {
+		observeInterval(d, i, "Pulled", 1)
+	}
+
+	// A large z-score from a handful of events in a quiet group is ignored
+	observeInterval(d, 20, "Pulled", 4)
+
+	if len(*fired) != 0 {
+		t.Fatalf("expected too few events not to trigger, got %d", len(*fired))
+	}
+}
+
+func TestAnomalyDetectorGroupsAndCountIncrements(t *testing.T) {
+	d, _, _ := initTestAnomalyDetector(config.AnomalyDetectionConfiguration{})
+
+	e := createEvent("backoff", "pod")
+	e.UID = "backoff"
+	e.Reason = "BackOff"
+	e.Count = 1
+	d.Handle(e)
+
+	e = e.DeepCopy()
+	e.Count = 4
+	d.Handle(e)
+
+	other := createEvent("pulled", "pod")
+	other.UID = "pulled"
+	other.Reason = "Pulled"
+	d.Handle(other)
+
+	state := d.State()
+	if len(state.Groups) != 2 || state.Groups[0].Key != "BackOff" || state.Groups[0].Current != 4 || state.Groups[1].Current != 1 {
+		t.Fatalf("unexpected detector state %+v", state)
+	}
+}
+
+func TestAnomalyDetectorServeState(t *testing.T) {
+	d, _, _ := initTestAnomalyDetector(config.AnomalyDetectionConfiguration{Name: "rates"})
+	observeInterval(d, 0, "BackOff", 3)
+
+	rw := httptest.NewRecorder()
+	d.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/anomalies", nil))
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, rw.Code)
+	}
+
+	state := AnomalyDetectorState{}
+	if err := json.NewDecoder(rw.Body).Decode(&state); err != nil {
+		t.Fatal(err)
+	}
+
+	if state.Name != "rates" || len(state.Groups) != 1 || state.Groups[0].Samples != 1 {
+		t.Fatalf("unexpected detector state %+v", state)
+	}
+}
@@ -0,0 +1,336 @@
+package triggers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ReasonConditionChanged is the reason of synthetic events for watched
+// status conditions transitioning to the configured status
+const ReasonConditionChanged = "ConditionChanged"
+
+// Condition is a status condition of a resource
+type Condition struct {
+	Type               string
+	Status             string
+	Reason             string
+	Message            string
+	LastTransitionTime time.Time
+}
+
+type conditionState struct {
+	status string
+	timer  *time.Timer
+	fired  bool
+}
+
+// ConditionWatcher watches resources of any type and triggers when a status
+// condition transitions to the configured status. A synthetic event
+// describing the transition is recorded in the buffer before triggering.
+type ConditionWatcher struct {
+	Name string
+
+	cfg       config.ConditionTriggerConfiguration
+	client    dynamic.Interface
+	discovery discovery.DiscoveryInterface
+	namespace string
+	recorder  EventRecorder
+	limiter   *Limiter
+
+	mx     sync.Mutex
+	states map[types.UID]*conditionState
+}
+
+// NewConditionWatcher creates a new ConditionWatcher
+func NewConditionWatcher(cfg config.ConditionTriggerConfiguration, defaultLimits *config.TriggerLimitsConfiguration, client dynamic.Interface, discovery discovery.DiscoveryInterface, namespace string, recorder EventRecorder, fire FireFunc) *ConditionWatcher {
+	if cfg.Name == "" {
+		cfg.Name = fmt.Sprintf("%s-%s", cfg.Kind, cfg.Condition)
+	}
+
+	limits := cfg.Limits
+	if limits == nil {
+		limits = defaultLimits
+	}
+
+	return &ConditionWatcher{
+		Name:      cfg.Name,
+		cfg:       cfg,
+		client:    client,
+		discovery: discovery,
+		namespace: namespace,
+		recorder:  recorder,
+		limiter:   NewLimiter(cfg.Name, limits, fire),
+		states:    make(map[types.UID]*conditionState),
+	}
+}
+
+// Run starts watching resources until the context is done
+func (w *ConditionWatcher) Run(ctx context.Context) error {
+	gvr, err := w.getResource()
+	if err != nil {
+		return err
+	}
+
+	selector := labels.SelectorFromSet(labels.Set(w.cfg.Labels)).String()
+
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(w.client, 0, w.namespace, func(opts *metav1.ListOptions) {
+		opts.LabelSelector = selector
+	})
+
+	factory.ForResource(gvr).Informer().AddEventHandler(cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj interface{}, isInInitialList bool) {
+			u, ok := obj.(*unstructured.Unstructured)
+			if !ok {
+				return
+			}
+
+			// Resources already in the configured status when starting up
+			// haven't transitioned, so only their state is recorded
+			if isInInitialList {
+				w.Seed(u)
+				return
+			}
+
+			w.Handle(u)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			if u, ok := obj.(*unstructured.Unstructured); ok {
+				w.Handle(u)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if u, ok := obj.(*unstructured.Unstructured); ok {
+				w.forget(u.GetUID())
+			}
+		},
+	})
+
+	factory.Start(ctx.Done())
+
+	log.Info("Watching resource conditions", "trigger", w.Name, "resource", gvr.String(), "condition", w.cfg.Condition, "status", w.cfg.Status)
+
+	return nil
+}
+
+// getResource returns the resource to watch, using API discovery to find the
+// resource name for the kind if it isn't configured
+func (w *ConditionWatcher) getResource() (schema.GroupVersionResource, error) {
+	gv, err := schema.ParseGroupVersion(w.cfg.APIVersion)
+	if err != nil {
+		return schema.GroupVersionResource{}, err
+	}
+
+	if w.cfg.Resource != "" {
+		return gv.WithResource(w.cfg.Resource), nil
+	}
+
+	groupResources, err := restmapper.GetAPIGroupResources(w.discovery)
+	if err != nil {
+		return schema.GroupVersionResource{}, fmt.Errorf("failed to discover resource for %s: %w", gv.WithKind(w.cfg.Kind), err)
+	}
+
+	mapping, err := restmapper.NewDiscoveryRESTMapper(groupResources).RESTMapping(gv.WithKind(w.cfg.Kind).GroupKind(), gv.Version)
+	if err != nil {
+		return schema.GroupVersionResource{}, fmt.Errorf("failed to discover resource for %s: %w", gv.WithKind(w.cfg.Kind), err)
+	}
+
+	return mapping.Resource, nil
+}
+
+// Handle checks the watched condition of a resource, triggering once it has
+// transitioned to the configured status for long enough. The trigger is reset
+// once the condition has a different status.
+func (w *ConditionWatcher) Handle(obj *unstructured.Unstructured) {
+	if e := w.update(obj); e != nil {
+		w.fire(e)
+	}
+}
+
+// update records the status of the watched condition of a resource, returning
+// the event to trigger with if it should trigger now
+func (w *ConditionWatcher) update(obj *unstructured.Unstructured) *corev1.Event {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	cond, found := FindCondition(obj, w.cfg.Condition)
+	if !found {
+		cond.Status = ""
+	}
+
+	state, exists := w.states[obj.GetUID()]
+	if !exists {
+		state = &conditionState{}
+		w.states[obj.GetUID()] = state
+	}
+
+	previous := state.status
+	state.status = cond.Status
+
+	if cond.Status != w.cfg.Status {
+		if state.timer != nil {
+			state.timer.Stop()
+			state.timer = nil
+		}
+		state.fired = false
+		return nil
+	}
+
+	if state.fired || state.timer != nil {
+		return nil
+	}
+
+	since := cond.LastTransitionTime
+	if since.IsZero() {
+		since = time.Now()
+	}
+
+	e := w.newTransitionEvent(obj, cond, previous)
+
+	if delay := w.cfg.For - time.Since(since); delay > 0 {
+		state.timer = time.AfterFunc(delay, func() {
+			w.mx.Lock()
+			state.timer = nil
+			fire := state.status == w.cfg.Status && !state.fired
+			if fire {
+				state.fired = true
+			}
+			w.mx.Unlock()
+
+			if fire {
+				w.fire(e)
+			}
+		})
+		return nil
+	}
+
+	state.fired = true
+
+	return e
+}
+
+// Seed records the status of the watched condition of a resource listed at
+// startup. Without a for duration only transitions observed afterwards
+// trigger, with one the condition is handled as an update, so a resource
+// which has had the status for long enough since its last transition
+// triggers even though the transition happened before startup.
+func (w *ConditionWatcher) Seed(obj *unstructured.Unstructured) {
+	if w.cfg.For > 0 {
+		w.Handle(obj)
+		return
+	}
+
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	cond, found := FindCondition(obj, w.cfg.Condition)
+	if !found {
+		cond.Status = ""
+	}
+
+	if state, exists := w.states[obj.GetUID()]; exists && state.timer != nil {
+		state.timer.Stop()
+	}
+
+	w.states[obj.GetUID()] = &conditionState{
+		status: cond.Status,
+		fired:  cond.Status == w.cfg.Status,
+	}
+}
+
+// fire records the transition event and triggers, it must be called without
+// the lock held as triggering can write a stash
+func (w *ConditionWatcher) fire(e *corev1.Event) {
+	log.Info("Condition transition detected", "trigger", w.Name, "object", e.InvolvedObject.Name, "msg", e.Message)
+
+	if w.recorder != nil {
+		w.recorder.RecordEvent(e)
+	}
+
+	w.limiter.Trigger(e)
+}
+
+func (w *ConditionWatcher) forget(uid types.UID) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	if state, exists := w.states[uid]; exists && state.timer != nil {
+		state.timer.Stop()
+	}
+
+	delete(w.states, uid)
+}
+
+func (w *ConditionWatcher) newTransitionEvent(obj *unstructured.Unstructured, cond Condition, previous string) *corev1.Event {
+	ref := corev1.ObjectReference{
+		APIVersion:      obj.GetAPIVersion(),
+		Kind:            obj.GetKind(),
+		Name:            obj.GetName(),
+		Namespace:       obj.GetNamespace(),
+		UID:             obj.GetUID(),
+		ResourceVersion: obj.GetResourceVersion(),
+	}
+
+	if previous == "" {
+		previous = "Unknown"
+	}
+
+	msg := fmt.Sprintf("Condition %s changed from %s to %s", cond.Type, previous, cond.Status)
+
+	if !cond.LastTransitionTime.IsZero() {
+		msg += fmt.Sprintf(" at %s", cond.LastTransitionTime.Format(time.RFC3339))
+	}
+
+	if cond.Reason != "" {
+		msg += fmt.Sprintf(", reason: %s", cond.Reason)
+	}
+
+	if cond.Message != "" {
+		msg += fmt.Sprintf(", message: %s", cond.Message)
+	}
+
+	return NewSyntheticEvent(ref, corev1.EventTypeWarning, ReasonConditionChanged, msg)
+}
+
+// FindCondition returns the status condition of the given type
+func FindCondition(obj *unstructured.Unstructured, conditionType string) (Condition, bool) {
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+
+	for _, c := range conditions {
+		m, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if t, _, _ := unstructured.NestedString(m, "type"); t != conditionType {
+			continue
+		}
+
+		cond := Condition{Type: conditionType}
+		cond.Status, _, _ = unstructured.NestedString(m, "status")
+		cond.Reason, _, _ = unstructured.NestedString(m, "reason")
+		cond.Message, _, _ = unstructured.NestedString(m, "message")
+
+		if ts, _, _ := unstructured.NestedString(m, "lastTransitionTime"); ts != "" {
+			cond.LastTransitionTime, _ = time.Parse(time.RFC3339, ts)
+		}
+
+		return cond, true
+	}
+
+	return Condition{Type: conditionType}, false
+}
@@ -0,0 +1,225 @@
+package triggers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// createCluster creates a cluster with an Available condition, the transition
+// time is only set if not zero as it only has a precision of seconds
+func createCluster(status string, transitioned time.Time) *unstructured.Unstructured {
+	available := map[string]interface{}{
+		"type":    "Available",
+		"status":  status,
+		"reason":  "ClusterUnavailable",
+		"message": "pods are not ready",
+	}
+
+	if !transitioned.IsZero() {
+		available["lastTransitionTime"] = transitioned.Format(time.RFC3339)
+	}
+
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "couchbase.com/v2",
+		"kind":       "CouchbaseCluster",
+		"metadata": map[string]interface{}{
+			"name":      "cb-example",
+			"namespace": "default",
+			"uid":       "cluster-uid",
+		},
+		"status": map[string]interface{}{
+			"conditions": []interface{}{
+				map[string]interface{}{
+					"type":   "Balanced",
+					"status": "True",
+				},
+				available,
+			},
+		},
+	}}
+}
+
+// initTestConditionWatcher creates a watcher sending the triggering events
+// to a channel, as triggers for the for duration fire from a timer
+func initTestConditionWatcher(cfg config.ConditionTriggerConfiguration) (*ConditionWatcher, *testRecorder, chan *corev1.Event) {
+	recorder := &testRecorder{}
+	fired := make(chan *corev1.Event, 10)
+
+	w := NewConditionWatcher(cfg, nil, nil, nil, "default", recorder, func(in *corev1.Event) {
+		fired <- in
+	})
+
+	return w, recorder, fired
+}
+
+func TestConditionWatcherTransition(t *testing.T) {
+	w, recorder, fired := initTestConditionWatcher(config.ConditionTriggerConfiguration{
+		Kind:      "CouchbaseCluster",
+		Condition: "Available",
+		Status:    "False",
+	})
+
+	w.Handle(createCluster("True", time.Time{}))
+	if len(fired) != 0 {
+		t.Fatalf("expected no trigger, got %d", len(fired))
+	}
+
+	w.Handle(createCluster("False", time.Time{}))
+	if len(fired) != 1 {
+		t.Fatalf("expected 1 trigger, got %d", len(fired))
+	}
+
+	if len(recorder.events) != 1 {
+		t.Fatalf("expected 1 recorded event, got %d", len(recorder.events))
+	}
+
+	e := recorder.events[0]
+	if e.Reason != ReasonConditionChanged || e.InvolvedObject.Kind != "CouchbaseCluster" || e.InvolvedObject.Name != "cb-example" {
+		t.Fatalf("unexpected synthetic event %v", e)
+	}
+
+	if !strings.Contains(e.Message, "from True to False") || !strings.Contains(e.Message, "ClusterUnavailable") {
+		t.Fatalf("unexpected synthetic event message %q", e.Message)
+	}
+
+	// Further updates with the same status must not retrigger
+	w.Handle(createCluster("False", time.Time{}))
+	if len(fired) != 1 {
+		t.Fatalf("expected 1 trigger, got %d", len(fired))
+	}
+
+	// Recovering resets the trigger
+	w.Handle(createCluster("True", time.Time{}))
+	w.Handle(createCluster("False", time.Time{}))
+	if len(fired) != 2 {
+		t.Fatalf("expected 2 triggers, got %d", len(fired))
+	}
+}
+
+func TestConditionWatcherFor(t *testing.T) {
+	w, _, fired := initTestConditionWatcher(config.ConditionTriggerConfiguration{
+		Kind:      "CouchbaseCluster",
+		Condition: "Available",
+		Status:    "False",
+		For:       200 * time.Millisecond,
+	})
+
+	w.Handle(createCluster("False", time.Time{}))
+	if len(fired) != 0 {
+		t.Fatalf("expected no trigger before the duration, got %d", len(fired))
+	}
+
+	select {
+	case <-fired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a trigger after the duration")
+	}
+}
+
+func TestConditionWatcherForRecovered(t *testing.T) {
+	w, _, fired := initTestConditionWatcher(config.ConditionTriggerConfiguration{
+		Kind:      "CouchbaseCluster",
+		Condition: "Available",
+		Status:    "False",
+		For:       200 * time.Millisecond,
+	})
+
+	w.Handle(createCluster("False", time.Time{}))
+	w.Handle(createCluster("True", time.Time{}))
+
+	select {
+	case <-fired:
+		t.Fatal("expected no trigger after recovering")
+	case <-time.After(400 * time.Millisecond):
+	}
+}
+
+func TestConditionWatcherForElapsed(t *testing.T) {
+	w, _, fired := initTestConditionWatcher(config.ConditionTriggerConfiguration{
+		Kind:      "CouchbaseCluster",
+		Condition: "Available",
+		Status:    "False",
+		For:       time.Minute,
+	})
+
+	// The condition transitioned long enough ago so triggers immediately
+	w.Handle(createCluster("False", time.Now().Add(-2*time.Minute)))
+	if len(fired) != 1 {
+		t.Fatalf("expected 1 trigger, got %d", len(fired))
+	}
+}
+
+func TestConditionWatcherSeed(t *testing.T) {
+	w, _, fired := initTestConditionWatcher(config.ConditionTriggerConfiguration{
+		Kind:      "CouchbaseCluster",
+		Condition: "Available",
+		Status:    "False",
+	})
+
+	// Resources listed on startup already in the status haven't transitioned
+	w.Seed(createCluster("False", time.Time{}))
+	w.Handle(createCluster("False", time.Time{}))
+	if len(fired) != 0 {
+		t.Fatalf("expected no trigger for the initial status, got %d", len(fired))
+	}
+
+	w.Handle(createCluster("True", time.Time{}))
+	w.Handle(createCluster("False", time.Time{}))
+	if len(fired) != 1 {
+		t.Fatalf("expected 1 trigger, got %d", len(fired))
+	}
+
+	if e := <-fired; !strings.Contains(e.Message, "from True to False") {
+		t.Fatalf("unexpected synthetic event message %q", e.Message)
+	}
+}
+
+func TestConditionWatcherFiresWithoutLock(t *testing.T) {
+	done := make(chan struct{})
+
+	var w *ConditionWatcher
+	w = NewConditionWatcher(config.ConditionTriggerConfiguration{
+		Kind:      "CouchbaseCluster",
+		Condition: "Available",
+		Status:    "False",
+	}, nil, nil, nil, "default", nil, func(in *corev1.Event) {
+		// Handling updates while a stash is taken isn't blocked
+		w.Handle(createCluster("True", time.Time{}))
+		close(done)
+	})
+
+	go w.Handle(createCluster("False", time.Time{}))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the trigger to fire without holding the lock")
+	}
+}
+
+func TestConditionWatcherSeedFor(t *testing.T) {
+	w, _, fired := initTestConditionWatcher(config.ConditionTriggerConfiguration{
+		Kind:      "CouchbaseCluster",
+		Condition: "Available",
+		Status:    "False",
+		For:       time.Minute,
+	})
+
+	// A resource which has had the status for long enough before startup
+	// still triggers
+	w.Seed(createCluster("False", time.Now().Add(-2*time.Minute)))
+	if len(fired) != 1 {
+		t.Fatalf("expected 1 trigger, got %d", len(fired))
+	}
+
+	// But not again until it transitions
+	w.Handle(createCluster("False", time.Now().Add(-2*time.Minute)))
+	if len(fired) != 1 {
+		t.Fatalf("expected 1 trigger, got %d", len(fired))
+	}
+}
@@ -0,0 +1,79 @@
+package triggers
+
+import (
+	"sync"
+	"time"
+)
+
+// ReasonEventsAbsent is the reason of synthetic events for absence rules
+// which haven't seen a matching event within their period
+const ReasonEventsAbsent = "EventsAbsent"
+
+// AbsentFunc is called when a heartbeat is missed with when the last
+// heartbeat was observed
+type AbsentFunc func(lastSeen time.Time)
+
+// Heartbeat expects to be observed at least once every period, it calls its
+// AbsentFunc once when a period passes without being observed and is reset
+// when next observed
+type Heartbeat struct {
+	period   time.Duration
+	onAbsent AbsentFunc
+
+	mx       sync.Mutex
+	timer    *time.Timer
+	lastSeen time.Time
+	absent   bool
+}
+
+// NewHeartbeat creates a new Heartbeat, the first period starts immediately
+func NewHeartbeat(period time.Duration, onAbsent AbsentFunc) *Heartbeat {
+	h := &Heartbeat{
+		period:   period,
+		onAbsent: onAbsent,
+		lastSeen: time.Now(),
+	}
+
+	h.timer = time.AfterFunc(period, h.expire)
+
+	return h
+}
+
+// Observe records a heartbeat, restarting the period
+func (h *Heartbeat) Observe() {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	h.lastSeen = time.Now()
+	h.absent = false
+	h.timer.Reset(h.period)
+}
+
+// Absent returns whether the heartbeat has been missed and not yet resumed
+func (h *Heartbeat) Absent() bool {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	return h.absent
+}
+
+// Stop stops the heartbeat being checked
+func (h *Heartbeat) Stop() {
+	h.timer.Stop()
+}
+
+func (h *Heartbeat) expire() {
+	h.mx.Lock()
+
+	// The timer may have expired while being reset by an observation
+	if h.absent || time.Since(h.lastSeen) < h.period {
+		h.mx.Unlock()
+		return
+	}
+
+	h.absent = true
+	lastSeen := h.lastSeen
+	h.mx.Unlock()
+
+	h.onAbsent(lastSeen)
+}
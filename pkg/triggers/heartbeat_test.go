@@ -0,0 +1,48 @@
+package triggers
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatAbsent(t *testing.T) {
+	var missed int32
+
+	h := NewHeartbeat(100*time.Millisecond, func(time.Time) { atomic.AddInt32(&missed, 1) })
+	defer h.Stop()
+
+	time.Sleep(250 * time.Millisecond)
+
+	// Only a single miss is reported until the heartbeat resumes
+	if n := atomic.LoadInt32(&missed); n != 1 || !h.Absent() {
+		t.Fatalf("expected 1 missed heartbeat, got %d", n)
+	}
+
+	h.Observe()
+	if h.Absent() {
+		t.Fatal("expected the heartbeat to have resumed")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&missed); n != 2 {
+		t.Fatalf("expected 2 missed heartbeats, got %d", n)
+	}
+}
+
+func TestHeartbeatObserved(t *testing.T) {
+	var missed int32
+
+	h := NewHeartbeat(100*time.Millisecond, func(time.Time) { atomic.AddInt32(&missed, 1) })
+	defer h.Stop()
+
+	for i := 0; i < 5; i++ {
+		time.Sleep(50 * time.Millisecond)
+		h.Observe()
+	}
+
+	if n := atomic.LoadInt32(&missed); n != 0 {
+		t.Fatalf("expected no missed heartbeats, got %d", n)
+	}
+}
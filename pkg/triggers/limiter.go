@@ -0,0 +1,170 @@
+package triggers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+var log = logf.Log.WithName("triggers")
+
+// FireFunc is called when a trigger fires with the event that triggered it
+type FireFunc func(in *corev1.Event)
+
+// The Limiter debounces and rate limits trigger firings so a burst of
+// matching events results in a single stash
+type Limiter struct {
+	name   string
+	limits config.TriggerLimitsConfiguration
+	fire   FireFunc
+
+	mx            sync.Mutex
+	pending       *corev1.Event
+	pendingSince  time.Time
+	debounceTimer *time.Timer
+	lastFired     time.Time
+	objectFired   map[string]time.Time
+	history       []time.Time
+}
+
+// NewLimiter creates a new Limiter which calls fire when a trigger is allowed
+// through, a nil config disables all limits
+func NewLimiter(name string, limits *config.TriggerLimitsConfiguration, fire FireFunc) *Limiter {
+	l := &Limiter{
+		name:        name,
+		fire:        fire,
+		objectFired: make(map[string]time.Time),
+	}
+
+	if limits != nil {
+		l.limits = *limits
+	}
+
+	return l
+}
+
+// Trigger requests the trigger fires for the event, this may be dropped
+// because of a cooldown or delayed until the debounce period is quiet
+func (l *Limiter) Trigger(in *corev1.Event) {
+	l.mx.Lock()
+
+	now := time.Now()
+
+	if l.limits.Cooldown > 0 && now.Sub(l.lastFired) < l.limits.Cooldown {
+		l.mx.Unlock()
+		log.Info("Trigger in cooldown, ignoring", "trigger", l.name, "event", in.Name)
+		return
+	}
+
+	if last, ok := l.objectFired[objectKey(in)]; ok && now.Sub(last) < l.limits.ObjectCooldown {
+		l.mx.Unlock()
+		log.Info("Involved object in cooldown, ignoring", "trigger", l.name, "event", in.Name, "object", objectKey(in))
+		return
+	}
+
+	if l.limits.Debounce <= 0 {
+		allowed := l.allowLocked(in, now)
+		l.mx.Unlock()
+
+		if allowed {
+			l.fireEvent(in)
+		}
+
+		return
+	}
+
+	// The first event of a burst is kept as it's the most useful for
+	// identifying what caused it
+	if l.pending == nil {
+		l.pending = in
+		l.pendingSince = now
+	}
+
+	if l.debounceTimer != nil {
+		l.debounceTimer.Stop()
+	}
+
+	// A continuous burst would delay the stash forever without a max wait
+	delay := l.limits.Debounce
+	if l.limits.MaxWait > 0 {
+		if remaining := l.limits.MaxWait - now.Sub(l.pendingSince); remaining < delay {
+			delay = max(remaining, 0)
+		}
+	}
+
+	l.debounceTimer = time.AfterFunc(delay, l.flush)
+
+	l.mx.Unlock()
+}
+
+// flush fires the pending trigger once the debounce period has elapsed
+func (l *Limiter) flush() {
+	l.mx.Lock()
+
+	if l.pending == nil {
+		l.mx.Unlock()
+		return
+	}
+
+	in := l.pending
+	l.pending = nil
+	l.debounceTimer = nil
+
+	allowed := l.allowLocked(in, time.Now())
+	l.mx.Unlock()
+
+	if allowed {
+		l.fireEvent(in)
+	}
+}
+
+// allowLocked checks the rate limit and records the firing if it is allowed,
+// the trigger is fired after releasing the lock as stashes are written
+// synchronously
+func (l *Limiter) allowLocked(in *corev1.Event, now time.Time) bool {
+
+	if l.limits.MaxStashesPerHour > 0 {
+		history := l.history[:0]
+		for _, t := range l.history {
+			if now.Sub(t) < time.Hour {
+				history = append(history, t)
+			}
+		}
+		l.history = history
+
+		if len(l.history) >= l.limits.MaxStashesPerHour {
+			log.Info("Trigger rate limit reached, ignoring", "trigger", l.name, "event", in.Name, "maxStashesPerHour", l.limits.MaxStashesPerHour)
+			return false
+		}
+
+		l.history = append(l.history, now)
+	}
+
+	l.lastFired = now
+
+	if l.limits.ObjectCooldown > 0 {
+		for key, t := range l.objectFired {
+			if now.Sub(t) >= l.limits.ObjectCooldown {
+				delete(l.objectFired, key)
+			}
+		}
+		l.objectFired[objectKey(in)] = now
+	}
+
+	return true
+}
+
+func (l *Limiter) fireEvent(in *corev1.Event) {
+	log.Info("Trigger fired", "trigger", l.name, "event", in.Name)
+	l.fire(in)
+}
+
+// objectKey identifies the involved object of an event
+func objectKey(in *corev1.Event) string {
+	o := in.InvolvedObject
+	return fmt.Sprintf("%s/%s/%s/%s", o.APIVersion, o.Kind, o.Namespace, o.Name)
+}
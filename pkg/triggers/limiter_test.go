@@ -0,0 +1,138 @@
+package triggers
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func createEvent(name, object string) *corev1.Event {
+	return &corev1.Event{
+		ObjectMeta: v1.ObjectMeta{
+			Name: name,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			Kind: "Pod",
+			Name: object,
+		},
+		Type: corev1.EventTypeWarning,
+	}
+}
+
+func TestLimiterNoLimits(t *testing.T) {
+	var fired atomic.Int32
+	l := NewLimiter("test", nil, func(in *corev1.Event) { fired.Add(1) })
+
+	for i := 0; i < 3; i++ {
+		l.Trigger(createEvent("event", "pod"))
+	}
+
+	if fired.Load() != 3 {
+		t.Errorf("Expected every trigger to fire without limits, got %v", fired.Load())
+	}
+}
+
+func TestLimiterDebounce(t *testing.T) {
+	var fired atomic.Int32
+	var firedEvent atomic.Value
+	l := NewLimiter("test", &config.TriggerLimitsConfiguration{Debounce: 200 * time.Millisecond}, func(in *corev1.Event) {
+		fired.Add(1)
+		firedEvent.Store(in.Name)
+	})
+
+	l.Trigger(createEvent("first", "pod"))
+	for i := 0; i < 5; i++ {
+		time.Sleep(50 * time.Millisecond)
+		l.Trigger(createEvent("later", "pod"))
+	}
+
+	if fired.Load() != 0 {
+		t.Errorf("Expected trigger not to fire until the burst is quiet")
+	}
+
+	time.Sleep(400 * time.Millisecond)
+
+	if fired.Load() != 1 {
+		t.Errorf("Expected a single trigger after the burst, got %v", fired.Load())
+	}
+
+	if firedEvent.Load() != "first" {
+		t.Errorf("Expected the first event of the burst to be used, got %v", firedEvent.Load())
+	}
+}
+
+func TestLimiterCooldown(t *testing.T) {
+	var fired atomic.Int32
+	l := NewLimiter("test", &config.TriggerLimitsConfiguration{Cooldown: time.Hour}, func(in *corev1.Event) { fired.Add(1) })
+
+	l.Trigger(createEvent("event", "pod-1"))
+	l.Trigger(createEvent("event", "pod-2"))
+
+	if fired.Load() != 1 {
+		t.Errorf("Expected trigger to be in cooldown, got %v firings", fired.Load())
+	}
+}
+
+func TestLimiterObjectCooldown(t *testing.T) {
+	var fired atomic.Int32
+	l := NewLimiter("test", &config.TriggerLimitsConfiguration{ObjectCooldown: time.Hour}, func(in *corev1.Event) { fired.Add(1) })
+
+	l.Trigger(createEvent("event", "pod-1"))
+	l.Trigger(createEvent("event", "pod-1"))
+	l.Trigger(createEvent("event", "pod-2"))
+
+	if fired.Load() != 2 {
+		t.Errorf("Expected one firing per object, got %v", fired.Load())
+	}
+}
+
+func TestLimiterMaxStashesPerHour(t *testing.T) {
+	var fired atomic.Int32
+	l := NewLimiter("test", &config.TriggerLimitsConfiguration{MaxStashesPerHour: 2}, func(in *corev1.Event) { fired.Add(1) })
+
+	for i := 0; i < 5; i++ {
+		l.Trigger(createEvent("event", "pod"))
+	}
+
+	if fired.Load() != 2 {
+		t.Errorf("Expected the rate limit to allow 2 firings, got %v", fired.Load())
+	}
+}
+
+func TestLimiterMaxWait(t *testing.T) {
+	var fired atomic.Int32
+	l := NewLimiter("test", &config.TriggerLimitsConfiguration{Debounce: 200 * time.Millisecond, MaxWait: 300 * time.Millisecond}, func(in *corev1.Event) { fired.Add(1) })
+
+	// A continuous burst fires once the max wait has elapsed
+	for i := 0; i < 10; i++ {
+		l.Trigger(createEvent("event", "pod"))
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if fired.Load() != 1 {
+		t.Errorf("Expected the trigger to fire during the burst, got %v", fired.Load())
+	}
+}
+
+func TestLimiterFiresWithoutLock(t *testing.T) {
+	done := make(chan struct{})
+
+	var l *Limiter
+	l = NewLimiter("test", &config.TriggerLimitsConfiguration{Cooldown: time.Hour}, func(in *corev1.Event) {
+		// Triggering while firing is ignored by the cooldown
+		l.Trigger(createEvent("event", "pod"))
+		close(done)
+	})
+
+	go l.Trigger(createEvent("event", "pod"))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the trigger to fire without holding the lock")
+	}
+}
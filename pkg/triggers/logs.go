@@ -0,0 +1,343 @@
+package triggers
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ReasonLogPatternMatched is the reason of synthetic events for log lines
+// matching a watched pattern
+const ReasonLogPatternMatched = "LogPatternMatched"
+
+// maxLogLineLength limits how much of a matching log line is recorded
+const maxLogLineLength = 1024
+
+// maxLogScanLength is the longest log line which can be read
+const maxLogScanLength = 1024 * 1024
+
+// LogWatcher follows the logs of selected pods containers and triggers when
+// a line matches any of its patterns. Each matching line is recorded in the
+// buffer as a synthetic event before triggering.
+type LogWatcher struct {
+	Name string
+
+	cfg        config.LogWatcherConfiguration
+	patterns   []*regexp.Regexp
+	kubeClient kubernetes.Interface
+	namespace  string
+	recorder   EventRecorder
+	limiter    *Limiter
+	started    time.Time
+
+	mx      sync.Mutex
+	streams map[string]context.CancelFunc
+}
+
+// NewLogWatcher creates a new LogWatcher
+func NewLogWatcher(cfg config.LogWatcherConfiguration, defaultLimits *config.TriggerLimitsConfiguration, kubeClient kubernetes.Interface, namespace string, recorder EventRecorder, fire FireFunc) (*LogWatcher, error) {
+	if cfg.Name == "" {
+		cfg.Name = "logWatcher"
+	}
+
+	limits := cfg.Limits
+	if limits == nil {
+		limits = defaultLimits
+	}
+
+	w := &LogWatcher{
+		Name:       cfg.Name,
+		cfg:        cfg,
+		kubeClient: kubeClient,
+		namespace:  namespace,
+		recorder:   recorder,
+		limiter:    NewLimiter(cfg.Name, limits, fire),
+		started:    time.Now(),
+		streams:    make(map[string]context.CancelFunc),
+	}
+
+	for _, p := range cfg.Patterns {
+		pattern, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log pattern %q: %w", p, err)
+		}
+
+		w.patterns = append(w.patterns, pattern)
+	}
+
+	return w, nil
+}
+
+// Run starts following the logs of selected pods until the context is done
+func (w *LogWatcher) Run(ctx context.Context) {
+	selector := labels.SelectorFromSet(labels.Set(w.cfg.Labels)).String()
+
+	factory := informers.NewSharedInformerFactoryWithOptions(w.kubeClient, 0,
+		informers.WithNamespace(w.namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = selector
+		}))
+
+	factory.Core().V1().Pods().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if pod, ok := obj.(*corev1.Pod); ok {
+				w.followPod(ctx, pod)
+			}
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			if pod, ok := obj.(*corev1.Pod); ok {
+				w.followPod(ctx, pod)
+			}
+		},
+	})
+
+	factory.Start(ctx.Done())
+
+	log.Info("Watching pod logs", "trigger", w.Name, "namespace", w.namespace, "selector", selector)
+}
+
+// followPod starts following the logs of any of the pods running containers
+// which aren't already being followed, a restarted container has a new
+// container ID so its logs are followed again
+func (w *LogWatcher) followPod(ctx context.Context, pod *corev1.Pod) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.State.Running == nil || cs.ContainerID == "" {
+			continue
+		}
+
+		if len(w.cfg.Containers) != 0 && !slices.Contains(w.cfg.Containers, cs.Name) {
+			continue
+		}
+
+		key := fmt.Sprintf("%s/%s/%s/%s", pod.Namespace, pod.Name, cs.Name, cs.ContainerID)
+		if _, exists := w.streams[key]; exists {
+			continue
+		}
+
+		// Only lines logged since the collector started are of interest
+		since := cs.State.Running.StartedAt.Time
+		if since.Before(w.started) {
+			since = w.started
+		}
+
+		streamCtx, cancel := context.WithCancel(ctx)
+		w.streams[key] = cancel
+
+		go func(pod *corev1.Pod, container, containerID string) {
+			defer func() {
+				w.mx.Lock()
+				delete(w.streams, key)
+				w.mx.Unlock()
+				cancel()
+			}()
+
+			w.followContainer(streamCtx, pod, container, containerID, &logStream{since: since})
+		}(pod, cs.Name, cs.ContainerID)
+	}
+}
+
+// Log streams end on API server and kubelet timeouts or network errors, they
+// are reconnected with a backoff while the container is still running
+var (
+	minLogBackoff = time.Second
+	maxLogBackoff = time.Minute
+)
+
+// logStream tracks how far a containers logs have been read, so a stream
+// which is reconnected resumes after the last line read rather than
+// triggering on lines again
+type logStream struct {
+	since time.Time
+	// last is the timestamp of the last line read
+	last time.Time
+}
+
+// followContainer follows the containers logs until the container stops or
+// the context is done, reconnecting when a stream ends
+func (w *LogWatcher) followContainer(ctx context.Context, pod *corev1.Pod, container, containerID string, s *logStream) {
+	backoff := minLogBackoff
+
+	for {
+		last := s.last
+
+		if err := w.follow(ctx, pod, container, s); err != nil {
+			log.Error(err, "Failed to follow container logs", "trigger", w.Name, "pod", pod.Name, "container", container)
+		}
+
+		// Streams which read lines were working so reconnect promptly
+		if s.last.After(last) {
+			backoff = minLogBackoff
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		if !w.containerRunning(ctx, pod, container, containerID) {
+			return
+		}
+
+		log.V(1).Info("Reconnecting to container logs", "trigger", w.Name, "pod", pod.Name, "container", container)
+
+		if backoff *= 2; backoff > maxLogBackoff {
+			backoff = maxLogBackoff
+		}
+	}
+}
+
+// containerRunning returns whether the container is still running, a
+// restarted container has a new container ID and is followed separately
+func (w *LogWatcher) containerRunning(ctx context.Context, pod *corev1.Pod, container, containerID string) bool {
+	current, err := w.kubeClient.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+	if err != nil {
+		return false
+	}
+
+	for _, cs := range current.Status.ContainerStatuses {
+		if cs.Name == container {
+			return cs.ContainerID == containerID && cs.State.Running != nil
+		}
+	}
+
+	return false
+}
+
+// follow reads the containers logs from where the stream was last read up to
+// until the log stream ends or the context is done
+func (w *LogWatcher) follow(ctx context.Context, pod *corev1.Pod, container string, s *logStream) error {
+	since := s.since
+	if !s.last.IsZero() {
+		since = s.last
+	}
+
+	sinceTime := metav1.NewTime(since)
+
+	stream, err := w.kubeClient.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Container:  container,
+		Follow:     true,
+		SinceTime:  &sinceTime,
+		Timestamps: true,
+	}).Stream(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer stream.Close()
+
+	return w.scan(stream, pod, container, s)
+}
+
+// scan handles each line read from a log stream. Lines are prefixed with
+// their timestamp, lines at or before the last line read were already
+// handled before the stream was reconnected so are skipped.
+func (w *LogWatcher) scan(r io.Reader, pod *corev1.Pod, container string, s *logStream) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLogScanLength)
+
+	for scanner.Scan() {
+		ts, line := splitLogTimestamp(scanner.Text())
+
+		if !ts.IsZero() {
+			if !s.last.IsZero() && !ts.After(s.last) {
+				continue
+			}
+
+			s.last = ts
+		}
+
+		w.HandleLine(pod, container, line)
+	}
+
+	if err := scanner.Err(); err != nil && err != context.Canceled {
+		return err
+	}
+
+	return nil
+}
+
+// splitLogTimestamp splits the timestamp the kubelet prefixes log lines with
+// from the line, the timestamp is zero if the line doesn't have one
+func splitLogTimestamp(line string) (time.Time, string) {
+	prefix, rest, found := strings.Cut(line, " ")
+	if !found {
+		return time.Time{}, line
+	}
+
+	ts, err := time.Parse(time.RFC3339Nano, prefix)
+	if err != nil {
+		return time.Time{}, line
+	}
+
+	return ts, rest
+}
+
+// HandleLine checks a log line against the patterns, recording and
+// triggering if it matches any
+func (w *LogWatcher) HandleLine(pod *corev1.Pod, container, line string) {
+	for _, pattern := range w.patterns {
+		if !pattern.MatchString(line) {
+			continue
+		}
+
+		line = truncateLine(line)
+
+		ref := corev1.ObjectReference{
+			APIVersion:      "v1",
+			Kind:            "Pod",
+			Name:            pod.Name,
+			Namespace:       pod.Namespace,
+			UID:             pod.UID,
+			ResourceVersion: pod.ResourceVersion,
+			FieldPath:       fmt.Sprintf("spec.containers{%s}", container),
+		}
+
+		msg := fmt.Sprintf("Container %s logged a line matching %q: %s", container, pattern.String(), line)
+		e := NewSyntheticEvent(ref, corev1.EventTypeWarning, ReasonLogPatternMatched, msg)
+
+		log.Info("Log pattern matched", "trigger", w.Name, "pod", pod.Name, "container", container, "pattern", pattern.String())
+
+		if w.recorder != nil {
+			w.recorder.RecordEvent(e)
+		}
+
+		w.limiter.Trigger(e)
+
+		return
+	}
+}
+
+// truncateLine limits a log line to maxLogLineLength bytes, without splitting
+// a multi-byte character
+func truncateLine(line string) string {
+	if len(line) <= maxLogLineLength {
+		return line
+	}
+
+	end := maxLogLineLength
+	for end > 0 && !utf8.RuneStart(line[end]) {
+		end--
+	}
+
+	return line[:end] + "..."
+}
@@ -0,0 +1,191 @@
+package triggers
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func initTestLogWatcher(t *testing.T, patterns ...string) (*LogWatcher, *testRecorder, *[]*corev1.Event) {
+	recorder := &testRecorder{}
+	fired := &[]*corev1.Event{}
+
+	w, err := NewLogWatcher(config.LogWatcherConfiguration{Patterns: patterns}, nil, fake.NewSimpleClientset(), "default", recorder, func(in *corev1.Event) {
+		*fired = append(*fired, in)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return w, recorder, fired
+}
+
+func TestLogWatcherPatterns(t *testing.T) {
+	w, recorder, fired := initTestLogWatcher(t, `reconcile failed`, `^panic:`)
+	pod := createPod()
+
+	logs := strings.Join([]string{
+		`{"level":"info","msg":"reconcile completed"}`,
+		`{"level":"error","msg":"reconcile failed","error":"timeout"}`,
+		`panic: runtime error: invalid memory address`,
+		`goroutine 1 [running]:`,
+	}, "\n")
+
+	if err := w.scan(strings.NewReader(logs), pod, "operator", &logStream{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*fired) != 2 {
+		t.Fatalf("expected 2 triggers, got %d", len(*fired))
+	}
+
+	if len(recorder.events) != 2 {
+		t.Fatalf("expected 2 recorded events, got %d", len(recorder.events))
+	}
+
+	e := recorder.events[0]
+	if e.Reason != ReasonLogPatternMatched || e.InvolvedObject.Name != pod.Name || !strings.Contains(e.Message, "reconcile failed") {
+		t.Fatalf("unexpected synthetic event %v", e)
+	}
+}
+
+func TestLogWatcherInvalidPattern(t *testing.T) {
+	_, err := NewLogWatcher(config.LogWatcherConfiguration{Patterns: []string{"("}}, nil, nil, "default", nil, nil)
+	if err == nil {
+		t.Fatal("expected an invalid pattern to fail")
+	}
+}
+
+func TestLogWatcherFollow(t *testing.T) {
+	// The fake client always returns "fake logs"
+	w, _, fired := initTestLogWatcher(t, `fake`)
+
+	if err := w.follow(context.Background(), createPod(), "couchbase-server", &logStream{since: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*fired) != 1 {
+		t.Fatalf("expected 1 trigger, got %d", len(*fired))
+	}
+}
+
+func TestLogWatcherResumesAfterLastLine(t *testing.T) {
+	w, _, fired := initTestLogWatcher(t, `failed`)
+	pod := createPod()
+	s := &logStream{}
+
+	first := strings.Join([]string{
+		`2024-01-01T10:00:00.100000000Z reconcile failed`,
+		`2024-01-01T10:00:00.200000000Z reconcile completed`,
+	}, "\n")
+
+	if err := w.scan(strings.NewReader(first), pod, "operator", s); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reconnected stream starts from the last lines second, so repeats
+	// the lines already read
+	second := strings.Join([]string{
+		`2024-01-01T10:00:00.100000000Z reconcile failed`,
+		`2024-01-01T10:00:00.200000000Z reconcile completed`,
+		`2024-01-01T10:00:01.000000000Z backup failed`,
+	}, "\n")
+
+	if err := w.scan(strings.NewReader(second), pod, "operator", s); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*fired) != 2 || !strings.Contains((*fired)[1].Message, "backup failed") {
+		t.Fatalf("expected each matching line to trigger once, got %v", *fired)
+	}
+
+	if !s.last.Equal(time.Date(2024, 1, 1, 10, 0, 1, 0, time.UTC)) {
+		t.Errorf("expected the last line read to be tracked, got %v", s.last)
+	}
+}
+
+func TestLogWatcherReconnects(t *testing.T) {
+	minLogBackoff, maxLogBackoff = time.Millisecond, 10*time.Millisecond
+	defer func() {
+		minLogBackoff, maxLogBackoff = time.Second, time.Minute
+	}()
+
+	pod := createPod()
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+		Name:        "couchbase-server",
+		ContainerID: "containerd://1",
+		State:       corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+	}}
+
+	var fired atomic.Int32
+	w, err := NewLogWatcher(config.LogWatcherConfiguration{Patterns: []string{"fake"}}, nil, fake.NewSimpleClientset(pod), "default", nil, func(in *corev1.Event) {
+		fired.Add(1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		w.followContainer(ctx, pod, "couchbase-server", "containerd://1", &logStream{})
+		close(done)
+	}()
+
+	// The fake client's log stream ends immediately, so is reconnected
+	// while the container is running
+	deadline := time.Now().Add(5 * time.Second)
+	for fired.Load() < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	<-done
+
+	if fired.Load() < 3 {
+		t.Fatalf("expected the log stream to be reconnected, got %d triggers", fired.Load())
+	}
+}
+
+func TestLogWatcherStopsWhenContainerStops(t *testing.T) {
+	minLogBackoff = time.Millisecond
+	defer func() {
+		minLogBackoff = time.Second
+	}()
+
+	// The pod isn't running so the stream isn't reconnected
+	w, _, _ := initTestLogWatcher(t, `fake`)
+
+	done := make(chan struct{})
+	go func() {
+		w.followContainer(context.Background(), createPod(), "couchbase-server", "containerd://1", &logStream{})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected following to stop once the container isn't running")
+	}
+}
+
+func TestTruncateLine(t *testing.T) {
+	if line := truncateLine("short"); line != "short" {
+		t.Errorf("expected a short line to be unchanged, got %q", line)
+	}
+
+	// The multi-byte character straddles the limit
+	line := truncateLine(strings.Repeat("a", maxLogLineLength-1) + "é" + "b")
+	if !utf8.ValidString(line) || line != strings.Repeat("a", maxLogLineLength-1)+"..." {
+		t.Errorf("expected the line to be truncated before the character, got %q", line[len(line)-8:])
+	}
+}
@@ -0,0 +1,270 @@
+package triggers
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// ReasonContainerTerminated is the reason of synthetic events for
+	// containers terminating with a watched reason
+	ReasonContainerTerminated = "ContainerTerminated"
+	// ReasonContainerRestarting is the reason of synthetic events for
+	// containers exceeding the restart threshold
+	ReasonContainerRestarting = "ContainerRestarting"
+	// ReasonCrashLoopBackOff is the reason of synthetic events for
+	// containers entering CrashLoopBackOff
+	ReasonCrashLoopBackOff = "CrashLoopBackOff"
+)
+
+const defaultRestartWindow = 10 * time.Minute
+
+var defaultTerminationReasons = []string{"OOMKilled", "Error"}
+
+// PodWatcher watches pods and triggers when their containers terminate,
+// restart too often or enter CrashLoopBackOff. A synthetic event describing
+// the failure is recorded in the buffer before triggering.
+type PodWatcher struct {
+	Name string
+
+	cfg        config.PodWatcherConfiguration
+	kubeClient kubernetes.Interface
+	namespace  string
+	recorder   EventRecorder
+	limiter    *Limiter
+
+	mx       sync.Mutex
+	restarts map[string][]occurrence
+}
+
+// NewPodWatcher creates a new PodWatcher
+func NewPodWatcher(cfg config.PodWatcherConfiguration, defaultLimits *config.TriggerLimitsConfiguration, kubeClient kubernetes.Interface, namespace string, recorder EventRecorder, fire FireFunc) *PodWatcher {
+	if cfg.Name == "" {
+		cfg.Name = "podWatcher"
+	}
+
+	if cfg.TerminationReasons == nil {
+		cfg.TerminationReasons = defaultTerminationReasons
+	}
+
+	if cfg.RestartWindow <= 0 {
+		cfg.RestartWindow = defaultRestartWindow
+	}
+
+	limits := cfg.Limits
+	if limits == nil {
+		limits = defaultLimits
+	}
+
+	return &PodWatcher{
+		Name:       cfg.Name,
+		cfg:        cfg,
+		kubeClient: kubeClient,
+		namespace:  namespace,
+		recorder:   recorder,
+		limiter:    NewLimiter(cfg.Name, limits, fire),
+		restarts:   make(map[string][]occurrence),
+	}
+}
+
+// Run starts watching pods until the context is done
+func (w *PodWatcher) Run(ctx context.Context) {
+	selector := labels.SelectorFromSet(labels.Set(w.cfg.Labels)).String()
+
+	factory := informers.NewSharedInformerFactoryWithOptions(w.kubeClient, 0,
+		informers.WithNamespace(w.namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = selector
+		}))
+
+	factory.Core().V1().Pods().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPod, ok := oldObj.(*corev1.Pod)
+			if !ok {
+				return
+			}
+
+			newPod, ok := newObj.(*corev1.Pod)
+			if !ok {
+				return
+			}
+
+			w.HandleUpdate(oldPod, newPod)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+
+			if pod, ok := obj.(*corev1.Pod); ok {
+				w.forget(pod)
+			}
+		},
+	})
+
+	factory.Start(ctx.Done())
+
+	log.Info("Watching pods", "trigger", w.Name, "namespace", w.namespace, "selector", selector)
+}
+
+// HandleUpdate compares the container statuses of a pod before and after an
+// update, recording and triggering for any failures
+func (w *PodWatcher) HandleUpdate(oldPod, newPod *corev1.Pod) {
+	for _, e := range w.detect(oldPod, newPod) {
+		log.Info("Pod failure detected", "trigger", w.Name, "pod", newPod.Name, "reason", e.Reason, "msg", e.Message)
+
+		if w.recorder != nil {
+			w.recorder.RecordEvent(e)
+		}
+
+		w.limiter.Trigger(e)
+	}
+}
+
+func (w *PodWatcher) detect(oldPod, newPod *corev1.Pod) []*corev1.Event {
+	var events []*corev1.Event
+
+	ref := corev1.ObjectReference{
+		APIVersion:      "v1",
+		Kind:            "Pod",
+		Name:            newPod.Name,
+		Namespace:       newPod.Namespace,
+		UID:             newPod.UID,
+		ResourceVersion: newPod.ResourceVersion,
+	}
+
+	oldStatuses := map[string]corev1.ContainerStatus{}
+	for _, cs := range containerStatuses(oldPod) {
+		oldStatuses[cs.Name] = cs
+	}
+
+	for _, cs := range containerStatuses(newPod) {
+		old := oldStatuses[cs.Name]
+
+		if t := newTermination(old, cs); t != nil && slices.Contains(w.cfg.TerminationReasons, t.Reason) {
+			msg := fmt.Sprintf("Container %s terminated with reason %s (exit code %d)", cs.Name, t.Reason, t.ExitCode)
+			events = append(events, NewSyntheticEvent(ref, corev1.EventTypeWarning, ReasonContainerTerminated, msg))
+		}
+
+		if w.cfg.CrashLoopBackOff && isCrashLooping(cs) && !isCrashLooping(old) {
+			msg := fmt.Sprintf("Container %s entered CrashLoopBackOff after %d restarts", cs.Name, cs.RestartCount)
+			events = append(events, NewSyntheticEvent(ref, corev1.EventTypeWarning, ReasonCrashLoopBackOff, msg))
+		}
+
+		if w.cfg.RestartThreshold > 0 && cs.RestartCount > old.RestartCount && old.Name != "" {
+			if restarts := w.recordRestarts(newPod, cs.Name, int(cs.RestartCount-old.RestartCount)); restarts >= w.cfg.RestartThreshold {
+				msg := fmt.Sprintf("Container %s restarted %d times within %s", cs.Name, restarts, w.cfg.RestartWindow)
+				events = append(events, NewSyntheticEvent(ref, corev1.EventTypeWarning, ReasonContainerRestarting, msg))
+			}
+		}
+	}
+
+	return events
+}
+
+// recordRestarts records restarts of a container and returns how many there
+// have been within the restart window, the count is reset once it reaches
+// the threshold
+func (w *PodWatcher) recordRestarts(pod *corev1.Pod, container string, restarts int) int {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	now := time.Now()
+	w.prune(now)
+
+	key := restartKey(pod, container)
+
+	total := restarts
+	for _, o := range w.restarts[key] {
+		total += o.count
+	}
+
+	if total >= w.cfg.RestartThreshold {
+		delete(w.restarts, key)
+	} else {
+		w.restarts[key] = append(w.restarts[key], occurrence{time: now, count: restarts})
+	}
+
+	return total
+}
+
+// prune removes restarts which are outside the restart window
+func (w *PodWatcher) prune(now time.Time) {
+	for key, restarts := range w.restarts {
+		i := 0
+		for i < len(restarts) && now.Sub(restarts[i].time) >= w.cfg.RestartWindow {
+			i++
+		}
+
+		if i == len(restarts) {
+			delete(w.restarts, key)
+		} else {
+			w.restarts[key] = restarts[i:]
+		}
+	}
+}
+
+// forget removes the restarts recorded for a deleted pods containers
+func (w *PodWatcher) forget(pod *corev1.Pod) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	prefix := restartKey(pod, "")
+	for key := range w.restarts {
+		if strings.HasPrefix(key, prefix) {
+			delete(w.restarts, key)
+		}
+	}
+}
+
+func restartKey(pod *corev1.Pod, container string) string {
+	return fmt.Sprintf("%s/%s/%s", pod.Namespace, pod.Name, container)
+}
+
+// newTermination returns the containers termination if it has terminated
+// since the old status
+func newTermination(old, cs corev1.ContainerStatus) *corev1.ContainerStateTerminated {
+	t := cs.State.Terminated
+
+	// If the container has already been restarted the termination is only
+	// in the last state
+	if t == nil && cs.RestartCount > old.RestartCount {
+		t = cs.LastTerminationState.Terminated
+	}
+
+	if t == nil {
+		return nil
+	}
+
+	for _, seen := range []*corev1.ContainerStateTerminated{old.State.Terminated, old.LastTerminationState.Terminated} {
+		if seen != nil && seen.ContainerID == t.ContainerID && seen.FinishedAt.Equal(&t.FinishedAt) {
+			return nil
+		}
+	}
+
+	return t
+}
+
+// containerStatuses returns the statuses of all a pods containers, a new slice
+// is used as pods from the informer cache mustn't be modified
+func containerStatuses(pod *corev1.Pod) []corev1.ContainerStatus {
+	statuses := make([]corev1.ContainerStatus, 0, len(pod.Status.InitContainerStatuses)+len(pod.Status.ContainerStatuses))
+	statuses = append(statuses, pod.Status.InitContainerStatuses...)
+	return append(statuses, pod.Status.ContainerStatuses...)
+}
+
+func isCrashLooping(cs corev1.ContainerStatus) bool {
+	return cs.State.Waiting != nil && cs.State.Waiting.Reason == ReasonCrashLoopBackOff
+}
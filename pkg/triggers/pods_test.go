@@ -0,0 +1,175 @@
+package triggers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type testRecorder struct {
+	events []*corev1.Event
+}
+
+func (r *testRecorder) RecordEvent(e *corev1.Event) {
+	r.events = append(r.events, e)
+}
+
+func createPod(statuses ...corev1.ContainerStatus) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "couchbase-0000",
+			Namespace: "default",
+		},
+		Status: corev1.PodStatus{
+			ContainerStatuses: statuses,
+		},
+	}
+}
+
+func runningStatus(restarts int32) corev1.ContainerStatus {
+	return corev1.ContainerStatus{
+		Name:         "couchbase-server",
+		RestartCount: restarts,
+		State:        corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+	}
+}
+
+func terminatedStatus(restarts int32, reason string, exitCode int32) corev1.ContainerStatus {
+	return corev1.ContainerStatus{
+		Name:         "couchbase-server",
+		RestartCount: restarts,
+		State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{
+			Reason:      reason,
+			ExitCode:    exitCode,
+			ContainerID: "container-1",
+			FinishedAt:  v1.NewTime(time.Now().Truncate(time.Second)),
+		}},
+	}
+}
+
+func initTestPodWatcher(cfg config.PodWatcherConfiguration) (*PodWatcher, *testRecorder, *[]*corev1.Event) {
+	recorder := &testRecorder{}
+	fired := &[]*corev1.Event{}
+
+	w := NewPodWatcher(cfg, nil, nil, "default", recorder, func(in *corev1.Event) {
+		*fired = append(*fired, in)
+	})
+
+	return w, recorder, fired
+}
+
+func TestPodWatcherOOMKilled(t *testing.T) {
+	w, recorder, fired := initTestPodWatcher(config.PodWatcherConfiguration{})
+
+	terminated := terminatedStatus(0, "OOMKilled", 137)
+	w.HandleUpdate(createPod(runningStatus(0)), createPod(terminated))
+
+	if len(*fired) != 1 || len(recorder.events) != 1 {
+		t.Fatalf("Expected OOMKilled container to be recorded and trigger, fired %v recorded %v", len(*fired), len(recorder.events))
+	}
+
+	e := recorder.events[0]
+	if e.Reason != ReasonContainerTerminated || e.Type != corev1.EventTypeWarning || e.InvolvedObject.Name != "couchbase-0000" {
+		t.Errorf("Unexpected synthetic event: %+v", e)
+	}
+
+	// Once restarted the same termination is in the last state and
+	// shouldn't trigger again
+	restarted := runningStatus(1)
+	restarted.LastTerminationState = terminated.State
+	w.HandleUpdate(createPod(terminated), createPod(restarted))
+
+	if len(*fired) != 1 {
+		t.Errorf("Expected the same termination not to trigger twice")
+	}
+}
+
+func TestPodWatcherTerminationMissedWhileRunning(t *testing.T) {
+	w, _, fired := initTestPodWatcher(config.PodWatcherConfiguration{})
+
+	restarted := runningStatus(1)
+	restarted.LastTerminationState = terminatedStatus(0, "Error", 1).State
+	w.HandleUpdate(createPod(runningStatus(0)), createPod(restarted))
+
+	if len(*fired) != 1 {
+		t.Errorf("Expected a termination only in the last state to trigger")
+	}
+}
+
+func TestPodWatcherIgnoredReason(t *testing.T) {
+	w, _, fired := initTestPodWatcher(config.PodWatcherConfiguration{TerminationReasons: []string{"OOMKilled"}})
+
+	w.HandleUpdate(createPod(runningStatus(0)), createPod(terminatedStatus(0, "Completed", 0)))
+	w.HandleUpdate(createPod(runningStatus(0)), createPod(terminatedStatus(0, "Error", 1)))
+
+	if len(*fired) != 0 {
+		t.Errorf("Expected unwatched termination reasons to be ignored")
+	}
+}
+
+func TestPodWatcherCrashLoopBackOff(t *testing.T) {
+	w, _, fired := initTestPodWatcher(config.PodWatcherConfiguration{CrashLoopBackOff: true, TerminationReasons: []string{}})
+
+	waiting := runningStatus(3)
+	waiting.State = corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: ReasonCrashLoopBackOff}}
+
+	w.HandleUpdate(createPod(runningStatus(3)), createPod(waiting))
+	w.HandleUpdate(createPod(waiting), createPod(waiting))
+
+	if len(*fired) != 1 || (*fired)[0].Reason != ReasonCrashLoopBackOff {
+		t.Errorf("Expected entering CrashLoopBackOff to trigger once, fired %v", len(*fired))
+	}
+}
+
+func TestPodWatcherRestartThreshold(t *testing.T) {
+	w, _, fired := initTestPodWatcher(config.PodWatcherConfiguration{RestartThreshold: 3, TerminationReasons: []string{}})
+
+	for i := int32(0); i < 3; i++ {
+		w.HandleUpdate(createPod(runningStatus(i)), createPod(runningStatus(i+1)))
+	}
+
+	if len(*fired) != 1 || (*fired)[0].Reason != ReasonContainerRestarting {
+		t.Errorf("Expected restart threshold to trigger once, fired %v", len(*fired))
+	}
+}
+
+func TestPodWatcherRestartsPruned(t *testing.T) {
+	w, _, fired := initTestPodWatcher(config.PodWatcherConfiguration{RestartThreshold: 3, RestartWindow: time.Minute, TerminationReasons: []string{}})
+
+	w.HandleUpdate(createPod(runningStatus(0)), createPod(runningStatus(1)))
+
+	// Restarts outside the window are dropped, even for other pods
+	w.restarts["default/other/couchbase-server"] = []occurrence{{time: time.Now().Add(-2 * time.Minute), count: 1}}
+	for key := range w.restarts {
+		w.restarts[key][0].time = time.Now().Add(-2 * time.Minute)
+	}
+
+	w.HandleUpdate(createPod(runningStatus(1)), createPod(runningStatus(2)))
+
+	if len(w.restarts) != 1 || len(w.restarts["default/couchbase-0000/couchbase-server"]) != 1 {
+		t.Errorf("Expected restarts outside the window to be pruned, got %v", w.restarts)
+	}
+
+	if len(*fired) != 0 {
+		t.Errorf("Expected no triggers, fired %v", len(*fired))
+	}
+}
+
+func TestPodWatcherForget(t *testing.T) {
+	w, _, _ := initTestPodWatcher(config.PodWatcherConfiguration{RestartThreshold: 3, TerminationReasons: []string{}})
+
+	w.HandleUpdate(createPod(runningStatus(0)), createPod(runningStatus(1)))
+
+	other := createPod(runningStatus(1))
+	other.Name = "couchbase-0001"
+	w.HandleUpdate(createPod(runningStatus(0)), other)
+
+	w.forget(createPod())
+
+	if len(w.restarts) != 1 || w.restarts["default/couchbase-0001/couchbase-server"] == nil {
+		t.Errorf("Expected only the deleted pods restarts to be removed, got %v", w.restarts)
+	}
+}
@@ -0,0 +1,109 @@
+package triggers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	"github.com/couchbase/k8s-event-collector/pkg/filters"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Rule is a named stash trigger which fires when matching events are seen
+type Rule struct {
+	Name   string
+	Config config.StashTriggerConfiguration
+	Filter *filters.FilterSet
+
+	threshold *Threshold
+	heartbeat *Heartbeat
+	limiter   *Limiter
+}
+
+// Rules is a set of trigger rules which are each evaluated against events
+type Rules []*Rule
+
+// NewRule creates a new Rule from config, the rules limits default to
+// defaultLimits if it doesn't have its own. Absence rules record a synthetic
+// event with the recorder when they fire.
+func NewRule(cfg config.StashTriggerConfiguration, defaultLimits *config.TriggerLimitsConfiguration, kubeClient kubernetes.Interface, recorder EventRecorder, fire FireFunc) *Rule {
+	eventType := cfg.EventType
+	if eventType == "" && cfg.EventFilters == nil && cfg.ExpectEvery <= 0 {
+		eventType = corev1.EventTypeWarning
+	}
+
+	limits := cfg.Limits
+	if limits == nil {
+		limits = defaultLimits
+	}
+
+	r := &Rule{
+		Name:    cfg.Name,
+		Config:  cfg,
+		Filter:  filters.NewFilterSet(cfg.Name, eventType, cfg.EventFilters, kubeClient),
+		limiter: NewLimiter(cfg.Name, limits, fire),
+	}
+
+	if cfg.Threshold != nil {
+		r.threshold = NewThreshold(*cfg.Threshold)
+	}
+
+	if cfg.ExpectEvery > 0 {
+		r.heartbeat = NewHeartbeat(cfg.ExpectEvery, func(lastSeen time.Time) {
+			e := r.newAbsenceEvent(lastSeen)
+
+			log.Info("Expected events are absent", "rule", r.Name, "lastSeen", lastSeen)
+
+			if recorder != nil {
+				recorder.RecordEvent(e)
+			}
+
+			r.limiter.Trigger(e)
+		})
+	}
+
+	return r
+}
+
+func (r *Rule) newAbsenceEvent(lastSeen time.Time) *corev1.Event {
+	ref := corev1.ObjectReference{
+		Kind: "EventCollector",
+		Name: r.Name,
+	}
+
+	msg := fmt.Sprintf("No events matching rule %s seen for %s, last seen at %s", r.Name, r.Config.ExpectEvery, lastSeen.Format(time.RFC3339))
+
+	return NewSyntheticEvent(ref, corev1.EventTypeWarning, ReasonEventsAbsent, msg)
+}
+
+// Handle evaluates the event against the rule and fires it if the event
+// matches and the rules threshold and limits allow it. Matching events reset
+// absence rules instead.
+func (r *Rule) Handle(in *corev1.Event) {
+	if !r.Filter.Match(in) {
+		return
+	}
+
+	if r.heartbeat != nil {
+		if r.heartbeat.Absent() {
+			log.Info("Expected events have resumed", "rule", r.Name)
+		}
+
+		r.heartbeat.Observe()
+		return
+	}
+
+	if r.threshold != nil && !r.threshold.Observe(in) {
+		return
+	}
+
+	r.limiter.Trigger(in)
+}
+
+// Handle evaluates the event against every rule
+func (rs Rules) Handle(in *corev1.Event) {
+	for _, r := range rs {
+		r.Handle(in)
+	}
+}
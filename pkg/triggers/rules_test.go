@@ -0,0 +1,97 @@
+package triggers
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestRulesFireIndependently(t *testing.T) {
+	fired := map[string]int{}
+
+	rules := Rules{
+		NewRule(config.StashTriggerConfiguration{Name: "warnings"}, nil, nil, nil, func(in *corev1.Event) { fired["warnings"]++ }),
+		NewRule(config.StashTriggerConfiguration{
+			Name:         "deployments",
+			EventType:    corev1.EventTypeNormal,
+			EventFilters: []config.KubernetesResourceFilter{{Resource: "Deployment"}},
+		}, nil, nil, nil, func(in *corev1.Event) { fired["deployments"]++ }),
+	}
+
+	rules.Handle(createEvent("warning", "pod"))
+
+	e := createEvent("normal", "deployment")
+	e.Type = corev1.EventTypeNormal
+	e.InvolvedObject.Kind = "Deployment"
+	rules.Handle(e)
+
+	if fired["warnings"] != 1 || fired["deployments"] != 1 {
+		t.Errorf("Expected each rule to fire once, got %v", fired)
+	}
+}
+
+func TestRuleLimitsOverrideDefaults(t *testing.T) {
+	fired := 0
+	defaultLimits := &config.TriggerLimitsConfiguration{MaxStashesPerHour: 1}
+
+	rule := NewRule(config.StashTriggerConfiguration{
+		Name:   "unlimited",
+		Limits: &config.TriggerLimitsConfiguration{},
+	}, defaultLimits, nil, nil, func(in *corev1.Event) { fired++ })
+
+	for i := 0; i < 3; i++ {
+		rule.Handle(createEvent("warning", "pod"))
+	}
+
+	if fired != 3 {
+		t.Errorf("Expected the rules own limits to be used, got %v firings", fired)
+	}
+}
+
+func TestAbsenceRule(t *testing.T) {
+	var mx sync.Mutex
+	var fired []*corev1.Event
+	recorder := &testRecorder{}
+
+	rule := NewRule(config.StashTriggerConfiguration{
+		Name:         "reconciling",
+		EventFilters: []config.KubernetesResourceFilter{{Resource: "CouchbaseCluster"}},
+		ExpectEvery:  100 * time.Millisecond,
+	}, nil, nil, recorder, func(in *corev1.Event) {
+		mx.Lock()
+		defer mx.Unlock()
+		fired = append(fired, in)
+	})
+	defer rule.heartbeat.Stop()
+
+	e := createEvent("reconciled", "cluster")
+	e.Type = corev1.EventTypeNormal
+	e.InvolvedObject.Kind = "CouchbaseCluster"
+
+	for i := 0; i < 3; i++ {
+		rule.Handle(e)
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	mx.Lock()
+	if len(fired) != 0 {
+		t.Fatalf("expected no firing while matching events are seen, got %d", len(fired))
+	}
+	mx.Unlock()
+
+	time.Sleep(200 * time.Millisecond)
+
+	mx.Lock()
+	defer mx.Unlock()
+
+	if len(fired) != 1 || fired[0].Reason != ReasonEventsAbsent {
+		t.Fatalf("expected the rule to fire once for absent events, got %v", fired)
+	}
+
+	if len(recorder.events) != 1 || recorder.events[0].Type != corev1.EventTypeWarning {
+		t.Fatalf("expected a synthetic warning event, got %v", recorder.events)
+	}
+}
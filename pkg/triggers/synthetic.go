@@ -0,0 +1,45 @@
+package triggers
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+)
+
+// SyntheticEventComponent is the source component of events created by the
+// collector to record things it observed which weren't reported as events
+const SyntheticEventComponent = "event-collector"
+
+// The EventRecorder interface records synthetic events in the buffer
+type EventRecorder interface {
+	RecordEvent(*corev1.Event)
+}
+
+// NewSyntheticEvent creates an event for the involved object, synthetic
+// events are only recorded in the buffer and aren't created in Kubernetes
+func NewSyntheticEvent(obj corev1.ObjectReference, eventType, reason, message string) *corev1.Event {
+	now := metav1.NewTime(time.Now())
+	uid := uuid.NewUUID()
+
+	return &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              fmt.Sprintf("%s.%s", obj.Name, uid[:8]),
+			Namespace:         obj.Namespace,
+			UID:               uid,
+			CreationTimestamp: now,
+		},
+		InvolvedObject: obj,
+		Reason:         reason,
+		Message:        message,
+		Source: corev1.EventSource{
+			Component: SyntheticEventComponent,
+		},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           eventType,
+	}
+}
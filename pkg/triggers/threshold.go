@@ -0,0 +1,160 @@
+package triggers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// GroupByObject counts events separately for each involved object
+	GroupByObject = "object"
+	// GroupByReason counts events separately for each event reason
+	GroupByReason = "reason"
+	// GroupByKind counts events separately for each involved object kind
+	GroupByKind = "kind"
+)
+
+// defaultThresholdWindow is the window used if a threshold of more than one
+// event doesn't set one, without a window every event would be forgotten
+// immediately so the count could never be reached
+const defaultThresholdWindow = 5 * time.Minute
+
+// occurrence is when an event was seen and its count, either the number of
+// new occurrences in a group or the events total count when last seen
+type occurrence struct {
+	time  time.Time
+	count int
+}
+
+// Threshold counts matching events over a sliding window and reports when
+// the configured count has been reached
+type Threshold struct {
+	cfg config.ThresholdConfiguration
+
+	mx     sync.Mutex
+	groups map[string][]occurrence
+	seen   map[types.UID]occurrence
+}
+
+// NewThreshold creates a new Threshold, the window defaults to 5m if more
+// than one event is needed
+func NewThreshold(cfg config.ThresholdConfiguration) *Threshold {
+	if cfg.Count > 1 && cfg.Window <= 0 {
+		cfg.Window = defaultThresholdWindow
+	}
+
+	return &Threshold{
+		cfg:    cfg,
+		groups: make(map[string][]occurrence),
+		seen:   make(map[types.UID]occurrence),
+	}
+}
+
+// Observe records a matching event and returns true if the threshold has been
+// reached, the events group is then reset so it has to be reached again
+// before firing again
+func (t *Threshold) Observe(in *corev1.Event) bool {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	now := time.Now()
+	t.prune(now)
+
+	n := t.occurrences(in, now)
+	if n == 0 {
+		return false
+	}
+
+	key := groupKey(t.cfg.GroupBy, in)
+	group := append(t.groups[key], occurrence{time: now, count: n})
+
+	total := 0
+	for _, o := range group {
+		total += o.count
+	}
+
+	if total >= t.cfg.Count {
+		delete(t.groups, key)
+		return true
+	}
+
+	t.groups[key] = group
+
+	return false
+}
+
+// occurrences returns how many new occurrences this event represents. Events
+// are delivered again when updated so only the increase in count is used, an
+// event which hasn't been seen within the window counts as one occurrence as
+// its earlier occurrences may be much older.
+func (t *Threshold) occurrences(in *corev1.Event, now time.Time) int {
+	count := eventCount(in)
+	prev, exists := t.seen[in.UID]
+	t.seen[in.UID] = occurrence{time: now, count: count}
+
+	if !exists {
+		return 1
+	}
+
+	if !t.cfg.CountIncrements || count <= prev.count {
+		return 0
+	}
+
+	return count - prev.count
+}
+
+// groupKey returns the group an event is counted in, all events are in the
+// same group if groupBy isn't set
+func groupKey(groupBy string, in *corev1.Event) string {
+	switch groupBy {
+	case GroupByObject:
+		return objectKey(in)
+	case GroupByReason:
+		return in.Reason
+	case GroupByKind:
+		return in.InvolvedObject.APIVersion + "/" + in.InvolvedObject.Kind
+	default:
+		return ""
+	}
+}
+
+// prune removes occurrences and seen events which are outside the window
+func (t *Threshold) prune(now time.Time) {
+	for key, group := range t.groups {
+		i := 0
+		for i < len(group) && now.Sub(group[i].time) >= t.cfg.Window {
+			i++
+		}
+
+		if i == len(group) {
+			delete(t.groups, key)
+		} else {
+			t.groups[key] = group[i:]
+		}
+	}
+
+	for uid, s := range t.seen {
+		if now.Sub(s.time) >= t.cfg.Window {
+			delete(t.seen, uid)
+		}
+	}
+}
+
+// eventCount returns the number of times an event has occurred
+func eventCount(in *corev1.Event) int {
+	count := int(in.Count)
+
+	if in.Series != nil && int(in.Series.Count) > count {
+		count = int(in.Series.Count)
+	}
+
+	if count < 1 {
+		return 1
+	}
+
+	return count
+}
@@ -0,0 +1,129 @@
+package triggers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbase/k8s-event-collector/pkg/config"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/rand"
+)
+
+func TestThresholdCount(t *testing.T) {
+	th := NewThreshold(config.ThresholdConfiguration{Count: 3, Window: time.Minute})
+
+	for i := 0; i < 2; i++ {
+		e := createEvent("event", "pod")
+		e.UID = types.UID(rand.String(36))
+		if th.Observe(e) {
+			t.Errorf("Threshold should not be reached after %v events", i+1)
+		}
+	}
+
+	e := createEvent("event", "pod")
+	e.UID = types.UID(rand.String(36))
+	if !th.Observe(e) {
+		t.Errorf("Threshold should be reached after 3 events")
+	}
+
+	e = createEvent("event", "pod")
+	e.UID = types.UID(rand.String(36))
+	if th.Observe(e) {
+		t.Errorf("Threshold should be reset after firing")
+	}
+}
+
+func TestThresholdWindow(t *testing.T) {
+	th := NewThreshold(config.ThresholdConfiguration{Count: 2, Window: 100 * time.Millisecond})
+
+	e := createEvent("event", "pod")
+	e.UID = "first"
+	th.Observe(e)
+
+	time.Sleep(150 * time.Millisecond)
+
+	e = createEvent("event", "pod")
+	e.UID = "second"
+	if th.Observe(e) {
+		t.Errorf("Events outside the window should not be counted")
+	}
+}
+
+func TestThresholdGroupByObject(t *testing.T) {
+	th := NewThreshold(config.ThresholdConfiguration{Count: 2, Window: time.Minute, GroupBy: GroupByObject})
+
+	for i, object := range []string{"pod-1", "pod-2", "pod-3"} {
+		e := createEvent("event", object)
+		e.UID = types.UID(rand.String(36))
+		if th.Observe(e) {
+			t.Errorf("Events for different objects should be counted separately, fired on %v", i)
+		}
+	}
+
+	e := createEvent("event", "pod-1")
+	e.UID = types.UID(rand.String(36))
+	if !th.Observe(e) {
+		t.Errorf("Threshold should be reached for pod-1")
+	}
+}
+
+func TestThresholdCountIncrements(t *testing.T) {
+	e := createEvent("event", "pod")
+	e.UID = "repeated"
+	e.Count = 1
+
+	th := NewThreshold(config.ThresholdConfiguration{Count: 5, Window: time.Minute})
+	for i := 0; i < 5; i++ {
+		e.Count++
+		if th.Observe(e) {
+			t.Errorf("Updates to the same event should only be counted once without countIncrements")
+		}
+	}
+
+	e.Count = 1
+	th = NewThreshold(config.ThresholdConfiguration{Count: 5, Window: time.Minute, CountIncrements: true})
+	th.Observe(e)
+
+	e.Count = 3
+	if th.Observe(e) {
+		t.Errorf("Threshold should not be reached after 3 occurrences")
+	}
+
+	e.Count = 5
+	if !th.Observe(e) {
+		t.Errorf("Threshold should be reached after 5 occurrences")
+	}
+}
+
+func TestThresholdDefaultWindow(t *testing.T) {
+	th := NewThreshold(config.ThresholdConfiguration{Count: 2})
+
+	for i := 0; i < 2; i++ {
+		e := createEvent("event", "pod")
+		e.UID = types.UID(rand.String(36))
+		if th.Observe(e) != (i == 1) {
+			t.Errorf("Threshold without a window should count events over the default window")
+		}
+	}
+}
+
+func TestThresholdGroupByKind(t *testing.T) {
+	th := NewThreshold(config.ThresholdConfiguration{Count: 2, Window: time.Minute, GroupBy: GroupByKind})
+
+	e := createEvent("event", "pod")
+	e.UID = types.UID(rand.String(36))
+	th.Observe(e)
+
+	e = createEvent("event", "cluster")
+	e.UID = types.UID(rand.String(36))
+	e.InvolvedObject.Kind = "CouchbaseCluster"
+	if th.Observe(e) {
+		t.Errorf("Events for different kinds should be counted separately")
+	}
+
+	e = createEvent("event", "pod-2")
+	e.UID = types.UID(rand.String(36))
+	if !th.Observe(e) {
+		t.Errorf("Threshold should be reached for the kind")
+	}
+}